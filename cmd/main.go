@@ -1,23 +1,28 @@
 package main
 
 import (
+	"context"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	_ "github.com/P1coFly/CarInfoEM/docs"
+	grpcserver "github.com/P1coFly/CarInfoEM/grpc-server"
 	"github.com/P1coFly/CarInfoEM/http-server/carinfo"
-	"github.com/P1coFly/CarInfoEM/http-server/handlers/adder"
-	"github.com/P1coFly/CarInfoEM/http-server/handlers/deleter"
-	"github.com/P1coFly/CarInfoEM/http-server/handlers/getter"
-	"github.com/P1coFly/CarInfoEM/http-server/handlers/patcher"
+	"github.com/P1coFly/CarInfoEM/http-server/router"
+	"github.com/P1coFly/CarInfoEM/http-server/schema"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
 	"github.com/P1coFly/CarInfoEM/internal/config"
+	"github.com/P1coFly/CarInfoEM/internal/dispatcher"
+	"github.com/P1coFly/CarInfoEM/internal/events"
+	"github.com/P1coFly/CarInfoEM/internal/purge"
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+	"github.com/P1coFly/CarInfoEM/internal/resync"
 	"github.com/P1coFly/CarInfoEM/internal/storage/postgresql"
-	"github.com/go-chi/chi"
-	"github.com/go-chi/chi/middleware"
 	"github.com/joho/godotenv"
-	httpSwagger "github.com/swaggo/http-swagger"
 )
 
 // При изменение анотации swagger, перед запуском контейнера, надо сгенерировать документацию
@@ -29,6 +34,11 @@ import (
 
 // @host localhost:8080
 // @BasePath /
+
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name X-API-Key
+// @description API key, can also be passed as Authorization: Bearer <key>
 func main() {
 	// Загружаем файл .ENV
 	if err := godotenv.Load(); err != nil {
@@ -52,26 +62,165 @@ func main() {
 	}
 	log.Info("connect to db is successful", "host", cfg.HostDB)
 
+	// события изменений машин рассылаются подписчикам ленты по уведомлениям Postgres,
+	// так их получают и изменения, сделанные другими экземплярами сервиса
+	hub := events.NewHub()
+	storage.SetPublisher(hub)
+	go storage.Listen(context.Background(), log)
+
 	// инициализируем объект для получения информации из внешнего сервиса
 	carinfo := carinfo.New(cfg.HostCarInfo)
+	// версия схемы ответов по умолчанию, клиент может выбрать другую заголовком X-Schema-Version
+	schemaVersion := schema.V1
+	if cfg.SchemaVersion != "" {
+		schemaVersion, err = schema.Parse(cfg.SchemaVersion)
+		if err != nil {
+			log.Error("invalid SCHEMA_VERSION", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// сколько хранится ответ на запрос с Idempotency-Key
+	idempotencyTTL := 24 * time.Hour
+	if cfg.IdempotencyTTL != "" {
+		idempotencyTTL, err = time.ParseDuration(cfg.IdempotencyTTL)
+		if err != nil {
+			log.Error("invalid IDEMPOTENCY_TTL", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// удалённые машины окончательно удаляются после SOFT_DELETE_RETENTION
+	softDeleteRetention := 30 * 24 * time.Hour
+	if cfg.SoftDeleteRetention != "" {
+		softDeleteRetention, err = time.ParseDuration(cfg.SoftDeleteRetention)
+		if err != nil {
+			log.Error("invalid SOFT_DELETE_RETENTION", "error", err)
+			os.Exit(1)
+		}
+	}
+	purgeInterval := time.Hour
+	if cfg.PurgeInterval != "" {
+		purgeInterval, err = time.ParseDuration(cfg.PurgeInterval)
+		if err != nil || purgeInterval <= 0 {
+			log.Error("invalid PURGE_INTERVAL", "error", err)
+			os.Exit(1)
+		}
+	}
+	go purge.Run(context.Background(), log, storage, purgeInterval, softDeleteRetention)
+
+	// данные из CarInfo старше CARINFO_MAX_AGE запрашиваются заново
+	carInfoMaxAge := 7 * 24 * time.Hour
+	if cfg.CarInfoMaxAge != "" {
+		carInfoMaxAge, err = time.ParseDuration(cfg.CarInfoMaxAge)
+		if err != nil {
+			log.Error("invalid CARINFO_MAX_AGE", "error", err)
+			os.Exit(1)
+		}
+	}
+	resyncInterval := time.Hour
+	if cfg.ResyncInterval != "" {
+		resyncInterval, err = time.ParseDuration(cfg.ResyncInterval)
+		if err != nil || resyncInterval <= 0 {
+			log.Error("invalid RESYNC_INTERVAL", "error", err)
+			os.Exit(1)
+		}
+	}
+	go resync.Run(context.Background(), log, storage, carinfo, resyncInterval, carInfoMaxAge)
+
+	// вебхуки отправляются из очереди в БД, записанной вместе с изменениями
+	go dispatcher.Run(context.Background(), log, storage, 5*time.Second)
+
+	// клиенты аутентифицируются API ключами из БД, служебный ключ из ADMIN_API_KEY
+	// нужен, чтобы выпустить первые ключи
+	authenticators := []auth.Authenticator{auth.NewAPIKeys(storage)}
+	switch {
+	case cfg.AdminAPIKey == "":
+		log.Info("ADMIN_API_KEY is not set, admin key is disabled")
+	case len(cfg.AdminAPIKey) < auth.MinStaticTokenLength:
+		log.Error("ADMIN_API_KEY is too short", slog.Int("min_length", auth.MinStaticTokenLength))
+		os.Exit(1)
+	default:
+		admin := auth.Principal{Subject: "admin", Scopes: []string{auth.ScopeAdmin}}
+		authenticators = append(authenticators, auth.NewStatic(cfg.AdminAPIKey, admin))
+	}
+
+	// токены корпоративного шлюза проверяются по ключам из JWT_JWKS, права даёт роль из токена
+	if cfg.JWT.JWKS != "" {
+		jwks := auth.NewJWKS(cfg.JWT.JWKS)
+		if err := jwks.Load(context.Background()); err != nil {
+			log.Error("failed to load JWT_JWKS", "error", err)
+			os.Exit(1)
+		}
+		authenticators = append(authenticators, auth.NewJWT(jwks, auth.JWTOptions{
+			Issuer:      cfg.JWT.Issuer,
+			Audience:    cfg.JWT.Audience,
+			RolesClaim:  cfg.JWT.RolesClaim,
+			TenantClaim: cfg.JWT.TenantClaim,
+		}))
+	}
+	authenticator := auth.Chain(authenticators...)
+
+	// лимиты запросов считаются отдельно для чтения, изменений и запросов к CarInfo,
+	// а все запросы с одного IP ограничиваются ещё до проверки токена
+	rateLimits := map[ratelimit.Budget]ratelimit.Limit{
+		ratelimit.Read:    {Burst: 600, Period: time.Minute},
+		ratelimit.Write:   {Burst: 120, Period: time.Minute},
+		ratelimit.CarInfo: {Burst: 100, Period: time.Minute},
+		ratelimit.IP:      {Burst: 1200, Period: time.Minute},
+	}
+	for budget, value := range map[ratelimit.Budget]string{
+		ratelimit.Read:    cfg.RateLimit.Read,
+		ratelimit.Write:   cfg.RateLimit.Write,
+		ratelimit.CarInfo: cfg.RateLimit.CarInfo,
+		ratelimit.IP:      cfg.RateLimit.IP,
+	} {
+		if value == "" {
+			continue
+		}
+		rateLimits[budget], err = ratelimit.ParseLimit(value)
+		if err != nil {
+			log.Error("invalid RATE_LIMIT_"+strings.ToUpper(string(budget)), "error", err)
+			os.Exit(1)
+		}
+	}
+	// в Postgres корзины общие для всех экземпляров сервиса
+	var rateLimitStore ratelimit.Store
+	switch cfg.RateLimit.Store {
+	case "", "memory":
+		rateLimitStore = ratelimit.NewMemoryStore()
+	case "postgres":
+		rateLimitStore = storage
+	default:
+		log.Error("invalid RATE_LIMIT_STORE", "store", cfg.RateLimit.Store)
+		os.Exit(1)
+	}
+	limiter := ratelimit.New(rateLimitStore, rateLimits)
+
 	// инициализируем router
-	router := chi.NewRouter()
-
-	// добавляем endpoints
-	router.Use(middleware.RequestID)
-	router.Use(middleware.Logger)
-	router.Use(middleware.Recoverer)
-	router.Use(middleware.URLFormat)
-	//добавляем endpoint ge
-	router.Delete("/car/delete/{id}", deleter.New(log, storage))
-	router.Patch("/car/patch/{id}", patcher.New(log, storage))
-	router.Get("/cars", getter.New(log, storage))
-	router.Post("/car/add", adder.New(log, storage, carinfo))
-
-	//Для доступа к swagger надо пройти по URI /swagger/
-	router.Get("/swagger/*", httpSwagger.Handler(
-		httpSwagger.URL("/swagger/doc.json"), //По URI /swagger/doc.json будет ледать спецификация в формате JSON
-	))
+	router := router.New(log, storage, carinfo, hub, router.Options{
+		DefaultSchema:  schemaVersion,
+		IdempotencyTTL: idempotencyTTL,
+		Authenticator:  authenticator,
+		Limiter:        limiter,
+	})
+
+	// gRPC API работает с тем же хранилищем и CarInfo на отдельном порту
+	if cfg.GRPCPort != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCPort)
+		if err != nil {
+			log.Error("failed to listen grpc port", "error", err)
+			os.Exit(1)
+		}
+		grpcSrv := grpcserver.New(log, storage, carinfo, authenticator, limiter)
+
+		log.Info("starting grpc server", slog.String("port", cfg.GRPCPort))
+		go func() {
+			if err := grpcSrv.Serve(lis); err != nil {
+				log.Error("failed to start grpc server", "error", err)
+			}
+		}()
+	}
 
 	log.Info("starting server", slog.String("port", cfg.Port))
 
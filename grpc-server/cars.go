@@ -0,0 +1,199 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	carsv1 "github.com/P1coFly/CarInfoEM/api/proto/cars/v1"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	"github.com/go-chi/chi/middleware"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// размер страницы List по умолчанию и максимальный
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type carService struct {
+	carsv1.UnimplementedCarServiceServer
+
+	log     *slog.Logger
+	storage Storage
+	carInfo CarInfo
+}
+
+// addRequest - проверяемая часть AddRequest, имена полей как в proto
+type addRequest struct {
+	RegNums []string `json:"reg_nums" validate:"required,min=1,max=100,dive,regnum"`
+}
+
+func (s *carService) Add(ctx context.Context, req *carsv1.AddRequest) (*carsv1.AddResponse, error) {
+	const op = "grpcserver.CarService.Add"
+
+	log := s.logger(ctx, op)
+
+	if err := validateRequest(addRequest{RegNums: req.GetRegNums()}); err != nil {
+		return nil, err
+	}
+	// каждый номер - отдельный запрос к CarInfo
+	if err := takeTokens(ctx, log, ratelimit.CarInfo, len(req.GetRegNums())); err != nil {
+		return nil, err
+	}
+
+	// как и в REST, ошибка одного номера не прерывает добавление остальных,
+	// не добавленные номера перечислены в failed
+	resp := &carsv1.AddResponse{}
+	for _, regNum := range req.GetRegNums() {
+		newCar, _, err := s.carInfo.Get(regNum)
+		if err != nil {
+			resp.Failed = append(resp.Failed, &carsv1.FailedCar{RegNum: regNum, Code: err_response.CodeCarInfo, Message: err.Error()})
+			continue
+		}
+
+		// проверяем данные, полученные из внешнего сервиса
+		if violations, err := validation.Struct(newCar); err != nil || len(violations) > 0 {
+			resp.Failed = append(resp.Failed, &carsv1.FailedCar{RegNum: regNum, Code: err_response.CodeValidation,
+				Message: fmt.Sprintf("invalid car data from carinfo: %v", violations)})
+			continue
+		}
+
+		carID, err := s.storage.AddCar(ctx, newCar, car.SourceCarInfo)
+		if errors.Is(err, storage.ErrCarExists) {
+			resp.Failed = append(resp.Failed, &carsv1.FailedCar{RegNum: regNum, Code: err_response.CodeConflict, Message: storage.ErrCarExists.Error()})
+			continue
+		}
+		if err != nil {
+			log.Error("failed to add car", slog.String("reg_num", regNum), "error", err)
+			resp.Failed = append(resp.Failed, &carsv1.FailedCar{RegNum: regNum, Code: err_response.CodeStorage, Message: "failed to save car"})
+			continue
+		}
+		resp.CarIds = append(resp.CarIds, int64(carID))
+	}
+
+	return resp, nil
+}
+
+func (s *carService) Get(ctx context.Context, req *carsv1.GetRequest) (*carsv1.Car, error) {
+	const op = "grpcserver.CarService.Get"
+
+	log := s.logger(ctx, op)
+
+	cwo, err := s.storage.GetCar(ctx, int(req.GetId()), nil, req.GetIncludeDeleted())
+	if err != nil {
+		return nil, statusError(log, err, "failed to get car")
+	}
+
+	return toProto(ctx, cwo), nil
+}
+
+func (s *carService) List(req *carsv1.ListRequest, stream carsv1.CarService_ListServer) error {
+	const op = "grpcserver.CarService.List"
+
+	ctx := stream.Context()
+	log := s.logger(ctx, op)
+
+	filter, err := fromProtoFilter(req.GetFilter())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	// как и в REST, без права на персональные данные искать по имени владельца нельзя
+	if filter.UsesOwnerName() && !auth.ShowOwners(ctx) {
+		return status.Error(codes.PermissionDenied, "missing scope "+auth.ScopeOwnersRead)
+	}
+
+	pageSize := int(req.GetPageSize())
+	switch {
+	case pageSize == 0:
+		pageSize = defaultPageSize
+	case pageSize < 0 || pageSize > maxPageSize:
+		return status.Errorf(codes.InvalidArgument, "page_size must be between 1 and %d", maxPageSize)
+	}
+
+	// читаем страницами, чтобы не держать в памяти всю выборку
+	for page := 1; ; page++ {
+		cars, err := s.storage.GetCars(ctx, pageSize, page, filter, nil)
+		if err != nil {
+			return statusError(log, err, "failed to get cars")
+		}
+		for _, cwo := range cars {
+			if err := stream.Send(toProto(ctx, cwo)); err != nil {
+				return err
+			}
+		}
+		if len(cars) < pageSize {
+			return nil
+		}
+	}
+}
+
+func (s *carService) Patch(ctx context.Context, req *carsv1.PatchRequest) (*carsv1.Car, error) {
+	const op = "grpcserver.CarService.Patch"
+
+	log := s.logger(ctx, op)
+
+	pc, err := fromProtoPatch(req.GetCar(), req.GetUpdateMask().GetPaths())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateRequest(pc); err != nil {
+		return nil, err
+	}
+
+	carID := int(req.GetId())
+	if _, err := s.storage.PatchCar(ctx, carID, pc, int(req.GetVersion())); err != nil {
+		return nil, statusError(log, err, "failed to patch car")
+	}
+
+	cwo, err := s.storage.GetCar(ctx, carID, nil, false)
+	if err != nil {
+		return nil, statusError(log, err, "failed to get car")
+	}
+
+	return toProto(ctx, cwo), nil
+}
+
+func (s *carService) Delete(ctx context.Context, req *carsv1.DeleteRequest) (*emptypb.Empty, error) {
+	const op = "grpcserver.CarService.Delete"
+
+	log := s.logger(ctx, op)
+
+	if _, err := s.storage.DeleteCar(ctx, int(req.GetId()), int(req.GetVersion())); err != nil {
+		return nil, statusError(log, err, "failed to delete car")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *carService) logger(ctx context.Context, op string) *slog.Logger {
+	return s.log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(ctx)),
+	)
+}
+
+// переводим ошибку хранилища в статус gRPC, неизвестные ошибки логируем и скрываем от клиента
+func statusError(log *slog.Logger, err error, msg string) error {
+	switch {
+	case errors.Is(err, storage.ErrCarNotFound):
+		return status.Error(codes.NotFound, "car with this id was not found")
+	case errors.Is(err, storage.ErrVersionMismatch):
+		return status.Error(codes.Aborted, "car was changed, reload it and retry")
+	case errors.Is(err, storage.ErrCarExists):
+		return status.Error(codes.AlreadyExists, storage.ErrCarExists.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	log.Error(msg, "error", err)
+	return status.Error(codes.Internal, msg)
+}
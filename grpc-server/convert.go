@@ -0,0 +1,148 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	carsv1 "github.com/P1coFly/CarInfoEM/api/proto/cars/v1"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// без права на персональные данные имя и отчество владельца сокращаются до инициалов
+func toProto(ctx context.Context, cwo car.CarWithOwner) *carsv1.Car {
+	if !auth.ShowOwners(ctx) {
+		cwo = cwo.MaskOwner()
+	}
+
+	c := &carsv1.Car{
+		Id:               int64(cwo.Id),
+		RegNum:           cwo.RegNum,
+		Mark:             cwo.Mark,
+		Model:            cwo.Model,
+		Source:           cwo.Source,
+		CarinfoFetchTime: timestamp(cwo.CarInfoFetchedAt),
+		CreateTime:       timestamppb.New(cwo.CreatedAt),
+		UpdateTime:       timestamppb.New(cwo.UpdatedAt),
+		DeleteTime:       timestamp(cwo.DeletedAt),
+		Version:          int64(cwo.Version),
+		Owner: &carsv1.Owner{
+			Name:       cwo.Owner.Name,
+			Surname:    cwo.Owner.Surname,
+			Patronymic: cwo.Owner.Patronymic.Ptr(),
+			Source:     cwo.Owner.Source,
+			CreateTime: timestamppb.New(cwo.Owner.CreatedAt),
+			UpdateTime: timestamppb.New(cwo.Owner.UpdatedAt),
+		},
+	}
+	if cwo.Year.Valid {
+		year := int32(cwo.Year.Int16)
+		c.Year = &year
+	}
+	return c
+}
+
+func timestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func fromProtoFilter(f *carsv1.CarFilter) (car.CarFilter, error) {
+	filter := car.CarFilter{
+		YearFilter:       f.GetYear(),
+		RegNumFilter:     f.GetRegNum(),
+		ModelFilter:      f.GetModel(),
+		MarkFilter:       f.GetMark(),
+		NameFilter:       f.GetOwnerName(),
+		SurnameFilter:    f.GetOwnerSurname(),
+		PatronymicFilter: f.GetOwnerPatronymic(),
+		IncludeDeleted:   f.GetIncludeDeleted(),
+	}
+	if f.GetUpdatedSince() != nil {
+		filter.UpdatedSince = f.GetUpdatedSince().AsTime()
+	}
+	if filter.YearFilter != "" {
+		if _, _, err := filter.YearRange(); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// собираем патч из полей машины, перечисленных в маске.
+// Поля year и owner.patronymic без значения очищаются
+func fromProtoPatch(c *carsv1.Car, paths []string) (car.PatchCar, error) {
+	var pc car.PatchCar
+	if len(paths) == 0 {
+		return pc, fmt.Errorf("update_mask is required")
+	}
+
+	for _, path := range paths {
+		switch path {
+		case "reg_num":
+			pc.RegNum = car.NewPatchField(c.GetRegNum())
+		case "mark":
+			pc.Mark = car.NewPatchField(c.GetMark())
+		case "model":
+			pc.Model = car.NewPatchField(c.GetModel())
+		case "year":
+			pc.Year = car.PatchField[int16]{Set: true, Null: c == nil || c.Year == nil}
+			if !pc.Year.Null {
+				year := c.GetYear()
+				// значение вне int16 заведомо не проходит проверку года
+				if year < -1<<15 || year > 1<<15-1 {
+					year = 0
+				}
+				pc.Year.Value = int16(year)
+			}
+		case "owner.name":
+			pc.Name = car.NewPatchField(c.GetOwner().GetName())
+		case "owner.surname":
+			pc.Surname = car.NewPatchField(c.GetOwner().GetSurname())
+		case "owner.patronymic":
+			patronymic := c.GetOwner().Patronymic
+			pc.Patronymic = car.PatchField[string]{Set: true, Null: patronymic == nil}
+			if patronymic != nil {
+				pc.Patronymic.Value = *patronymic
+			}
+		default:
+			return pc, fmt.Errorf("field %q can not be updated", path)
+		}
+	}
+	return pc, nil
+}
+
+// путь к полю в JSON переводим в имена полей proto
+func protoFieldPath(path string) string {
+	return strings.ReplaceAll(path, "regNum", "reg_num")
+}
+
+// проверяем запрос по правилам валидации, нарушения возвращаем в деталях статуса
+func validateRequest(req any) error {
+	violations, err := validation.Struct(req)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to validate request")
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	br := &errdetails.BadRequest{}
+	for _, v := range violations {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: protoFieldPath(v.Field), Description: v.Message})
+	}
+	st, err := status.New(codes.InvalidArgument, "request is invalid").WithDetails(br)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "request is invalid")
+	}
+	return st.Err()
+}
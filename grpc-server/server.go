@@ -0,0 +1,233 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	carsv1 "github.com/P1coFly/CarInfoEM/api/proto/cars/v1"
+	"github.com/P1coFly/CarInfoEM/internal/actor"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/go-chi/chi/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Ключи метаданных запроса, аналоги заголовков REST API
+const (
+	AuthorizationKey = "authorization"
+	APIKeyKey        = "x-api-key"
+	RequestIDKey     = "x-request-id"
+	TenantKey        = "x-tenant-id"
+)
+
+// бюджеты лимитов запросов, из которых списывается вызов
+var methodBudgets = map[string]ratelimit.Budget{
+	carsv1.CarService_Add_FullMethodName:    ratelimit.Write,
+	carsv1.CarService_Get_FullMethodName:    ratelimit.Read,
+	carsv1.CarService_List_FullMethodName:   ratelimit.Read,
+	carsv1.CarService_Patch_FullMethodName:  ratelimit.Write,
+	carsv1.CarService_Delete_FullMethodName: ratelimit.Write,
+}
+
+// права, нужные для вызова методов
+var methodScopes = map[string]string{
+	carsv1.CarService_Add_FullMethodName:    auth.ScopeCarsWrite,
+	carsv1.CarService_Get_FullMethodName:    auth.ScopeCarsRead,
+	carsv1.CarService_List_FullMethodName:   auth.ScopeCarsRead,
+	carsv1.CarService_Patch_FullMethodName:  auth.ScopeCarsWrite,
+	carsv1.CarService_Delete_FullMethodName: auth.ScopeCarsDelete,
+}
+
+// Storage - методы хранилища, которые нужны gRPC API
+type Storage interface {
+	AddCar(ctx context.Context, car car.Car, source string) (int, error)
+	GetCar(ctx context.Context, carID int, fields []string, includeDeleted bool) (car.CarWithOwner, error)
+	GetCars(ctx context.Context, pageSize, pageToken int, carFilter car.CarFilter, fields []string) ([]car.CarWithOwner, error)
+	PatchCar(ctx context.Context, carID int, pc car.PatchCar, version int) (int, error)
+	DeleteCar(ctx context.Context, carID, version int) (int, error)
+}
+
+type CarInfo interface {
+	Get(regNum string) (car.Car, int, error)
+}
+
+// New собирает gRPC сервер с CarService.
+// Токен клиента передаётся в метаданных authorization (Bearer) или x-api-key, идентификатор запроса - в x-request-id,
+// администратор выбирает арендатора в x-tenant-id
+// limiter ограничивает частоту вызовов клиента так же, как в REST API, nil - без ограничений
+func New(log *slog.Logger, storage Storage, carInfo CarInfo, authenticator auth.Authenticator, limiter *ratelimit.Limiter) *grpc.Server {
+	a := &authorizer{log: log, authenticator: authenticator, limiter: limiter}
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryInterceptor(log, a)),
+		grpc.ChainStreamInterceptor(streamInterceptor(log, a)),
+	)
+	carsv1.RegisterCarServiceServer(srv, &carService{log: log, storage: storage, carInfo: carInfo})
+
+	return srv
+}
+
+// переносим в контекст идентификатор запроса, как это делает middleware REST API
+func withRequestID(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	reqID := first(md.Get(RequestIDKey))
+	if reqID == "" {
+		reqID = fmt.Sprintf("grpc-%06d", middleware.NextRequestID())
+	}
+	return context.WithValue(ctx, middleware.RequestIDKey, reqID)
+}
+
+// authorizer аутентифицирует вызов и проверяет права на метод
+type authorizer struct {
+	log           *slog.Logger
+	authenticator auth.Authenticator
+	limiter       *ratelimit.Limiter
+}
+
+// authorize возвращает контекст с клиентом, он же становится исполнителем для журнала изменений.
+// Вызов списывает токен из бюджета метода
+func (a *authorizer) authorize(ctx context.Context, method string) (context.Context, error) {
+	const op = "grpcserver.authorize"
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := first(md.Get(APIKeyKey))
+	if h := first(md.Get(AuthorizationKey)); h != "" {
+		scheme, t, ok := strings.Cut(h, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return ctx, status.Error(codes.Unauthenticated, "invalid authorization metadata")
+		}
+		token = strings.TrimSpace(t)
+	}
+	if token == "" {
+		return ctx, status.Error(codes.Unauthenticated, "authentication required")
+	}
+
+	p, err := a.authenticator.Authenticate(ctx, token)
+	if err != nil {
+		if errors.Is(err, auth.ErrUnauthenticated) || errors.Is(err, auth.ErrUnsupported) {
+			return ctx, status.Error(codes.Unauthenticated, "invalid credentials")
+		}
+		a.log.Error("failed to authenticate", slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(ctx)), "error", err)
+		return ctx, status.Error(codes.Internal, "failed to authenticate")
+	}
+
+	scope, ok := methodScopes[method]
+	if !ok {
+		scope = auth.ScopeAdmin
+	}
+	if !p.HasScope(scope) {
+		return ctx, status.Error(codes.PermissionDenied, "missing scope "+scope)
+	}
+
+	tenantID, err := p.ResolveTenant(strings.TrimSpace(first(md.Get(TenantKey))))
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidTenant) {
+			return ctx, status.Error(codes.InvalidArgument, "invalid "+TenantKey)
+		}
+		return ctx, status.Error(codes.PermissionDenied, "access to tenant denied")
+	}
+
+	ctx = auth.WithPrincipal(ctx, p)
+	ctx = actor.WithActor(ctx, p.Subject)
+	ctx = tenant.WithTenant(ctx, tenantID)
+	ctx = ratelimit.WithClient(ctx, a.limiter, tenantID+"/"+p.Subject)
+
+	budget, ok := methodBudgets[method]
+	if !ok {
+		budget = ratelimit.Write
+	}
+	if err := takeTokens(ctx, a.log, budget, 1); err != nil {
+		return ctx, err
+	}
+	return ctx, nil
+}
+
+// takeTokens списывает токены клиента, при недоступном хранилище лимитов вызов выполняется
+func takeTokens(ctx context.Context, log *slog.Logger, budget ratelimit.Budget, n int) error {
+	res, err := ratelimit.Take(ctx, budget, n)
+	if errors.Is(err, ratelimit.ErrBatchTooLarge) {
+		return status.Errorf(codes.InvalidArgument, "batch of %d exceeds the %s rate limit burst of %d", n, budget, res.Limit)
+	}
+	if err != nil {
+		log.Error("failed to take rate limit tokens",
+			slog.String("request_id", middleware.GetReqID(ctx)), "error", err)
+		return nil
+	}
+	if !res.Allowed {
+		return status.Errorf(codes.ResourceExhausted, "%s rate limit exceeded, retry in %.0f seconds",
+			budget, math.Ceil(res.RetryAfter.Seconds()))
+	}
+	return nil
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func unaryInterceptor(log *slog.Logger, a *authorizer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx = withRequestID(ctx)
+		start := time.Now()
+
+		ctx, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			logCall(log, ctx, info.FullMethod, start, err)
+			return nil, err
+		}
+
+		resp, err := handler(ctx, req)
+		logCall(log, ctx, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+func streamInterceptor(log *slog.Logger, a *authorizer) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := withRequestID(ss.Context())
+		start := time.Now()
+
+		ctx, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			logCall(log, ctx, info.FullMethod, start, err)
+			return err
+		}
+
+		err = handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		logCall(log, ctx, info.FullMethod, start, err)
+		return err
+	}
+}
+
+// serverStream подменяет контекст потока
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func logCall(log *slog.Logger, ctx context.Context, method string, start time.Time, err error) {
+	log.Info("grpc call",
+		slog.String("method", method),
+		slog.String("request_id", middleware.GetReqID(ctx)),
+		slog.String("actor", actor.FromContext(ctx)),
+		slog.String("code", status.Code(err).String()),
+		slog.Duration("duration", time.Since(start)),
+	)
+}
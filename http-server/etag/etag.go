@@ -0,0 +1,63 @@
+package etag
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalid = errors.New("invalid ETag in If-Match, expected a single \"<version>\", ETag from GET or *")
+
+// Format формирует ETag по версии записи
+func Format(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// FormatVariant формирует слабый ETag представления записи: одна версия отдаётся по-разному
+// в зависимости от variant, например набора полей или схемы ответа
+func FormatVariant(version int, variant ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(variant, "\n")))
+	return `W/"` + strconv.Itoa(version) + "-" + hex.EncodeToString(h[:4]) + `"`
+}
+
+// IfMatch возвращает версию из заголовка If-Match.
+// 0 означает, что заголовок не передан или равен *, и проверка версии не нужна
+func IfMatch(r *http.Request) (int, error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return 0, nil
+	}
+
+	// списки не поддерживаем. ETag из GET принимается целиком: версия записи - его начало до варианта представления
+	h = strings.TrimPrefix(h, "W/")
+	if !strings.HasPrefix(h, `"`) || !strings.HasSuffix(h, `"`) || len(h) < 2 {
+		return 0, ErrInvalid
+	}
+	v, _, _ := strings.Cut(h[1:len(h)-1], "-")
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return 0, ErrInvalid
+	}
+	return version, nil
+}
+
+// NoneMatch сообщает, совпадает ли current с одним из ETag в If-None-Match.
+// Для If-None-Match используется слабое сравнение
+func NoneMatch(r *http.Request, current string) bool {
+	h := r.Header.Get("If-None-Match")
+	if h == "" {
+		return false
+	}
+
+	current = strings.TrimPrefix(current, "W/")
+	for _, tag := range strings.Split(h, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
@@ -1,21 +1,31 @@
 package adder
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 
 	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/http-server/middleware/throttle"
+	"github.com/P1coFly/CarInfoEM/http-server/schema"
 	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 )
 
 type Request struct {
-	RegNums []string `json:"reg_num" example:"X123XX150"`
+	RegNums []string `json:"regNums" example:"X123XX150" validate:"required,min=1,max=100,dive,regnum"`
+	// LegacyRegNums - поле из исходной схемы, принимается для совместимости
+	LegacyRegNums []string `json:"reg_num,omitempty" swaggerignore:"true"`
 } //@name RegNums
 
 type AddCar interface {
-	AddCar(car car.Car) (int, error)
+	AddCar(ctx context.Context, car car.Car, source string) (int, error)
 }
 
 type CarInfo interface {
@@ -28,17 +38,39 @@ type AddResponse struct {
 	CarsID     []int    `json:"cars_id,omitempty"`
 }
 
+// FailedCar - номер, который не удалось добавить, в схеме V2
+type FailedCar struct {
+	RegNum  string `json:"regNum" example:"X123XX150"`
+	Code    string `json:"code" example:"carinfo_failed"`
+	Message string `json:"message"`
+}
+
+// AddResult - результат добавления в схеме V2
+type AddResult struct {
+	CarIDs []int       `json:"carIds"`
+	Failed []FailedCar `json:"failed"`
+}
+
+// AddResponseV2 - ответ в схеме V2
+type AddResponseV2 struct {
+	Data AddResult `json:"data"`
+}
+
 // @Summary Add
 // @Tags car
-// @Description add car
+// @Description add car. /api/v1 always answers with schema 2, deprecated routes pick the schema with the X-Schema-Version header
 // @Accept json
 // @Produce json
+// @Param X-Schema-Version header int false "Response schema version for deprecated routes"
+// @Param Idempotency-Key header string false "Key to safely retry the request, the first response is replayed for repeats"
 // @Param input body RegNums true "Array of new car registration numbers"
-// @Success 201,206 {object} AddResponse
-// @Failure 400 {object} err_response.Response
-// @Failure 500 {object} err_response.Response
-// @Failure default {object} err_response.Response
-// @Router /car/add [post]
+// @Success 201,206 {object} AddResponseV2
+// @Failure 400,409,422,429 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars [post]
+// @DeprecatedRouter /car/add [post]
 func New(log *slog.Logger, adder AddCar, carInfo CarInfo) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.AddCar.New"
@@ -52,33 +84,73 @@ func New(log *slog.Logger, adder AddCar, carInfo CarInfo) http.HandlerFunc {
 		var req Request
 		if err := render.DecodeJSON(r.Body, &req); err != nil {
 			log.Error("failed to decode request body", "error", err)
-			w.WriteHeader(400)
-			render.JSON(w, r, err_response.Error("failed to decode request body"))
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to decode request body")
 			return
 		}
+		if len(req.RegNums) == 0 {
+			req.RegNums = req.LegacyRegNums
+		}
 
-		log.Info("request body decoded", slog.Any("request", req))
+		violations, err := validation.Struct(req)
+		if err != nil {
+			log.Error("failed to validate request", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to validate request")
+			return
+		}
+		if len(violations) > 0 {
+			log.Info("invalid request", slog.Any("violations", violations))
+			err_response.RenderViolations(w, r, violations)
+			return
+		}
+
+		log.Info("request body decoded", slog.Int("reg_nums", len(req.RegNums)))
+
+		// каждый номер - отдельный запрос к CarInfo
+		if !throttle.Take(log, w, r, ratelimit.CarInfo, len(req.RegNums)) {
+			return
+		}
 
 		/*отправляем regNum в carInfo
 		получаем объект car и записываем в бд
 		в случаи ошибки запоминаем её и переходим к следующему regNum*/
 		var failedCars []string
-		var errors []error
-		var successfulCarIDs []int
+		var errs []error
+		failed := []FailedCar{}
+		successfulCarIDs := []int{}
 		var code int
 		for _, regNum := range req.RegNums {
-			car, temp, err := carInfo.Get(regNum)
+			newCar, temp, err := carInfo.Get(regNum)
 			code = temp
 			if err != nil {
 				failedCars = append(failedCars, regNum)
-				errors = append(errors, err)
+				errs = append(errs, err)
+				failed = append(failed, FailedCar{RegNum: regNum, Code: err_response.CodeCarInfo, Message: err.Error()})
+				continue
+			}
+
+			// проверяем данные, полученные из внешнего сервиса
+			if violations, err := validation.Struct(newCar); err != nil || len(violations) > 0 {
+				code = 502
+				failedCars = append(failedCars, regNum)
+				errs = append(errs, fmt.Errorf("invalid car data from carinfo: %v", violations))
+				failed = append(failed, FailedCar{RegNum: regNum, Code: err_response.CodeValidation,
+					Message: fmt.Sprintf("invalid car data from carinfo: %v", violations)})
 				continue
 			}
 
-			carID, err := adder.AddCar(car)
+			carID, err := adder.AddCar(r.Context(), newCar, car.SourceCarInfo)
+			if errors.Is(err, storage.ErrCarExists) {
+				code = 409
+				failedCars = append(failedCars, regNum)
+				errs = append(errs, err)
+				failed = append(failed, FailedCar{RegNum: regNum, Code: err_response.CodeConflict, Message: storage.ErrCarExists.Error()})
+				continue
+			}
 			if err != nil {
+				code = 500
 				failedCars = append(failedCars, regNum)
-				errors = append(errors, err)
+				errs = append(errs, err)
+				failed = append(failed, FailedCar{RegNum: regNum, Code: err_response.CodeStorage, Message: "failed to save car"})
 				continue
 			}
 			successfulCarIDs = append(successfulCarIDs, carID)
@@ -86,24 +158,26 @@ func New(log *slog.Logger, adder AddCar, carInfo CarInfo) http.HandlerFunc {
 
 		//Если со всеми regNum случилась ошибка
 		if len(failedCars) == len(req.RegNums) {
-			w.WriteHeader(code)
-			render.JSON(w, r, err_response.Error("failed to add cars"))
+			err_response.Render(w, r, code, failed[len(failed)-1].Code, "failed to add cars")
 			return
 		}
+
+		status := 201
 		//Если частично с regNum случилась ошибка
 		if len(failedCars) > 0 {
-			w.WriteHeader(206)
+			status = 206
+		}
+		render.Status(r, status)
+
+		if schema.FromContext(r.Context()) == schema.V1 {
 			render.JSON(w, r, AddResponse{
 				FailedCars: failedCars,
-				Errors:     errors,
+				Errors:     errs,
 				CarsID:     successfulCarIDs,
 			})
 			return
 		}
 
-		w.WriteHeader(201)
-		render.JSON(w, r, AddResponse{
-			CarsID: successfulCarIDs,
-		})
+		render.JSON(w, r, AddResponseV2{Data: AddResult{CarIDs: successfulCarIDs, Failed: failed}})
 	}
 }
@@ -0,0 +1,181 @@
+package apikeys
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/models/apikey"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+type KeyStore interface {
+	CreateAPIKey(ctx context.Context, key apikey.Key, hash string) (apikey.Key, error)
+	GetAPIKeys(ctx context.Context) ([]apikey.Key, error)
+	RevokeAPIKey(ctx context.Context, id int64) error
+}
+
+type CreateRequest struct {
+	Name   string   `json:"name" example:"billing" validate:"required,max=100"`
+	Scopes []string `json:"scopes" example:"cars:read,cars:write" validate:"required,min=1,dive,oneof=cars:read cars:write cars:delete owners:read admin"`
+}
+
+// CreatedKey - созданный ключ вместе с самим ключом, он показывается только один раз
+type CreatedKey struct {
+	apikey.Key
+	Secret string `json:"key" example:"cie_3f9a1c2b_..."`
+}
+
+type CreateResponse struct {
+	Data CreatedKey `json:"data"`
+}
+
+type ListResponse struct {
+	Data []apikey.Key `json:"data"`
+}
+
+// @Summary Create API key
+// @Tags api-keys
+// @Description create an API key, requires the admin scope. The key is returned only in this response,
+// @Description pass it in Authorization: Bearer <key> or X-API-Key
+// @Accept json
+// @Produce json
+// @Param input body CreateRequest true "key name and scopes"
+// @Success 201 {object} CreateResponse
+// @Failure 400,401,403,422 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/api-keys [post]
+func NewCreate(log *slog.Logger, store KeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.APIKeys.NewCreate"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//декодируем тело запроса
+		var req CreateRequest
+		if err := render.DecodeJSON(r.Body, &req); err != nil {
+			log.Error("failed to decode request body", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to decode request body")
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		violations, err := validation.Struct(req)
+		if err != nil {
+			log.Error("failed to validate request", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to validate request")
+			return
+		}
+		if len(violations) > 0 {
+			log.Info("invalid request", slog.Any("violations", violations))
+			err_response.RenderViolations(w, r, violations)
+			return
+		}
+
+		plain, prefix, hash, err := apikey.Generate()
+		if err != nil {
+			log.Error("failed to generate key", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to create api key")
+			return
+		}
+
+		key, err := store.CreateAPIKey(r.Context(), apikey.Key{Name: req.Name, Prefix: prefix, Scopes: req.Scopes}, hash)
+		if err != nil {
+			log.Error("failed to create api key", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to create api key")
+			return
+		}
+
+		log.Info("api key created", slog.Int64("id", key.ID), slog.String("prefix", key.Prefix))
+
+		render.Status(r, 201)
+		render.JSON(w, r, CreateResponse{Data: CreatedKey{Key: key, Secret: plain}})
+	}
+}
+
+// @Summary List API keys
+// @Tags api-keys
+// @Description get all API keys including revoked ones, requires the admin scope
+// @Produce json
+// @Success 200 {object} ListResponse
+// @Failure 401,403 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/api-keys [get]
+func NewList(log *slog.Logger, store KeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.APIKeys.NewList"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		keys, err := store.GetAPIKeys(r.Context())
+		if err != nil {
+			log.Error("failed to get api keys", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get api keys. Try later")
+			return
+		}
+
+		render.Status(r, 200)
+		render.JSON(w, r, ListResponse{Data: keys})
+	}
+}
+
+// @Summary Revoke API key
+// @Tags api-keys
+// @Description revoke an API key, requires the admin scope. Requests with a revoked key are rejected
+// @Produce json
+// @Param id path int true "API key ID"
+// @Success 204
+// @Failure 400,401,403,404 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/api-keys/{id} [delete]
+func NewRevoke(log *slog.Logger, store KeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.APIKeys.NewRevoke"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("failed to get api key ID from URL")
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get api key ID from URL")
+			return
+		}
+
+		if err := store.RevokeAPIKey(r.Context(), id); err != nil {
+			if errors.Is(err, storage.ErrAPIKeyNotFound) {
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "api key with this id was not found")
+				return
+			}
+			log.Error("failed to revoke api key", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to revoke api key")
+			return
+		}
+
+		log.Info("api key revoked", slog.Int64("id", id))
+
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,172 @@
+package auditlog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/models/audit"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+type AuditReader interface {
+	GetAuditRecords(ctx context.Context, filter audit.Filter, pageSize, pageToken int) ([]audit.Record, error)
+}
+
+// Meta - информация о странице журнала
+type Meta struct {
+	Page     int `json:"page"`
+	PageSize int `json:"pageSize"`
+}
+
+// ListResponse - страница журнала изменений
+type ListResponse struct {
+	Data []audit.Record `json:"data"`
+	Meta Meta           `json:"meta"`
+}
+
+// @Summary History
+// @Tags audit
+// @Description get the change history of a car, newest first. Deleted cars keep their history
+// @Produce json
+// @Param id path int true "Car ID"
+// @Param page_size query int false "Page size (default is 100) used for pagination" default:"100"
+// @Param page_token query int false "Page token (default is 1) used for pagination" default:"1"
+// @Success 200 {object} ListResponse
+// @Failure 400,403 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/{id}/history [get]
+func NewCarHistory(log *slog.Logger, reader AuditReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.AuditLog.NewCarHistory"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//пытаемсяя получить id с запроса
+		carID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			log.Error("failed to get car ID from URL")
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get car ID from URL")
+			return
+		}
+
+		list(w, r, log, reader, audit.Filter{CarID: carID})
+	}
+}
+
+// @Summary Audit
+// @Tags audit
+// @Description get the change journal of all cars, newest first
+// @Produce json
+// @Param actor query string false "Filter by actor"
+// @Param since query string false "Only changes made at or after this time (RFC 3339), example: 2024-01-02T15:04:05Z"
+// @Param page_size query int false "Page size (default is 100) used for pagination" default:"100"
+// @Param page_token query int false "Page token (default is 1) used for pagination" default:"1"
+// @Success 200 {object} ListResponse
+// @Failure 400,403 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/audit [get]
+func New(log *slog.Logger, reader AuditReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.AuditLog.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		filter := audit.Filter{Actor: r.URL.Query().Get("actor")}
+		if since := r.URL.Query().Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				log.Error("invalid since", "error", err)
+				err_response.Render(w, r, 400, err_response.CodeInvalidParam, "invalid since, need RFC 3339 time")
+				return
+			}
+			filter.Since = t
+		}
+
+		list(w, r, log, reader, filter)
+	}
+}
+
+// отдаём страницу журнала по фильтру
+func list(w http.ResponseWriter, r *http.Request, log *slog.Logger, reader AuditReader, filter audit.Filter) {
+	pageSize, err := pageParam(r, "page_size", 100)
+	if err != nil {
+		log.Error("invalid page_size", "error", err)
+		err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
+		return
+	}
+	pageToken, err := pageParam(r, "page_token", 1)
+	if err != nil {
+		log.Error("invalid page_token", "error", err)
+		err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
+		return
+	}
+
+	records, err := reader.GetAuditRecords(r.Context(), filter, pageSize, pageToken)
+	if err != nil {
+		log.Error("failed to get audit records", "error", err)
+		err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get audit records. Try later")
+		return
+	}
+
+	log.Info("audit records was got", slog.Int("count", len(records)))
+
+	// без права на персональные данные имена владельцев в снимках и изменениях сокращаются до инициалов
+	if !auth.ShowOwners(r.Context()) {
+		for i := range records {
+			if records[i], err = maskOwner(records[i]); err != nil {
+				log.Error("invalid audit snapshot", slog.Int64("audit_id", records[i].ID), "error", err)
+				err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get audit records. Try later")
+				return
+			}
+		}
+	}
+
+	render.Status(r, 200)
+	render.JSON(w, r, ListResponse{Data: records, Meta: Meta{Page: pageToken, PageSize: pageSize}})
+}
+
+func maskOwner(rec audit.Record) (audit.Record, error) {
+	var err error
+	if rec.Before, err = car.MaskDocument(rec.Before); err != nil {
+		return rec, err
+	}
+	if rec.After, err = car.MaskDocument(rec.After); err != nil {
+		return rec, err
+	}
+	for field, change := range rec.Diff {
+		rec.Diff[field] = audit.Change{From: car.MaskField(field, change.From), To: car.MaskField(field, change.To)}
+	}
+	return rec, nil
+}
+
+// получаем положительный параметр пагинации, если не указан - def
+func pageParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("incorrect %s, %s must be an integer greater than 0", name, name)
+	}
+	return v, nil
+}
@@ -0,0 +1,356 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+// DefaultMaxAffected - ограничение числа машин, если в запросе не указан maxAffected
+const DefaultMaxAffected = 100
+
+// Статусы обработки отдельной машины
+const (
+	StatusMatched   = "matched"
+	StatusDeleted   = "deleted"
+	StatusPatched   = "patched"
+	StatusUnchanged = "unchanged"
+	StatusNotFound  = "not_found"
+	StatusFailed    = "failed"
+)
+
+type CarFinder interface {
+	FindCarIDs(ctx context.Context, ids []int, carFilter car.CarFilter, limit int) ([]int, error)
+}
+
+type BatchDeleter interface {
+	CarFinder
+	DeleteCar(ctx context.Context, carID, version int) (int, error)
+}
+
+type BatchPatcher interface {
+	CarFinder
+	PatchCar(ctx context.Context, carID int, pc car.PatchCar, version int) (int, error)
+}
+
+// Filter - условия выбора машин, совпадают с параметрами фильтрации списка
+type Filter struct {
+	Year       string `json:"year" example:"2000:2023"`
+	RegNum     string `json:"regNum"`
+	Model      string `json:"model"`
+	Mark       string `json:"mark"`
+	Name       string `json:"name"`
+	Surname    string `json:"surname"`
+	Patronymic string `json:"patronymic"`
+}
+
+// Selector - какие машины затрагивает операция.
+// Если заданы и ids, и filter, выбираются машины из ids, подходящие под filter
+type Selector struct {
+	IDs    []int   `json:"ids" validate:"omitempty,max=1000,dive,min=1"`
+	Filter *Filter `json:"filter"`
+	// DryRun - только посчитать подходящие машины, ничего не меняя
+	DryRun bool `json:"dryRun"`
+	// MaxAffected - если подходящих машин больше, операция не выполняется
+	MaxAffected int `json:"maxAffected" validate:"omitempty,min=1,max=1000" example:"100"`
+}
+
+type DeleteRequest struct {
+	Selector
+}
+
+type PatchRequest struct {
+	Selector
+	Patch car.PatchCar `json:"patch"`
+}
+
+// LogValue не пишет в лог значения фильтра: в нём могут быть имена владельцев
+func (s Selector) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("ids", len(s.IDs)),
+		slog.Bool("filter", s.Filter != nil),
+		slog.Bool("dryRun", s.DryRun),
+		slog.Int("maxAffected", s.MaxAffected),
+	)
+}
+
+// Result - результат для одной машины
+type Result struct {
+	ID     int    `json:"id"`
+	Status string `json:"status" example:"deleted"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Summary - итог пакетной операции
+type Summary struct {
+	DryRun    bool     `json:"dryRun"`
+	Matched   int      `json:"matched"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	Results   []Result `json:"results"`
+}
+
+type Response struct {
+	Data Summary `json:"data"`
+}
+
+// @Summary Batch delete
+// @Tags car
+// @Description delete cars selected by ids and/or filter. With dryRun only the matching cars are returned.
+// @Description Nothing is deleted if more than maxAffected (default 100) cars match
+// @Accept json
+// @Produce json
+// @Param input body DeleteRequest true "cars to delete"
+// @Success 200 {object} Response
+// @Failure 400,403,409,422 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/batch-delete [post]
+func NewDelete(log *slog.Logger, deleter BatchDeleter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.Batch.NewDelete"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//декодируем тело запроса
+		var req DeleteRequest
+		if err := render.DecodeJSON(r.Body, &req); err != nil {
+			log.Error("failed to decode request body", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to decode request body")
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("selector", req.Selector))
+
+		if !validate(w, r, log, req, req.Selector) {
+			return
+		}
+
+		summary, ok := selectCars(w, r, log, deleter, req.Selector)
+		if !ok {
+			return
+		}
+
+		if !req.DryRun {
+			for i, res := range summary.Results {
+				if res.Status != StatusMatched {
+					continue
+				}
+				id, err := deleter.DeleteCar(r.Context(), res.ID, 0)
+				switch {
+				case err == nil:
+					summary.Results[i].Status = StatusDeleted
+				case id == -1:
+					// машину успели удалить между выбором и удалением
+					summary.Results[i].Status = StatusNotFound
+				default:
+					log.Error("failed to delete car", slog.Int("id", res.ID), "error", err)
+					summary.Results[i].Status = StatusFailed
+					summary.Results[i].Error = "failed to delete car"
+				}
+			}
+			summary.count()
+		}
+
+		log.Info("batch delete done", slog.Int("matched", summary.Matched), slog.Int("failed", summary.Failed))
+
+		render.Status(r, 200)
+		render.JSON(w, r, Response{Data: summary})
+	}
+}
+
+// @Summary Batch patch
+// @Tags car
+// @Description apply one patch to cars selected by ids and/or filter. With dryRun only the matching cars are returned.
+// @Description Nothing is changed if more than maxAffected (default 100) cars match
+// @Accept json
+// @Produce json
+// @Param input body PatchRequest true "cars to patch and the patch"
+// @Success 200 {object} Response
+// @Failure 400,403,409,422 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/batch-patch [post]
+func NewPatch(log *slog.Logger, patcher BatchPatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.Batch.NewPatch"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//декодируем тело запроса
+		var req PatchRequest
+		if err := render.DecodeJSON(r.Body, &req); err != nil {
+			log.Error("failed to decode request body", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to decode request body")
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("selector", req.Selector), slog.Any("patch", req.Patch))
+
+		if req.Patch.IsEmpty() {
+			err_response.RenderViolations(w, r, []validation.Violation{{Field: "patch", Message: "must change at least one field"}})
+			return
+		}
+
+		if !validate(w, r, log, req, req.Selector) {
+			return
+		}
+
+		summary, ok := selectCars(w, r, log, patcher, req.Selector)
+		if !ok {
+			return
+		}
+
+		if !req.DryRun {
+			for i, res := range summary.Results {
+				if res.Status != StatusMatched {
+					continue
+				}
+				code, err := patcher.PatchCar(r.Context(), res.ID, req.Patch, 0)
+				switch {
+				case err == nil && code == 2:
+					summary.Results[i].Status = StatusUnchanged
+				case err == nil:
+					summary.Results[i].Status = StatusPatched
+				case code == -1:
+					summary.Results[i].Status = StatusNotFound
+				case errors.Is(err, storage.ErrCarExists):
+					summary.Results[i].Status = StatusFailed
+					summary.Results[i].Error = storage.ErrCarExists.Error()
+				default:
+					log.Error("failed to patch car", slog.Int("id", res.ID), "error", err)
+					summary.Results[i].Status = StatusFailed
+					summary.Results[i].Error = "failed to patch car"
+				}
+			}
+			summary.count()
+		}
+
+		log.Info("batch patch done", slog.Int("matched", summary.Matched), slog.Int("failed", summary.Failed))
+
+		render.Status(r, 200)
+		render.JSON(w, r, Response{Data: summary})
+	}
+}
+
+// проверяем запрос и условия выбора машин.
+// При нарушениях ответ уже отправлен и возвращается false
+func validate(w http.ResponseWriter, r *http.Request, log *slog.Logger, req any, sel Selector) bool {
+	// выбор по имени владельца раскрывает его полностью, в том числе в dryRun
+	if sel.carFilter().UsesOwnerName() && !auth.ShowOwners(r.Context()) {
+		log.Info("owner filter without scope", slog.String("scope", auth.ScopeOwnersRead))
+		err_response.Render(w, r, 403, err_response.CodeForbidden, "missing scope "+auth.ScopeOwnersRead)
+		return false
+	}
+
+	violations, err := validation.Struct(req)
+	if err != nil {
+		log.Error("failed to validate request", "error", err)
+		err_response.Render(w, r, 500, err_response.CodeInternal, "failed to validate request")
+		return false
+	}
+
+	// без условий операция затронула бы все машины
+	if len(sel.IDs) == 0 && sel.carFilter().IsEmpty() {
+		violations = append(violations, validation.Violation{Field: "filter", Message: "ids or a non-empty filter is required"})
+	}
+	if sel.Filter != nil && sel.Filter.Year != "" {
+		if _, _, err := sel.carFilter().YearRange(); err != nil {
+			violations = append(violations, validation.Violation{Field: "filter.year", Message: err.Error()})
+		}
+	}
+
+	if len(violations) > 0 {
+		log.Info("invalid request", slog.Any("violations", violations))
+		err_response.RenderViolations(w, r, violations)
+		return false
+	}
+	return true
+}
+
+// выбираем машины для операции и заполняем результаты со статусами matched и not_found.
+// При ошибке ответ уже отправлен и возвращается false
+func selectCars(w http.ResponseWriter, r *http.Request, log *slog.Logger, finder CarFinder, sel Selector) (Summary, bool) {
+	maxAffected := sel.MaxAffected
+	if maxAffected == 0 {
+		maxAffected = DefaultMaxAffected
+	}
+
+	// выбираем на одну машину больше, чтобы узнать о превышении ограничения
+	ids, err := finder.FindCarIDs(r.Context(), sel.IDs, sel.carFilter(), maxAffected+1)
+	if err != nil {
+		log.Error("failed to find cars", "error", err)
+		err_response.Render(w, r, 500, err_response.CodeInternal, "failed to find cars. Try later")
+		return Summary{}, false
+	}
+	if len(ids) > maxAffected {
+		log.Info("too many cars matched", slog.Int("max_affected", maxAffected))
+		err_response.Render(w, r, 409, err_response.CodeLimitExceeded,
+			fmt.Sprintf("more than %d cars match, narrow the selection or raise maxAffected", maxAffected))
+		return Summary{}, false
+	}
+
+	summary := Summary{DryRun: sel.DryRun, Matched: len(ids), Results: make([]Result, 0, len(ids))}
+	matched := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		matched[id] = true
+		summary.Results = append(summary.Results, Result{ID: id, Status: StatusMatched})
+	}
+
+	// запрошенные, но не найденные машины тоже попадают в результаты
+	reported := make(map[int]bool, len(sel.IDs))
+	for _, id := range sel.IDs {
+		if !matched[id] && !reported[id] {
+			reported[id] = true
+			summary.Results = append(summary.Results, Result{ID: id, Status: StatusNotFound, Error: storage.ErrCarNotFound.Error()})
+		}
+	}
+	summary.count()
+
+	return summary, true
+}
+
+// пересчитываем итоги по результатам
+func (s *Summary) count() {
+	s.Succeeded, s.Failed = 0, 0
+	for _, res := range s.Results {
+		switch res.Status {
+		case StatusDeleted, StatusPatched, StatusUnchanged:
+			s.Succeeded++
+		case StatusNotFound, StatusFailed:
+			s.Failed++
+		}
+	}
+}
+
+// переводим фильтр из запроса в фильтр хранилища
+func (sel Selector) carFilter() car.CarFilter {
+	if sel.Filter == nil {
+		return car.CarFilter{}
+	}
+	return car.CarFilter{YearFilter: sel.Filter.Year,
+		RegNumFilter:     sel.Filter.RegNum,
+		ModelFilter:      sel.Filter.Model,
+		MarkFilter:       sel.Filter.Mark,
+		NameFilter:       sel.Filter.Name,
+		SurnameFilter:    sel.Filter.Surname,
+		PatronymicFilter: sel.Filter.Patronymic}
+}
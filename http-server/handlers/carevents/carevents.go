@@ -0,0 +1,189 @@
+package carevents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/events"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/go-chi/chi/middleware"
+)
+
+// LastEventIDHeader - заголовок, с которым EventSource переподключается
+const LastEventIDHeader = "Last-Event-ID"
+
+const (
+	// сколько событий читается из журнала за запрос при возобновлении
+	replayBatch = 500
+	// размер очереди новых событий подписчика
+	subscriberBuffer = 256
+	// как часто отправляется комментарий, чтобы прокси не закрывали соединение
+	heartbeatInterval = 15 * time.Second
+	// через сколько миллисекунд клиент переподключается после обрыва
+	retryMillis = 3000
+)
+
+type EventReader interface {
+	GetEvents(ctx context.Context, afterID int64, filter events.Filter, limit int) ([]events.Event, error)
+}
+
+type Subscriber interface {
+	Subscribe(buffer int) chan events.Event
+	Unsubscribe(ch chan events.Event)
+}
+
+// @Summary Events
+// @Tags events
+// @Description stream car changes as Server-Sent Events. Event names are created, updated and deleted, data is an events.Event.
+// @Description Send Last-Event-ID (or last_event_id) to resume after the given event, otherwise only new events are streamed
+// @Produce text/event-stream
+// @Param Last-Event-ID header int false "Id of the last received event"
+// @Param last_event_id query int false "Id of the last received event, for clients that can not set headers"
+// @Param mark query string false "Only cars of this mark"
+// @Param name query string false "Only cars whose owner has this name, requires owners:read"
+// @Param surname query string false "Only cars whose owner has this surname"
+// @Success 200 {object} events.Event
+// @Failure 400,403 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/events [get]
+func New(log *slog.Logger, reader EventReader, hub Subscriber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.CarEvents.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		// события других арендаторов подписчику не отправляются
+		tenantID, _ := tenant.FromContext(r.Context())
+		filter := events.Filter{
+			TenantID: tenantID,
+			Mark:     r.URL.Query().Get("mark"),
+			Name:     r.URL.Query().Get("name"),
+			Surname:  r.URL.Query().Get("surname"),
+		}
+		mask := !auth.ShowOwners(r.Context())
+		if mask && filter.Name != "" {
+			log.Info("owner filter without scope", slog.String("scope", auth.ScopeOwnersRead))
+			err_response.Render(w, r, 403, err_response.CodeForbidden, "missing scope "+auth.ScopeOwnersRead)
+			return
+		}
+
+		lastIDStr := r.Header.Get(LastEventIDHeader)
+		if lastIDStr == "" {
+			lastIDStr = r.URL.Query().Get("last_event_id")
+		}
+		var lastID int64
+		resume := lastIDStr != ""
+		if resume {
+			var err error
+			lastID, err = strconv.ParseInt(lastIDStr, 10, 64)
+			if err != nil || lastID < 0 {
+				log.Error("invalid last event id", slog.String("last_event_id", lastIDStr))
+				err_response.Render(w, r, 400, err_response.CodeInvalidParam, "invalid Last-Event-ID, need a non-negative integer")
+				return
+			}
+		}
+
+		// поток живёт дольше WriteTimeout сервера
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Debug("failed to reset write deadline", "error", err)
+		}
+
+		// подписываемся до чтения журнала, чтобы не потерять события между ними
+		ch := hub.Subscribe(subscriberBuffer)
+		defer hub.Unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+
+		log.Info("subscriber connected", slog.Int64("last_event_id", lastID))
+
+		// отправляем пропущенные события из журнала
+		for resume {
+			missed, err := reader.GetEvents(r.Context(), lastID, filter, replayBatch)
+			if err != nil {
+				log.Error("failed to get events", "error", err)
+				return
+			}
+			for _, e := range missed {
+				if err := write(w, e, mask); err != nil {
+					return
+				}
+				lastID = e.ID
+			}
+			resume = len(missed) == replayBatch
+		}
+		if err := rc.Flush(); err != nil {
+			log.Error("streaming is not supported", "error", err)
+			return
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				log.Info("subscriber disconnected")
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+			case e, ok := <-ch:
+				if !ok {
+					// подписчик отстал, клиент переподключится с Last-Event-ID
+					log.Info("subscriber dropped as too slow")
+					return
+				}
+				// уже отправлено из журнала или не подходит под фильтр.
+				// Новые события сравниваем только с журналом: транзакции могут завершиться не по порядку id
+				if e.ID <= lastID || !filter.Match(e) {
+					continue
+				}
+				if err := write(w, e, mask); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// записываем событие в формате text/event-stream.
+// При mask имя и отчество владельца сокращаются до инициалов
+func write(w http.ResponseWriter, e events.Event, mask bool) error {
+	if mask {
+		doc, err := car.MaskDocument(e.Car)
+		if err != nil {
+			return err
+		}
+		e.Car = doc
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
@@ -1,14 +1,17 @@
 package deleter
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strconv"
 
+	"github.com/P1coFly/CarInfoEM/http-server/etag"
 	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
-	"github.com/go-chi/render"
 )
 
 type Request struct {
@@ -16,20 +19,24 @@ type Request struct {
 }
 
 type DeleterCar interface {
-	DeleteCar(carID int) (int, error)
+	DeleteCar(ctx context.Context, carID, version int) (int, error)
 }
 
 // @Summary Delete
 // @Tags car
-// @Description delete car
+// @Description delete car. The car is hidden but kept until the retention period ends and can be restored
 // @Accept json
 // @Produce json
 // @Param id path int true "Car ID"
+// @Param X-Schema-Version header int false "Response schema version for deprecated routes"
+// @Param If-Match header string false "ETag of the car version being deleted"
 // @Success 204
-// @Failure 400,404 {object} err_response.Response
-// @Failure 500 {object} err_response.Response
-// @Failure default {object} err_response.Response
-// @Router /car/delete/{id} [delete]
+// @Failure 400,404,412 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/{id} [delete]
+// @DeprecatedRouter /car/delete/{id} [delete]
 func New(log *slog.Logger, deleter DeleterCar) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.DeleterCar.New"
@@ -44,28 +51,38 @@ func New(log *slog.Logger, deleter DeleterCar) http.HandlerFunc {
 
 		if err != nil {
 			log.Error("failed to get id")
-			w.WriteHeader(400)
-			render.JSON(w, r, err_response.Error("failed to get. Need car's id"))
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get. Need car's id")
 
 			return
 		}
 
 		req := Request{CarID: idx}
 
+		// ожидаемая версия из If-Match, 0 - без проверки
+		version, err := etag.IfMatch(r)
+		if err != nil {
+			log.Error("invalid If-Match", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
+			return
+		}
+
 		log.Debug("carID", slog.Any("carID", req.CarID))
 		log.Info("request body decoded", slog.Any("request", req))
 
 		//удаляем машину
-		id, err := deleter.DeleteCar(req.CarID)
+		id, err := deleter.DeleteCar(r.Context(), req.CarID, version)
 		if err != nil {
 			log.Error("failed delete car", "error", err)
+			if errors.Is(err, storage.ErrVersionMismatch) {
+				log.Info("car version mismatch", slog.Int("id", req.CarID))
+				err_response.Render(w, r, 412, err_response.CodePreconditionFailed, "car was changed, reload it and retry")
+				return
+			}
 			if id == -1 {
-				w.WriteHeader(404)
-				render.JSON(w, r, err_response.Error("car with this id was not found"))
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "car with this id was not found")
 				return
 			}
-			w.WriteHeader(500)
-			render.JSON(w, r, err_response.Error("failed delete car"))
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed delete car")
 
 			return
 		}
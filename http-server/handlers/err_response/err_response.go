@@ -1,5 +1,16 @@
 package err_response
 
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/P1coFly/CarInfoEM/http-server/schema"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
 type Response struct {
 	Status string `json:"status,omitempty"`
 	Error  string `json:"error,omitempty"`
@@ -9,9 +20,135 @@ const (
 	StatusError = "Error"
 )
 
+// ContentType - тип содержимого ответа с ошибкой по RFC 7807
+const ContentType = "application/problem+json"
+
+// TypeBaseURI - префикс URI типа ошибки, к нему добавляется код
+const TypeBaseURI = "/problems/"
+
+// Коды ошибок, из них формируется type
+const (
+	CodeBadRequest           = "bad_request"
+	CodeInvalidBody          = "invalid_body"
+	CodeInvalidParam         = "invalid_param"
+	CodeValidation           = "validation_failed"
+	CodeNotFound             = "not_found"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeConflict             = "conflict"
+	CodePreconditionFailed   = "precondition_failed"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodePatchFailed          = "patch_failed"
+	CodeLimitExceeded        = "limit_exceeded"
+	CodeRateLimited          = "rate_limited"
+	CodeInternal             = "internal"
+	CodeCarInfo              = "carinfo_failed"
+	CodeStorage              = "storage_failed"
+)
+
+var titles = map[string]string{
+	CodeBadRequest:           "Bad request",
+	CodeInvalidBody:          "Invalid request body",
+	CodeInvalidParam:         "Invalid request parameter",
+	CodeValidation:           "Validation failed",
+	CodeNotFound:             "Resource not found",
+	CodeUnauthorized:         "Authentication required",
+	CodeForbidden:            "Access denied",
+	CodeMethodNotAllowed:     "Method not allowed",
+	CodeUnsupportedMediaType: "Unsupported media type",
+	CodeConflict:             "Conflict",
+	CodePreconditionFailed:   "Precondition failed",
+	CodeIdempotencyKeyReused: "Idempotency key reused",
+	CodePatchFailed:          "Patch could not be applied",
+	CodeLimitExceeded:        "Too many resources affected",
+	CodeRateLimited:          "Too many requests",
+	CodeInternal:             "Internal server error",
+	CodeCarInfo:              "CarInfo service request failed",
+	CodeStorage:              "Storage request failed",
+}
+
+// FieldError - ошибка валидации конкретного поля
+type FieldError struct {
+	Field   string `json:"field" example:"owner.name"`
+	Message string `json:"message" example:"must not be empty"`
+}
+
+// Problem - ответ с ошибкой по RFC 7807
+type Problem struct {
+	Type      string       `json:"type" example:"/problems/not_found"`
+	Title     string       `json:"title" example:"Resource not found"`
+	Status    int          `json:"status" example:"404"`
+	Detail    string       `json:"detail,omitempty" example:"car with this id was not found"`
+	Instance  string       `json:"instance,omitempty" example:"/cars/1"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
 func Error(msg string) Response {
 	return Response{
 		Status: StatusError,
 		Error:  msg,
 	}
 }
+
+// Render отправляет ошибку в формате, соответствующем версии схемы запроса
+func Render(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	RenderFields(w, r, status, code, detail, nil)
+}
+
+// RenderFields отправляет ошибку вместе с ошибками отдельных полей.
+// В схеме V1 ошибки полей не передаются
+func RenderFields(w http.ResponseWriter, r *http.Request, status int, code, detail string, fields []FieldError) {
+	if schema.FromContext(r.Context()) == schema.V1 {
+		render.Status(r, status)
+		render.JSON(w, r, Error(detail))
+		return
+	}
+
+	title, ok := titles[code]
+	if !ok {
+		title = http.StatusText(status)
+	}
+
+	body, err := json.Marshal(Problem{
+		Type:      TypeBaseURI + code,
+		Title:     title,
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: middleware.GetReqID(r.Context()),
+		Errors:    fields,
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// RenderViolations отправляет ошибки валидации с путями к полям
+func RenderViolations(w http.ResponseWriter, r *http.Request, violations []validation.Violation) {
+	fields := make([]FieldError, 0, len(violations))
+	details := make([]string, 0, len(violations))
+	for _, v := range violations {
+		fields = append(fields, FieldError{Field: v.Field, Message: v.Message})
+		details = append(details, v.Field+" "+v.Message)
+	}
+
+	RenderFields(w, r, http.StatusUnprocessableEntity, CodeValidation, strings.Join(details, "; "), fields)
+}
+
+// NotFound - обработчик для несуществующих маршрутов
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Render(w, r, http.StatusNotFound, CodeNotFound, "route not found")
+}
+
+// MethodNotAllowed - обработчик для неподдерживаемых методов
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Render(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+}
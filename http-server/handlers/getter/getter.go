@@ -1,21 +1,35 @@
 package getter
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/P1coFly/CarInfoEM/http-server/etag"
 	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/http-server/middleware/access"
+	"github.com/P1coFly/CarInfoEM/http-server/schema"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
 	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 )
 
 type GetCar interface {
-	GetCars(pageSize, pageToken int, carFilter car.CarFilter) ([]car.CarWithOwner, error)
-	GetTotalCarsCount(carFilter car.CarFilter) (int, error)
+	GetCars(ctx context.Context, pageSize, pageToken int, carFilter car.CarFilter, fields []string) ([]car.CarWithOwner, error)
+	GetTotalCarsCount(ctx context.Context, carFilter car.CarFilter) (int, error)
+}
+
+type GetCarByID interface {
+	GetCar(ctx context.Context, carID int, fields []string, includeDeleted bool) (car.CarWithOwner, error)
 }
 
 type Info struct {
@@ -29,25 +43,55 @@ type GetResponse struct {
 	Info         `json:"info"`
 }
 
+// SparseGetResponse - ответ, если через fields запрошена часть полей
+type SparseGetResponse struct {
+	CarWithOwner []map[string]any
+	Info         `json:"info"`
+}
+
+// Meta - информация о пагинации в схеме V2
+type Meta struct {
+	Total    int `json:"total"`
+	Page     int `json:"page"`
+	LastPage int `json:"lastPage"`
+}
+
+// ListResponse - ответ в схеме V2
+type ListResponse struct {
+	Data []car.CarWithOwner `json:"data"`
+	Meta Meta               `json:"meta"`
+}
+
+// CarResponse - ответ в схеме V2
+type CarResponse struct {
+	Data car.CarWithOwner `json:"data"`
+}
+
 // @Summary Get
 // @Tags cars
-// @Description get cars
+// @Description get cars. /api/v1 always answers with schema 2, deprecated routes pick the schema with the X-Schema-Version header
 // @Accept json
 // @Produce json
+// @Param X-Schema-Version header int false "Response schema version for deprecated routes"
 // @Param page_size query int false "Page size (default is 100) used for pagination" default:"100"
 // @Param page_token query int false "Page token (default is 1) used for pagination" default:"1"
 // @Param year query string false "Filter by year (format: 'start:end') example: 2000:2023"
 // @Param reg_num query string false "Filter by registration number"
 // @Param model query string false "Filter by car model"
 // @Param mark query string false "Filter by car mark"
-// @Param name query string false "Filter by owner name"
+// @Param name query string false "Filter by owner name, requires owners:read"
 // @Param surname query string false "Filter by owner surname"
-// @Param patronymic query string false "Filter by owner patronymic"
-// @Success 200 {object} GetResponse
-// @Failure 400 {object} err_response.Response
-// @Failure 500 {object} err_response.Response
-// @Failure default {object} err_response.Response
-// @Router /cars [get]
+// @Param patronymic query string false "Filter by owner patronymic, requires owners:read"
+// @Param fields query string false "Comma-separated list of fields to return, example: id,regNum,owner.surname"
+// @Param updated_since query string false "Only cars changed at or after this time (RFC 3339), example: 2024-01-02T15:04:05Z"
+// @Param include_deleted query bool false "Also return deleted cars, they are marked with deletedAt"
+// @Success 200 {object} ListResponse
+// @Failure 400,403 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars [get]
+// @DeprecatedRouter /cars [get]
 func New(log *slog.Logger, get GetCar) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.GetCar.New"
@@ -66,15 +110,13 @@ func New(log *slog.Logger, get GetCar) http.HandlerFunc {
 		pageSize, err := strconv.Atoi(pageSizeStr)
 		if err != nil {
 			log.Error("failed to get page_size", "error", err)
-			w.WriteHeader(400)
-			render.JSON(w, r, err_response.Error("failed to get page_size. Need page_size=<int>"))
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get page_size. Need page_size=<int>")
 
 			return
 		}
 		if pageSize < 1 {
 			log.Error("incorrect page_size, page_size must be greater than 0")
-			w.WriteHeader(400)
-			render.JSON(w, r, err_response.Error("incorrect page_size, page_size must be greater than 0"))
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "incorrect page_size, page_size must be greater than 0")
 
 			return
 		}
@@ -86,16 +128,22 @@ func New(log *slog.Logger, get GetCar) http.HandlerFunc {
 		pageToken, err := strconv.Atoi(pageTokenStr)
 		if err != nil {
 			log.Error("failed to get page_token", "error", err)
-			w.WriteHeader(400)
-			render.JSON(w, r, err_response.Error("failed to get page_token. Need page_token=<int>"))
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get page_token. Need page_token=<int>")
 
 			return
 		}
 		if pageToken < 1 {
 			log.Error("incorrect page_token, page_token must be greater than 0")
-			w.WriteHeader(400)
-			render.JSON(w, r, err_response.Error("incorrect page_token, page_token must be greater than 0"))
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "incorrect page_token, page_token must be greater than 0")
+
+			return
+		}
 
+		// получаем список запрашиваемых полей
+		fields, err := car.ParseFields(r.URL.Query().Get("fields"))
+		if err != nil {
+			log.Error("invalid fields", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, fmt.Sprintf("invalid fields: %v", err))
 			return
 		}
 
@@ -108,73 +156,207 @@ func New(log *slog.Logger, get GetCar) http.HandlerFunc {
 			SurnameFilter:    r.URL.Query().Get("surname"),
 			PatronymicFilter: r.URL.Query().Get("patronymic")}
 
-		// Валидируем year, чтобы соответствовал виду 'start:end'
-		var startYear, endYear int
-		if carFilter.YearFilter != "" {
-			years := strings.Split(carFilter.YearFilter, ":")
-			if len(years) != 2 {
-				log.Error("invalid year filter format")
-				w.WriteHeader(400)
-				render.JSON(w, r, err_response.Error("invalid year filter format"))
-				return
-			}
-
-			var err error
-			startYear, err = strconv.Atoi(years[0])
+		if since := r.URL.Query().Get("updated_since"); since != "" {
+			carFilter.UpdatedSince, err = time.Parse(time.RFC3339, since)
 			if err != nil {
-				log.Error("invalid start year", "error", err)
-				w.WriteHeader(400)
-				render.JSON(w, r, err_response.Error("invalid start year"))
+				log.Error("invalid updated_since", "error", err)
+				err_response.Render(w, r, 400, err_response.CodeInvalidParam, "invalid updated_since, need RFC 3339 time")
 				return
 			}
+		}
 
-			endYear, err = strconv.Atoi(years[1])
-			if err != nil {
-				log.Error("invalid end year", "error", err)
-				w.WriteHeader(400)
-				render.JSON(w, r, err_response.Error("invalid end year"))
-				return
-			}
+		carFilter.IncludeDeleted, err = includeDeleted(r)
+		if err != nil {
+			log.Error("invalid include_deleted", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "invalid include_deleted, need true or false")
+			return
+		}
+
+		// без права на персональные данные искать по имени владельца нельзя, иначе оно подбирается перебором
+		if carFilter.UsesOwnerName() && !auth.ShowOwners(r.Context()) {
+			log.Info("owner filter without scope", slog.String("scope", auth.ScopeOwnersRead))
+			err_response.Render(w, r, 403, err_response.CodeForbidden, "missing scope "+auth.ScopeOwnersRead)
+			return
+		}
 
-			if startYear > endYear {
-				log.Error("start year cannot be greater than end year")
-				w.WriteHeader(400)
-				render.JSON(w, r, err_response.Error("start year cannot be greater than end year"))
+		// Валидируем year, чтобы соответствовал виду 'start:end'
+		if carFilter.YearFilter != "" {
+			if _, _, err := carFilter.YearRange(); err != nil {
+				log.Error("invalid year filter", "error", err)
+				err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
 				return
 			}
 		}
 
 		//получаем выборку car с указанами параметрами
-		carWithOwner, err := get.GetCars(pageSize, pageToken, carFilter)
+		carWithOwner, err := get.GetCars(r.Context(), pageSize, pageToken, carFilter, fields)
 		if err != nil {
 			log.Error("failed to get cars", "error", err)
-			w.WriteHeader(500)
-			render.JSON(w, r, err_response.Error("failed to get cars. Try later"))
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get cars. Try later")
 
 			return
 		}
 		log.Info("cars was got")
 
 		//считаем кол-во страниц
-		total, err := get.GetTotalCarsCount(carFilter)
+		total, err := get.GetTotalCarsCount(r.Context(), carFilter)
 		if err != nil {
 			log.Error("failed to get total cars", "error", err)
-			w.WriteHeader(500)
-			render.JSON(w, r, err_response.Error("failed to get cars. Try later"))
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get cars. Try later")
 
 			return
 		}
 
 		log.Info("cars was got")
 
-		w.WriteHeader(200)
-		render.JSON(w, r, GetResponse{
-			CarWithOwner: carWithOwner,
-			Info: Info{
-				Total:    total,
-				Page:     pageToken,
-				LastPage: int(math.Ceil(float64(total) / float64(pageSize)))},
-		})
+		info := Info{
+			Total:    total,
+			Page:     pageToken,
+			LastPage: int(math.Ceil(float64(total) / float64(pageSize)))}
+
+		render.Status(r, 200)
+
+		// без права на персональные данные имена владельцев сокращаются до инициалов
+		if !auth.ShowOwners(r.Context()) {
+			for i := range carWithOwner {
+				carWithOwner[i] = carWithOwner[i].MaskOwner()
+			}
+		}
+
+		// если запрошена часть полей, отдаём только их
+		var sparse []map[string]any
+		if len(fields) > 0 {
+			sparse = make([]map[string]any, 0, len(carWithOwner))
+			for _, cwo := range carWithOwner {
+				sparse = append(sparse, cwo.Select(fields))
+			}
+		}
+
+		if schema.FromContext(r.Context()) == schema.V1 {
+			if sparse != nil {
+				render.JSON(w, r, SparseGetResponse{CarWithOwner: sparse, Info: info})
+				return
+			}
+			render.JSON(w, r, GetResponse{
+				CarWithOwner: carWithOwner,
+				Info:         info,
+			})
+			return
+		}
+
+		meta := Meta{Total: info.Total, Page: info.Page, LastPage: info.LastPage}
+		if sparse != nil {
+			render.JSON(w, r, schema.Envelope{Data: sparse, Meta: meta})
+			return
+		}
+		if carWithOwner == nil {
+			carWithOwner = []car.CarWithOwner{}
+		}
+		render.JSON(w, r, ListResponse{Data: carWithOwner, Meta: meta})
+
+	}
+}
+
+// @Summary GetByID
+// @Tags car
+// @Description get car by id
+// @Accept json
+// @Produce json
+// @Param id path int true "Car ID"
+// @Param fields query string false "Comma-separated list of fields to return, example: id,regNum,owner.surname"
+// @Param include_deleted query bool false "Also find a deleted car, it is marked with deletedAt"
+// @Param If-None-Match header string false "ETag from a previous response"
+// @Success 200 {object} CarResponse
+// @Success 304 "car has not changed"
+// @Header 200,304 {string} ETag "weak ETag of the car version and its representation, accepted in If-Match"
+// @Header 200,304 {string} Vary "X-Schema-Version, Authorization, X-API-Key"
+// @Failure 400,404 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/{id} [get]
+func NewByID(log *slog.Logger, get GetCarByID) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.GetCarByID.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//пытаемсяя получить id с запроса
+		carID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			log.Error("failed to get car ID from URL")
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get car ID from URL")
+			return
+		}
+
+		// получаем список запрашиваемых полей
+		fields, err := car.ParseFields(r.URL.Query().Get("fields"))
+		if err != nil {
+			log.Error("invalid fields", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, fmt.Sprintf("invalid fields: %v", err))
+			return
+		}
+
+		withDeleted, err := includeDeleted(r)
+		if err != nil {
+			log.Error("invalid include_deleted", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "invalid include_deleted, need true or false")
+			return
+		}
+
+		cwo, err := get.GetCar(r.Context(), carID, fields, withDeleted)
+		if err != nil {
+			if errors.Is(err, storage.ErrCarNotFound) {
+				log.Info("car not found", slog.Int("id", carID))
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "car with this id was not found")
+				return
+			}
+			log.Error("failed to get car", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get car. Try later")
+			return
+		}
+
+		log.Info("car was got", slog.Int("id", carID))
+
+		// одна версия машины отдаётся по-разному в зависимости от полей, схемы и доступа к владельцам,
+		// поэтому ETag слабый и учитывает представление, а кэши различают ответы по Vary
+		showOwners := auth.ShowOwners(r.Context())
+		tag := etag.FormatVariant(cwo.Version, strings.Join(fields, ","),
+			strconv.Itoa(int(schema.FromContext(r.Context()))), strconv.FormatBool(showOwners))
+		w.Header().Set("ETag", tag)
+		w.Header().Set("Vary", schema.Header+", Authorization, "+access.APIKeyHeader)
+		if etag.NoneMatch(r, tag) {
+			w.WriteHeader(304)
+			return
+		}
+
+		render.Status(r, 200)
+
+		if !showOwners {
+			cwo = cwo.MaskOwner()
+		}
+
+		var data any = cwo
+		if len(fields) > 0 {
+			data = cwo.Select(fields)
+		}
+
+		if schema.FromContext(r.Context()) == schema.V1 {
+			render.JSON(w, r, data)
+			return
+		}
+		render.JSON(w, r, schema.Envelope{Data: data})
+	}
+}
 
+// читаем параметр include_deleted, по умолчанию удалённые машины скрыты
+func includeDeleted(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("include_deleted")
+	if s == "" {
+		return false, nil
 	}
+	return strconv.ParseBool(s)
 }
@@ -0,0 +1,103 @@
+package graphql
+
+import (
+	"context"
+	_ "embed"
+	"log/slog"
+	"net/http"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/models/audit"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	gql "github.com/graph-gophers/graphql-go"
+)
+
+//go:embed schema.graphql
+var schemaSDL string
+
+type Storage interface {
+	GetCars(ctx context.Context, pageSize, pageToken int, carFilter car.CarFilter, fields []string) ([]car.CarWithOwner, error)
+	GetTotalCarsCount(ctx context.Context, carFilter car.CarFilter) (int, error)
+	GetCar(ctx context.Context, carID int, fields []string, includeDeleted bool) (car.CarWithOwner, error)
+	GetOwners(ctx context.Context, carIDs []int) (map[int]car.Owner, error)
+	GetOwnerHistory(ctx context.Context, carIDs []int) (map[int][]audit.Record, error)
+	AddCar(ctx context.Context, car car.Car, source string) (int, error)
+	PatchCar(ctx context.Context, carID int, pc car.PatchCar, version int) (int, error)
+	DeleteCar(ctx context.Context, carID, version int) (int, error)
+}
+
+type CarInfo interface {
+	Get(regNum string) (car.Car, int, error)
+}
+
+// Request - запрос GraphQL
+type Request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// @Summary GraphQL
+// @Tags graphql
+// @Description GraphQL endpoint for cars and owners, the schema is available through introspection
+// @Accept json
+// @Produce json
+// @Param input body Request true "GraphQL query"
+// @Success 200 {object} object "GraphQL response with data and errors"
+// @Failure 400 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /graphql [post]
+func New(log *slog.Logger, storage Storage, carInfo CarInfo) http.HandlerFunc {
+	// схема встроена в бинарник, ошибка в ней - ошибка сборки
+	schema := gql.MustParseSchema(schemaSDL, &rootResolver{log: log, storage: storage, carInfo: carInfo},
+		gql.UseFieldResolvers(), gql.MaxDepth(8))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.GraphQL.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		var req Request
+		if err := render.DecodeJSON(r.Body, &req); err != nil {
+			log.Error("failed to decode request body", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to decode request body")
+			return
+		}
+
+		log.Info("request body decoded", slog.String("operation", req.OperationName))
+
+		// владельцы и их история загружаются пачками в пределах одного запроса
+		ctx := withLoaders(r.Context(), storage)
+		resp := schema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+		if len(resp.Errors) > 0 {
+			log.Info("graphql errors", slog.Any("errors", resp.Errors))
+		}
+
+		render.Status(r, 200)
+		render.JSON(w, r, resp)
+	}
+}
+
+type ctxKey struct{}
+
+type loaders struct {
+	owners       *loader[int, car.Owner]
+	ownerHistory *loader[int, []audit.Record]
+}
+
+func withLoaders(ctx context.Context, storage Storage) context.Context {
+	return context.WithValue(ctx, ctxKey{}, &loaders{
+		owners:       newLoader(storage.GetOwners),
+		ownerHistory: newLoader(storage.GetOwnerHistory),
+	})
+}
+
+func loadersFrom(ctx context.Context) *loaders {
+	return ctx.Value(ctxKey{}).(*loaders)
+}
@@ -0,0 +1,112 @@
+package graphql
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// batchWait - сколько loader собирает ключи перед запросом.
+// Резолверы полей выполняются параллельно, поэтому ключи одного уровня успевают попасть в одну пачку.
+// Если ключи известны заранее, их лучше передать в Prime: число параллельных резолверов ограничено
+const batchWait = 2 * time.Millisecond
+
+// loader объединяет запросы по отдельным ключам в один запрос по списку ключей
+// и запоминает результаты до конца запроса GraphQL
+type loader[K comparable, V any] struct {
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)
+
+	mu    sync.Mutex
+	cache map[K]*result[V]
+	batch *batch[K, V]
+}
+
+type result[V any] struct {
+	done  chan struct{}
+	value V
+	found bool
+	err   error
+}
+
+type batch[K comparable, V any] struct {
+	keys      []K
+	results   []*result[V]
+	scheduled bool
+}
+
+func newLoader[K comparable, V any](fetch func(ctx context.Context, keys []K) (map[K]V, error)) *loader[K, V] {
+	return &loader[K, V]{fetch: fetch, cache: make(map[K]*result[V])}
+}
+
+// Prime добавляет ключи в следующую пачку, не запуская запрос.
+// Запрос выполнится при первом Load, если значения так и не понадобятся - не выполнится вовсе
+func (l *loader[K, V]) Prime(keys ...K) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		if _, ok := l.cache[key]; !ok {
+			l.enqueue(key)
+		}
+	}
+}
+
+// Load возвращает значение по ключу, found=false - значения нет
+func (l *loader[K, V]) Load(ctx context.Context, key K) (V, bool, error) {
+	l.mu.Lock()
+	res, ok := l.cache[key]
+	if !ok {
+		res = l.enqueue(key)
+	}
+	// пачку, в которой ждёт ключ, запускаем по таймеру при первом Load
+	if l.batch != nil && !l.batch.scheduled && !isDone(res) {
+		l.batch.scheduled = true
+		time.AfterFunc(batchWait, func() { l.run(ctx) })
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-res.done:
+		return res.value, res.found, res.err
+	case <-ctx.Done():
+		var zero V
+		return zero, false, ctx.Err()
+	}
+}
+
+// добавляем ключ в текущую пачку, вызывается под l.mu
+func (l *loader[K, V]) enqueue(key K) *result[V] {
+	res := &result[V]{done: make(chan struct{})}
+	l.cache[key] = res
+
+	if l.batch == nil {
+		l.batch = &batch[K, V]{}
+	}
+	l.batch.keys = append(l.batch.keys, key)
+	l.batch.results = append(l.batch.results, res)
+	return res
+}
+
+func isDone[V any](res *result[V]) bool {
+	select {
+	case <-res.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *loader[K, V]) run(ctx context.Context) {
+	l.mu.Lock()
+	b := l.batch
+	l.batch = nil
+	l.mu.Unlock()
+
+	values, err := l.fetch(ctx, b.keys)
+	for i, key := range b.keys {
+		res := b.results[i]
+		res.value, res.found = values[key]
+		res.err = err
+		close(res.done)
+	}
+}
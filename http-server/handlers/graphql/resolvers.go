@@ -0,0 +1,721 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/models/audit"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	"github.com/go-chi/chi/middleware"
+	gql "github.com/graph-gophers/graphql-go"
+)
+
+// carFields - поля машины без владельца, владелец загружается отдельно пачкой
+var carFields = slices.DeleteFunc(slices.Clone(car.Fields), func(f string) bool {
+	return strings.HasPrefix(f, "owner.")
+})
+
+// значения CarSortField в поля car.SortableFields
+var sortFields = map[string]string{
+	"ID":            car.FieldID,
+	"REG_NUM":       car.FieldRegNum,
+	"MARK":          car.FieldMark,
+	"MODEL":         car.FieldModel,
+	"YEAR":          car.FieldYear,
+	"CREATED_AT":    car.FieldCreatedAt,
+	"UPDATED_AT":    car.FieldUpdatedAt,
+	"OWNER_NAME":    car.FieldName,
+	"OWNER_SURNAME": car.FieldSurname,
+}
+
+// resolverError - ошибка с кодом в extensions, коды совпадают с кодами REST API
+type resolverError struct {
+	message    string
+	code       string
+	violations []validation.Violation
+}
+
+func (e *resolverError) Error() string {
+	return e.message
+}
+
+func (e *resolverError) Extensions() map[string]any {
+	ext := map[string]any{"code": e.code}
+	if len(e.violations) > 0 {
+		fields := make([]err_response.FieldError, 0, len(e.violations))
+		for _, v := range e.violations {
+			fields = append(fields, err_response.FieldError{Field: v.Field, Message: v.Message})
+		}
+		ext["violations"] = fields
+	}
+	return ext
+}
+
+type rootResolver struct {
+	log     *slog.Logger
+	storage Storage
+	carInfo CarInfo
+}
+
+func (r *rootResolver) logger(ctx context.Context, op string) *slog.Logger {
+	return r.log.With(
+		slog.String("op", op),
+		slog.String("request_id", middleware.GetReqID(ctx)),
+	)
+}
+
+// переводим ошибку хранилища в ошибку GraphQL, неизвестные ошибки логируем и скрываем от клиента
+func storageError(log *slog.Logger, err error, msg string) error {
+	switch {
+	case errors.Is(err, storage.ErrCarNotFound):
+		return &resolverError{message: "car with this id was not found", code: err_response.CodeNotFound}
+	case errors.Is(err, storage.ErrVersionMismatch):
+		return &resolverError{message: "car was changed, reload it and retry", code: err_response.CodePreconditionFailed}
+	case errors.Is(err, storage.ErrCarExists):
+		return &resolverError{message: storage.ErrCarExists.Error(), code: err_response.CodeConflict}
+	}
+	log.Error(msg, "error", err)
+	return &resolverError{message: msg, code: err_response.CodeInternal}
+}
+
+func validate(req any) error {
+	violations, err := validation.Struct(req)
+	if err != nil {
+		return &resolverError{message: "failed to validate request", code: err_response.CodeInternal}
+	}
+	if len(violations) > 0 {
+		return &resolverError{message: "request is invalid", code: err_response.CodeValidation, violations: violations}
+	}
+	return nil
+}
+
+// проверяем право на мутацию, право на чтение проверено при маршрутизации
+func requireScope(ctx context.Context, scope string) error {
+	if p, ok := auth.FromContext(ctx); ok && p.HasScope(scope) {
+		return nil
+	}
+	return &resolverError{message: "missing scope " + scope, code: err_response.CodeForbidden}
+}
+
+// takeTokens списывает токены клиента, при недоступном хранилище лимитов мутация выполняется
+func takeTokens(ctx context.Context, log *slog.Logger, budget ratelimit.Budget, n int) error {
+	res, err := ratelimit.Take(ctx, budget, n)
+	if errors.Is(err, ratelimit.ErrBatchTooLarge) {
+		return &resolverError{
+			message: fmt.Sprintf("batch of %d exceeds the %s rate limit burst of %d", n, budget, res.Limit),
+			code:    err_response.CodeValidation,
+		}
+	}
+	if err != nil {
+		log.Error("failed to take rate limit tokens", "error", err)
+		return nil
+	}
+	if !res.Allowed {
+		return &resolverError{
+			message: fmt.Sprintf("%s rate limit exceeded, retry in %.0f seconds", budget, math.Ceil(res.RetryAfter.Seconds())),
+			code:    err_response.CodeRateLimited,
+		}
+	}
+	return nil
+}
+
+func parseID(id gql.ID) (int, error) {
+	carID, err := strconv.Atoi(string(id))
+	if err != nil {
+		return 0, &resolverError{message: "invalid car id", code: err_response.CodeInvalidParam}
+	}
+	return carID, nil
+}
+
+func checkPage(pageSize, page int32) error {
+	if pageSize < 1 || page < 1 {
+		return &resolverError{message: "pageSize and page must be greater than 0", code: err_response.CodeInvalidParam}
+	}
+	return nil
+}
+
+// Query
+
+type carFilterInput struct {
+	RegNum          *string
+	Mark            *string
+	Model           *string
+	Year            *string
+	OwnerName       *string
+	OwnerSurname    *string
+	OwnerPatronymic *string
+	UpdatedSince    *gql.Time
+	IncludeDeleted  *bool
+}
+
+type carSortInput struct {
+	Field     string
+	Direction string
+}
+
+func deref[T any](v *T) T {
+	var zero T
+	if v == nil {
+		return zero
+	}
+	return *v
+}
+
+func (r *rootResolver) Cars(ctx context.Context, args struct {
+	Filter   *carFilterInput
+	Sort     *[]carSortInput
+	PageSize int32
+	Page     int32
+}) (*carPageResolver, error) {
+	const op = "handlers.GraphQL.Cars"
+
+	if err := checkPage(args.PageSize, args.Page); err != nil {
+		return nil, err
+	}
+
+	var filter car.CarFilter
+	if f := args.Filter; f != nil {
+		filter = car.CarFilter{
+			YearFilter:       deref(f.Year),
+			RegNumFilter:     deref(f.RegNum),
+			ModelFilter:      deref(f.Model),
+			MarkFilter:       deref(f.Mark),
+			NameFilter:       deref(f.OwnerName),
+			SurnameFilter:    deref(f.OwnerSurname),
+			PatronymicFilter: deref(f.OwnerPatronymic),
+			IncludeDeleted:   deref(f.IncludeDeleted),
+		}
+		if f.UpdatedSince != nil {
+			filter.UpdatedSince = f.UpdatedSince.Time
+		}
+	}
+	if filter.YearFilter != "" {
+		if _, _, err := filter.YearRange(); err != nil {
+			return nil, &resolverError{message: err.Error(), code: err_response.CodeInvalidParam}
+		}
+	}
+	if args.Sort != nil {
+		for _, s := range *args.Sort {
+			filter.Sort = append(filter.Sort, car.SortField{Field: sortFields[s.Field], Desc: s.Direction == "DESC"})
+		}
+	}
+	// выбор и порядок по имени владельца раскрывают его полностью
+	if filter.UsesOwnerName() {
+		if err := requireScope(ctx, auth.ScopeOwnersRead); err != nil {
+			return nil, err
+		}
+	}
+
+	cars, err := r.storage.GetCars(ctx, int(args.PageSize), int(args.Page), filter, carFields)
+	if err != nil {
+		return nil, storageError(r.logger(ctx, op), err, "failed to get cars")
+	}
+
+	nodes := make([]*carResolver, 0, len(cars))
+	ids := make([]int, 0, len(cars))
+	for _, cwo := range cars {
+		nodes = append(nodes, &carResolver{root: r, cwo: cwo})
+		ids = append(ids, cwo.Id)
+	}
+	// владельцы и их история для всей страницы загрузятся одним запросом при первом обращении к полю
+	loadersFrom(ctx).owners.Prime(ids...)
+	loadersFrom(ctx).ownerHistory.Prime(ids...)
+	return &carPageResolver{root: r, filter: filter, nodes: nodes, pageSize: args.PageSize, page: args.Page}, nil
+}
+
+func (r *rootResolver) Car(ctx context.Context, args struct {
+	ID             gql.ID
+	IncludeDeleted bool
+}) (*carResolver, error) {
+	const op = "handlers.GraphQL.Car"
+
+	carID, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	cwo, err := r.storage.GetCar(ctx, carID, nil, args.IncludeDeleted)
+	if err != nil {
+		if errors.Is(err, storage.ErrCarNotFound) {
+			return nil, nil
+		}
+		return nil, storageError(r.logger(ctx, op), err, "failed to get car")
+	}
+
+	return &carResolver{root: r, cwo: cwo, hasOwner: true}, nil
+}
+
+type ownerFilterInput struct {
+	Name       *string
+	Surname    *string
+	Patronymic *string
+}
+
+func (r *rootResolver) Owners(ctx context.Context, args struct {
+	Filter   *ownerFilterInput
+	PageSize int32
+	Page     int32
+}) ([]*ownerResolver, error) {
+	const op = "handlers.GraphQL.Owners"
+
+	if err := checkPage(args.PageSize, args.Page); err != nil {
+		return nil, err
+	}
+
+	// у каждой машины своя запись владельца, поэтому владельцы выбираются вместе с машинами
+	var filter car.CarFilter
+	if f := args.Filter; f != nil {
+		filter = car.CarFilter{NameFilter: deref(f.Name), SurnameFilter: deref(f.Surname), PatronymicFilter: deref(f.Patronymic)}
+	}
+	if filter.UsesOwnerName() {
+		if err := requireScope(ctx, auth.ScopeOwnersRead); err != nil {
+			return nil, err
+		}
+	}
+	// без права на персональные данные порядок не должен зависеть от скрытого имени
+	filter.Sort = []car.SortField{{Field: car.FieldSurname}}
+	if auth.ShowOwners(ctx) {
+		filter.Sort = append(filter.Sort, car.SortField{Field: car.FieldName})
+	}
+
+	cars, err := r.storage.GetCars(ctx, int(args.PageSize), int(args.Page), filter, nil)
+	if err != nil {
+		return nil, storageError(r.logger(ctx, op), err, "failed to get owners")
+	}
+
+	owners := make([]*ownerResolver, 0, len(cars))
+	for _, cwo := range cars {
+		owners = append(owners, &ownerResolver{owner: cwo.Owner, car: &carResolver{root: r, cwo: cwo, hasOwner: true}})
+	}
+	return owners, nil
+}
+
+// Mutation
+
+type addCarsRequest struct {
+	RegNums []string `json:"regNums" validate:"required,min=1,max=100,dive,regnum"`
+}
+
+func (r *rootResolver) AddCars(ctx context.Context, args struct{ RegNums []string }) (*addCarsResolver, error) {
+	const op = "handlers.GraphQL.AddCars"
+
+	log := r.logger(ctx, op)
+
+	if err := requireScope(ctx, auth.ScopeCarsWrite); err != nil {
+		return nil, err
+	}
+	if err := validate(addCarsRequest{RegNums: args.RegNums}); err != nil {
+		return nil, err
+	}
+	if err := takeTokens(ctx, log, ratelimit.Write, 1); err != nil {
+		return nil, err
+	}
+	// каждый номер - отдельный запрос к CarInfo
+	if err := takeTokens(ctx, log, ratelimit.CarInfo, len(args.RegNums)); err != nil {
+		return nil, err
+	}
+
+	// как и в REST, ошибка одного номера не прерывает добавление остальных
+	res := &addCarsResolver{}
+	for _, regNum := range args.RegNums {
+		newCar, _, err := r.carInfo.Get(regNum)
+		if err != nil {
+			res.failed = append(res.failed, failedCar{regNum: regNum, code: err_response.CodeCarInfo, message: err.Error()})
+			continue
+		}
+
+		// проверяем данные, полученные из внешнего сервиса
+		if violations, err := validation.Struct(newCar); err != nil || len(violations) > 0 {
+			res.failed = append(res.failed, failedCar{regNum: regNum, code: err_response.CodeValidation,
+				message: fmt.Sprintf("invalid car data from carinfo: %v", violations)})
+			continue
+		}
+
+		carID, err := r.storage.AddCar(ctx, newCar, car.SourceCarInfo)
+		if errors.Is(err, storage.ErrCarExists) {
+			res.failed = append(res.failed, failedCar{regNum: regNum, code: err_response.CodeConflict, message: storage.ErrCarExists.Error()})
+			continue
+		}
+		if err != nil {
+			log.Error("failed to add car", slog.String("reg_num", regNum), "error", err)
+			res.failed = append(res.failed, failedCar{regNum: regNum, code: err_response.CodeStorage, message: "failed to save car"})
+			continue
+		}
+		res.carIDs = append(res.carIDs, gql.ID(strconv.Itoa(carID)))
+	}
+
+	return res, nil
+}
+
+type carPatchInput struct {
+	RegNum gql.NullString
+	Mark   gql.NullString
+	Model  gql.NullString
+	Year   gql.NullInt
+	Owner  *ownerPatchInput
+}
+
+type ownerPatchInput struct {
+	Name       gql.NullString
+	Surname    gql.NullString
+	Patronymic gql.NullString
+}
+
+// переводим поле ввода GraphQL в поле патча, явный null становится Null
+func patchString(v gql.NullString) car.PatchField[string] {
+	return car.PatchField[string]{Set: v.Set, Null: v.Set && v.Value == nil, Value: deref(v.Value)}
+}
+
+func (p carPatchInput) toPatch() car.PatchCar {
+	pc := car.PatchCar{
+		RegNum: patchString(p.RegNum),
+		Mark:   patchString(p.Mark),
+		Model:  patchString(p.Model),
+		Year:   car.PatchField[int16]{Set: p.Year.Set, Null: p.Year.Set && p.Year.Value == nil},
+	}
+	if p.Year.Value != nil {
+		year := *p.Year.Value
+		// значение вне int16 заведомо не проходит проверку года
+		if year < math.MinInt16 || year > math.MaxInt16 {
+			year = 0
+		}
+		pc.Year.Value = int16(year)
+	}
+	if p.Owner != nil {
+		pc.Name = patchString(p.Owner.Name)
+		pc.Surname = patchString(p.Owner.Surname)
+		pc.Patronymic = patchString(p.Owner.Patronymic)
+	}
+	return pc
+}
+
+func (r *rootResolver) PatchCar(ctx context.Context, args struct {
+	ID      gql.ID
+	Patch   carPatchInput
+	Version *int32
+}) (*carResolver, error) {
+	const op = "handlers.GraphQL.PatchCar"
+
+	log := r.logger(ctx, op)
+
+	if err := requireScope(ctx, auth.ScopeCarsWrite); err != nil {
+		return nil, err
+	}
+	if err := takeTokens(ctx, log, ratelimit.Write, 1); err != nil {
+		return nil, err
+	}
+	carID, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := args.Patch.toPatch()
+	if err := validate(pc); err != nil {
+		return nil, err
+	}
+
+	if _, err := r.storage.PatchCar(ctx, carID, pc, int(deref(args.Version))); err != nil {
+		return nil, storageError(log, err, "failed to patch car")
+	}
+
+	cwo, err := r.storage.GetCar(ctx, carID, nil, false)
+	if err != nil {
+		return nil, storageError(log, err, "failed to get car")
+	}
+
+	return &carResolver{root: r, cwo: cwo, hasOwner: true}, nil
+}
+
+func (r *rootResolver) DeleteCar(ctx context.Context, args struct {
+	ID      gql.ID
+	Version *int32
+}) (bool, error) {
+	const op = "handlers.GraphQL.DeleteCar"
+
+	if err := requireScope(ctx, auth.ScopeCarsDelete); err != nil {
+		return false, err
+	}
+	if err := takeTokens(ctx, r.logger(ctx, op), ratelimit.Write, 1); err != nil {
+		return false, err
+	}
+	carID, err := parseID(args.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := r.storage.DeleteCar(ctx, carID, int(deref(args.Version))); err != nil {
+		return false, storageError(r.logger(ctx, op), err, "failed to delete car")
+	}
+
+	return true, nil
+}
+
+// Types
+
+type carPageResolver struct {
+	root     *rootResolver
+	filter   car.CarFilter
+	nodes    []*carResolver
+	pageSize int32
+	page     int32
+
+	// общее количество считается, только если его запросили
+	countOnce sync.Once
+	total     int
+	err       error
+}
+
+func (p *carPageResolver) Nodes() []*carResolver {
+	return p.nodes
+}
+
+func (p *carPageResolver) Page() int32 {
+	return p.page
+}
+
+func (p *carPageResolver) count(ctx context.Context) (int, error) {
+	const op = "handlers.GraphQL.CarPage.count"
+
+	p.countOnce.Do(func() {
+		p.total, p.err = p.root.storage.GetTotalCarsCount(ctx, p.filter)
+		if p.err != nil {
+			p.err = storageError(p.root.logger(ctx, op), p.err, "failed to get total cars")
+		}
+	})
+	return p.total, p.err
+}
+
+func (p *carPageResolver) Total(ctx context.Context) (int32, error) {
+	total, err := p.count(ctx)
+	return int32(total), err
+}
+
+func (p *carPageResolver) LastPage(ctx context.Context) (int32, error) {
+	total, err := p.count(ctx)
+	return int32(math.Ceil(float64(total) / float64(p.pageSize))), err
+}
+
+type carResolver struct {
+	root *rootResolver
+	cwo  car.CarWithOwner
+	// hasOwner - владелец выбран вместе с машиной, иначе загружается через loader
+	hasOwner bool
+}
+
+func (c *carResolver) ID() gql.ID {
+	return gql.ID(strconv.Itoa(c.cwo.Id))
+}
+
+func (c *carResolver) RegNum() string {
+	return c.cwo.RegNum
+}
+
+func (c *carResolver) Mark() string {
+	return c.cwo.Mark
+}
+
+func (c *carResolver) Model() string {
+	return c.cwo.Model
+}
+
+func (c *carResolver) Year() *int32 {
+	if !c.cwo.Year.Valid {
+		return nil
+	}
+	year := int32(c.cwo.Year.Int16)
+	return &year
+}
+
+func (c *carResolver) Source() string {
+	return c.cwo.Source
+}
+
+func (c *carResolver) CarinfoFetchedAt() *gql.Time {
+	if c.cwo.CarInfoFetchedAt == nil {
+		return nil
+	}
+	return &gql.Time{Time: *c.cwo.CarInfoFetchedAt}
+}
+
+func (c *carResolver) CreatedAt() gql.Time {
+	return gql.Time{Time: c.cwo.CreatedAt}
+}
+
+func (c *carResolver) UpdatedAt() gql.Time {
+	return gql.Time{Time: c.cwo.UpdatedAt}
+}
+
+func (c *carResolver) DeletedAt() *gql.Time {
+	if c.cwo.DeletedAt == nil {
+		return nil
+	}
+	return &gql.Time{Time: *c.cwo.DeletedAt}
+}
+
+func (c *carResolver) Version() int32 {
+	return int32(c.cwo.Version)
+}
+
+func (c *carResolver) Owner(ctx context.Context) (*ownerResolver, error) {
+	const op = "handlers.GraphQL.Car.Owner"
+
+	if c.hasOwner {
+		return &ownerResolver{owner: c.cwo.Owner, car: c}, nil
+	}
+
+	owner, found, err := loadersFrom(ctx).owners.Load(ctx, c.cwo.Id)
+	if err != nil {
+		return nil, storageError(c.root.logger(ctx, op), err, "failed to get owner")
+	}
+	if !found {
+		return nil, &resolverError{message: "owner of the car was not found", code: err_response.CodeNotFound}
+	}
+	return &ownerResolver{owner: owner, car: c}, nil
+}
+
+func (c *carResolver) OwnerHistory(ctx context.Context) ([]*ownerRecordResolver, error) {
+	const op = "handlers.GraphQL.Car.OwnerHistory"
+
+	// записи о новых владельцах, от старых к новым
+	records, _, err := loadersFrom(ctx).ownerHistory.Load(ctx, c.cwo.Id)
+	if err != nil {
+		return nil, storageError(c.root.logger(ctx, op), err, "failed to get owner history")
+	}
+
+	history := []*ownerRecordResolver{}
+	for _, rec := range records {
+		var doc struct {
+			Owner car.People `json:"owner"`
+		}
+		if err := json.Unmarshal(rec.After, &doc); err != nil {
+			c.root.logger(ctx, op).Error("invalid audit snapshot", slog.Int64("audit_id", rec.ID), "error", err)
+			continue
+		}
+		history = append(history, &ownerRecordResolver{owner: doc.Owner, rec: rec})
+	}
+	return history, nil
+}
+
+type ownerResolver struct {
+	owner car.Owner
+	car   *carResolver
+}
+
+func (o *ownerResolver) Name(ctx context.Context) string {
+	return visibleOwner(ctx, o.owner.People).Name
+}
+
+func (o *ownerResolver) Surname() string {
+	return o.owner.Surname
+}
+
+func (o *ownerResolver) Patronymic(ctx context.Context) *string {
+	return visibleOwner(ctx, o.owner.People).Patronymic.Ptr()
+}
+
+func (o *ownerResolver) Source() string {
+	return o.owner.Source
+}
+
+func (o *ownerResolver) CreatedAt() gql.Time {
+	return gql.Time{Time: o.owner.CreatedAt}
+}
+
+func (o *ownerResolver) UpdatedAt() gql.Time {
+	return gql.Time{Time: o.owner.UpdatedAt}
+}
+
+func (o *ownerResolver) Car() *carResolver {
+	return o.car
+}
+
+type ownerRecordResolver struct {
+	owner car.People
+	rec   audit.Record
+}
+
+func (o *ownerRecordResolver) Name(ctx context.Context) string {
+	return visibleOwner(ctx, o.owner).Name
+}
+
+func (o *ownerRecordResolver) Surname() string {
+	return o.owner.Surname
+}
+
+func (o *ownerRecordResolver) Patronymic(ctx context.Context) *string {
+	return visibleOwner(ctx, o.owner).Patronymic.Ptr()
+}
+
+// без права на персональные данные имя и отчество владельца сокращаются до инициалов
+func visibleOwner(ctx context.Context, p car.People) car.People {
+	if auth.ShowOwners(ctx) {
+		return p
+	}
+	return p.Masked()
+}
+
+func (o *ownerRecordResolver) ChangedAt() gql.Time {
+	return gql.Time{Time: o.rec.CreatedAt}
+}
+
+// исполнитель берётся из журнала изменений, который доступен только администратору
+func (o *ownerRecordResolver) Actor(ctx context.Context) (string, error) {
+	if err := requireScope(ctx, auth.ScopeAdmin); err != nil {
+		return "", err
+	}
+	return o.rec.Actor, nil
+}
+
+func (o *ownerRecordResolver) Action() string {
+	return o.rec.Action
+}
+
+type failedCar struct {
+	regNum  string
+	code    string
+	message string
+}
+
+func (f failedCar) RegNum() string {
+	return f.regNum
+}
+
+func (f failedCar) Code() string {
+	return f.code
+}
+
+func (f failedCar) Message() string {
+	return f.message
+}
+
+type addCarsResolver struct {
+	carIDs []gql.ID
+	failed []failedCar
+}
+
+func (a *addCarsResolver) CarIds() []gql.ID {
+	if a.carIDs == nil {
+		return []gql.ID{}
+	}
+	return a.carIDs
+}
+
+func (a *addCarsResolver) Failed() []failedCar {
+	if a.failed == nil {
+		return []failedCar{}
+	}
+	return a.failed
+}
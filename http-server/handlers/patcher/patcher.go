@@ -1,13 +1,24 @@
 package patcher
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"strconv"
 
+	"github.com/P1coFly/CarInfoEM/http-server/etag"
 	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
 	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
@@ -15,24 +26,44 @@ import (
 
 type Request struct {
 	car.PatchCar
+	// LegacyRegNum - поле из исходной схемы, принимается для совместимости
+	LegacyRegNum car.PatchField[string] `json:"reg_num" swaggerignore:"true"`
 }
 
 type PatcherCar interface {
-	PatchCar(carID int, cwo car.PatchCar) (int, error)
+	GetCar(ctx context.Context, carID int, fields []string, includeDeleted bool) (car.CarWithOwner, error)
+	PatchCar(ctx context.Context, carID int, cwo car.PatchCar, version int) (int, error)
 }
 
+// Поддерживаемые форматы патча
+const (
+	ContentTypeJSON       = "application/json"
+	ContentTypeMergePatch = "application/merge-patch+json"
+	ContentTypeJSONPatch  = "application/json-patch+json"
+)
+
 // @Summary Patch
 // @Tags car
-// @Description patch car
+// @Description patch car. The format is chosen by Content-Type:
+// @Description application/json - only passed fields are changed, null clears nullable fields (year, owner.patronymic);
+// @Description application/merge-patch+json - RFC 7396 merge patch of the car document;
+// @Description application/json-patch+json - RFC 6902 list of operations on the car document
 // @Accept json
+// @Accept application/merge-patch+json
+// @Accept application/json-patch+json
 // @Produce json
 // @Param id path int true "Car ID"
-// @Param input body car.Car true "new car data"
+// @Param X-Schema-Version header int false "Response schema version for deprecated routes"
+// @Param If-Match header string false "ETag of the car version being patched"
+// @Param input body car.PatchCar true "new car data"
 // @Success 200
-// @Failure 400,404 {object} err_response.Response
-// @Failure 500 {object} err_response.Response
-// @Failure default {object} err_response.Response
-// @Router /car/patch/{id} [patch]
+// @Success 204 "nothing to change"
+// @Failure 400,404,409,412,415,422 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/{id} [patch]
+// @DeprecatedRouter /car/patch/{id} [patch]
 func New(log *slog.Logger, patcher PatcherCar) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.PatcherCar.New"
@@ -46,33 +77,72 @@ func New(log *slog.Logger, patcher PatcherCar) http.HandlerFunc {
 		carID, err := strconv.Atoi(chi.URLParam(r, "id"))
 		if err != nil {
 			log.Error("failed to get car ID from URL")
-			w.WriteHeader(400)
-			render.JSON(w, r, err_response.Error("failed to get car ID from URL"))
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get car ID from URL")
 			return
 		}
 
-		//декодируем тело запроса
-		var req Request
-		if err := render.DecodeJSON(r.Body, &req); err != nil {
-			log.Error("failed to decode request body", "error", err)
-			w.WriteHeader(400)
-			render.JSON(w, r, err_response.Error("failed to decode request body"))
+		// ожидаемая версия из If-Match, 0 - без проверки
+		version, err := etag.IfMatch(r)
+		if err != nil {
+			log.Error("invalid If-Match", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
 			return
 		}
 
-		log.Info("request body decoded", slog.Any("request", req))
+		// формат патча определяем по Content-Type, без него считаем тело обычным JSON
+		mediaType := ContentTypeJSON
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			mediaType, _, err = mime.ParseMediaType(ct)
+			if err != nil {
+				log.Error("failed to parse Content-Type", "error", err)
+				err_response.Render(w, r, 415, err_response.CodeUnsupportedMediaType, "invalid Content-Type")
+				return
+			}
+		}
+
+		var pc car.PatchCar
+		var ok bool
+		switch mediaType {
+		case ContentTypeJSON:
+			pc, ok = decodeFieldPatch(w, r, log)
+		case ContentTypeMergePatch, ContentTypeJSONPatch:
+			// патч документа применяется к прочитанной версии,
+			// поэтому сохраняем только если она не изменилась
+			pc, version, ok = applyDocumentPatch(w, r, log, patcher, carID, mediaType, version)
+			//документ не изменился
+			if ok && pc.IsEmpty() {
+				w.WriteHeader(204)
+				return
+			}
+		default:
+			log.Error("unsupported Content-Type", slog.String("content_type", mediaType))
+			err_response.Render(w, r, 415, err_response.CodeUnsupportedMediaType,
+				fmt.Sprintf("unsupported Content-Type %q", mediaType))
+			return
+		}
+		if !ok {
+			return
+		}
 
 		//вызываем метож патча сущности
-		code, err := patcher.PatchCar(carID, req.PatchCar)
+		code, err := patcher.PatchCar(r.Context(), carID, pc, version)
 		if err != nil {
+			if errors.Is(err, storage.ErrVersionMismatch) {
+				log.Info("car version mismatch", slog.Int("id", carID))
+				err_response.Render(w, r, 412, err_response.CodePreconditionFailed, "car was changed, reload it and retry")
+				return
+			}
 			if code == -1 {
-				w.WriteHeader(404)
-				render.JSON(w, r, err_response.Error("car with this id was not found"))
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "car with this id was not found")
+				return
+			}
+			if errors.Is(err, storage.ErrCarExists) {
+				log.Info("registration number is taken", slog.Int("id", carID))
+				err_response.Render(w, r, 409, err_response.CodeConflict, storage.ErrCarExists.Error())
 				return
 			}
 			log.Error("failed to patch car", "error", err)
-			w.WriteHeader(500)
-			render.JSON(w, r, err_response.Error(fmt.Sprintf("failed to patch car: %v", err)))
+			err_response.Render(w, r, 500, err_response.CodeInternal, fmt.Sprintf("failed to patch car: %v", err))
 			return
 		}
 		//Если нет изменений
@@ -84,3 +154,174 @@ func New(log *slog.Logger, patcher PatcherCar) http.HandlerFunc {
 		w.WriteHeader(200)
 	}
 }
+
+// разбираем патч из отдельных полей (application/json).
+// При ошибке ответ уже отправлен и возвращается false
+func decodeFieldPatch(w http.ResponseWriter, r *http.Request, log *slog.Logger) (car.PatchCar, bool) {
+	//декодируем тело запроса
+	var req Request
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		log.Error("failed to decode request body", "error", err)
+		err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to decode request body")
+		return car.PatchCar{}, false
+	}
+
+	if !req.RegNum.Set {
+		req.RegNum = req.LegacyRegNum
+	}
+
+	// в лог попадают только названия полей, значения могут содержать персональные данные
+	log.Info("request body decoded", slog.Any("patch", req.PatchCar))
+
+	if !validate(w, r, log, req.PatchCar) {
+		return car.PatchCar{}, false
+	}
+
+	return req.PatchCar, true
+}
+
+// применяем merge patch или JSON patch к текущему документу машины
+// и возвращаем патч только из изменившихся полей вместе с версией, к которой он применён.
+// ifMatch - версия из If-Match, 0 - без проверки.
+// При ошибке ответ уже отправлен и возвращается false
+func applyDocumentPatch(w http.ResponseWriter, r *http.Request, log *slog.Logger, patcher PatcherCar, carID int, mediaType string, ifMatch int) (car.PatchCar, int, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Error("failed to read request body", "error", err)
+		err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to read request body")
+		return car.PatchCar{}, 0, false
+	}
+
+	log.Info("request body read", slog.String("content_type", mediaType), slog.Int("size", len(body)))
+
+	current, err := patcher.GetCar(r.Context(), carID, nil, false)
+	if err != nil {
+		if errors.Is(err, storage.ErrCarNotFound) {
+			err_response.Render(w, r, 404, err_response.CodeNotFound, "car with this id was not found")
+			return car.PatchCar{}, 0, false
+		}
+		log.Error("failed to get car", "error", err)
+		err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get car")
+		return car.PatchCar{}, 0, false
+	}
+
+	if ifMatch != 0 && ifMatch != current.Version {
+		log.Info("car version mismatch", slog.Int("id", carID))
+		err_response.Render(w, r, 412, err_response.CodePreconditionFailed, "car was changed, reload it and retry")
+		return car.PatchCar{}, 0, false
+	}
+
+	// без права на персональные данные патч применяется к документу с инициалами владельца,
+	// иначе test, copy и move раскрыли бы полное имя
+	base := current
+	mask := !auth.ShowOwners(r.Context())
+	if mask {
+		base = current.MaskOwner()
+	}
+
+	doc, err := json.Marshal(base)
+	if err != nil {
+		log.Error("failed to encode car", "error", err)
+		err_response.Render(w, r, 500, err_response.CodeInternal, "failed to patch car")
+		return car.PatchCar{}, 0, false
+	}
+
+	var patched []byte
+	if mediaType == ContentTypeMergePatch {
+		patched, err = jsonpatch.MergePatch(doc, body)
+		if err != nil {
+			log.Info("failed to apply merge patch", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, fmt.Sprintf("invalid merge patch: %v", err))
+			return car.PatchCar{}, 0, false
+		}
+	} else {
+		ops, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			log.Info("failed to decode json patch", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, fmt.Sprintf("invalid json patch: %v", err))
+			return car.PatchCar{}, 0, false
+		}
+		patched, err = ops.Apply(doc)
+		if err != nil {
+			log.Info("failed to apply json patch", "error", err)
+			if errors.Is(err, jsonpatch.ErrTestFailed) {
+				err_response.Render(w, r, 409, err_response.CodeConflict, fmt.Sprintf("json patch test failed: %v", err))
+				return car.PatchCar{}, 0, false
+			}
+			err_response.Render(w, r, 422, err_response.CodePatchFailed, fmt.Sprintf("failed to apply json patch: %v", err))
+			return car.PatchCar{}, 0, false
+		}
+	}
+
+	var result car.CarWithOwner
+	if err := json.Unmarshal(patched, &result); err != nil {
+		log.Info("patched document is not a car", "error", err)
+		err_response.Render(w, r, 422, err_response.CodePatchFailed, fmt.Sprintf("patched document is not a car: %v", err))
+		return car.PatchCar{}, 0, false
+	}
+
+	if mask {
+		result = unmaskOwner(current, base, result)
+	}
+
+	// служебные поля менять нельзя
+	if violations := readOnlyViolations(current, result); len(violations) > 0 {
+		err_response.RenderViolations(w, r, violations)
+		return car.PatchCar{}, 0, false
+	}
+
+	if !validate(w, r, log, result.Car()) {
+		return car.PatchCar{}, 0, false
+	}
+
+	return car.Diff(current, result.Car()), current.Version, true
+}
+
+// возвращаем полные имя и отчество владельца, если патч оставил их инициалы,
+// чтобы замаскированные значения не записались вместо настоящих
+func unmaskOwner(current, masked, result car.CarWithOwner) car.CarWithOwner {
+	if result.Name == masked.Name {
+		result.Name = current.Name
+	}
+	if result.Patronymic == masked.Patronymic {
+		result.Patronymic = current.Patronymic
+	}
+	return result
+}
+
+// сравниваем служебные поля до и после патча.
+// Сравнение идёт по JSON, так как время после разбора документа теряет часовой пояс
+func readOnlyViolations(current, result car.CarWithOwner) []validation.Violation {
+	var violations []validation.Violation
+	// удаление и восстановление - отдельные операции
+	if result.DeletedAt != nil {
+		violations = append(violations, validation.Violation{Field: "deletedAt", Message: "is read-only"})
+	}
+	current.DeletedAt, result.DeletedAt = nil, nil
+
+	for _, f := range car.ReadOnlyFields {
+		before, _ := json.Marshal(current.Select([]string{f}))
+		after, _ := json.Marshal(result.Select([]string{f}))
+		if !bytes.Equal(before, after) {
+			violations = append(violations, validation.Violation{Field: f, Message: "is read-only"})
+		}
+	}
+	return violations
+}
+
+// проверяем данные по правилам валидации.
+// При нарушениях ответ уже отправлен и возвращается false
+func validate(w http.ResponseWriter, r *http.Request, log *slog.Logger, s any) bool {
+	violations, err := validation.Struct(s)
+	if err != nil {
+		log.Error("failed to validate request", "error", err)
+		err_response.Render(w, r, 500, err_response.CodeInternal, "failed to validate request")
+		return false
+	}
+	if len(violations) > 0 {
+		log.Info("invalid request", slog.Any("violations", violations))
+		err_response.RenderViolations(w, r, violations)
+		return false
+	}
+	return true
+}
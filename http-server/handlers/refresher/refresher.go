@@ -0,0 +1,103 @@
+package refresher
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/P1coFly/CarInfoEM/http-server/etag"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/resync"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+// Result - итог обновления машины
+type Result struct {
+	// Changed - данные в CarInfo отличались от сохранённых
+	Changed bool             `json:"changed"`
+	Car     car.CarWithOwner `json:"car"`
+}
+
+type Response struct {
+	Data Result `json:"data"`
+}
+
+// @Summary Refresh
+// @Tags car
+// @Description fetch the car from the CarInfo service again and save the changes. Manual edits are overwritten
+// @Produce json
+// @Param id path int true "Car ID"
+// @Param If-Match header string false "ETag of the car version being refreshed"
+// @Success 200 {object} Response
+// @Header 200 {string} ETag "car version"
+// @Failure 400,404,412,429 {object} err_response.Problem
+// @Failure 500,502 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/{id}/refresh [post]
+func New(log *slog.Logger, store resync.Storage, carInfo resync.CarInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.Refresher.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//пытаемсяя получить id с запроса
+		carID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			log.Error("failed to get car ID from URL")
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get car ID from URL")
+			return
+		}
+
+		// ожидаемая версия из If-Match, 0 - без проверки
+		version, err := etag.IfMatch(r)
+		if err != nil {
+			log.Error("invalid If-Match", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
+			return
+		}
+
+		changed, err := resync.Refresh(r.Context(), store, carInfo, carID, version)
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrCarNotFound):
+				log.Info("car not found", slog.Int("id", carID))
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "car with this id was not found")
+			case errors.Is(err, storage.ErrVersionMismatch):
+				log.Info("car version mismatch", slog.Int("id", carID))
+				err_response.Render(w, r, 412, err_response.CodePreconditionFailed, "car was changed, reload it and retry")
+			case errors.Is(err, resync.ErrCarInfo):
+				log.Error("failed to get car from carinfo", "error", err)
+				err_response.Render(w, r, 502, err_response.CodeCarInfo, "failed to get car from carinfo")
+			case errors.Is(err, resync.ErrInvalidCarInfo):
+				log.Error("invalid car from carinfo", "error", err)
+				err_response.Render(w, r, 502, err_response.CodeCarInfo, err.Error())
+			default:
+				log.Error("failed to refresh car", "error", err)
+				err_response.Render(w, r, 500, err_response.CodeInternal, "failed to refresh car")
+			}
+			return
+		}
+
+		log.Info("car refreshed", slog.Int("id", carID), slog.Bool("changed", changed))
+
+		cwo, err := store.GetCar(r.Context(), carID, nil, false)
+		if err != nil {
+			log.Error("failed to get car", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get car. Try later")
+			return
+		}
+
+		w.Header().Set("ETag", etag.Format(cwo.Version))
+		render.Status(r, 200)
+		render.JSON(w, r, Response{Data: Result{Changed: changed, Car: cwo}})
+	}
+}
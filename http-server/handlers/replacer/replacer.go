@@ -0,0 +1,111 @@
+package replacer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/P1coFly/CarInfoEM/http-server/etag"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+type ReplacerCar interface {
+	ReplaceCar(ctx context.Context, carID int, c car.Car, version int) error
+}
+
+// @Summary Replace
+// @Tags car
+// @Description replace all car data. Omitted nullable fields (year, owner.patronymic) are cleared
+// @Accept json
+// @Produce json
+// @Param id path int true "Car ID"
+// @Param If-Match header string false "ETag of the car version being replaced"
+// @Param input body car.Car true "new car data"
+// @Success 204
+// @Failure 400,404,409,412,422 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/{id} [put]
+func New(log *slog.Logger, replacer ReplacerCar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.ReplacerCar.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//пытаемсяя получить id с запроса
+		carID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			log.Error("failed to get car ID from URL")
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get car ID from URL")
+			return
+		}
+
+		// ожидаемая версия из If-Match, 0 - без проверки
+		version, err := etag.IfMatch(r)
+		if err != nil {
+			log.Error("invalid If-Match", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
+			return
+		}
+
+		//декодируем тело запроса
+		var req car.Car
+		if err := render.DecodeJSON(r.Body, &req); err != nil {
+			log.Error("failed to decode request body", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to decode request body")
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		violations, err := validation.Struct(req)
+		if err != nil {
+			log.Error("failed to validate request", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to validate request")
+			return
+		}
+		if len(violations) > 0 {
+			log.Info("invalid request", slog.Any("violations", violations))
+			err_response.RenderViolations(w, r, violations)
+			return
+		}
+
+		//заменяем данные машины
+		if err := replacer.ReplaceCar(r.Context(), carID, req, version); err != nil {
+			if errors.Is(err, storage.ErrVersionMismatch) {
+				log.Info("car version mismatch", slog.Int("id", carID))
+				err_response.Render(w, r, 412, err_response.CodePreconditionFailed, "car was changed, reload it and retry")
+				return
+			}
+			if errors.Is(err, storage.ErrCarNotFound) {
+				log.Info("car not found", slog.Int("id", carID))
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "car with this id was not found")
+				return
+			}
+			if errors.Is(err, storage.ErrCarExists) {
+				log.Info("registration number is taken", slog.Int("id", carID))
+				err_response.Render(w, r, 409, err_response.CodeConflict, storage.ErrCarExists.Error())
+				return
+			}
+			log.Error("failed to replace car", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to replace car")
+			return
+		}
+
+		log.Info("car replaced", slog.Int("id", carID))
+
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,84 @@
+package restorer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/P1coFly/CarInfoEM/http-server/etag"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+type RestorerCar interface {
+	RestoreCar(ctx context.Context, carID, version int) error
+}
+
+// @Summary Restore
+// @Tags car
+// @Description restore a deleted car that has not been purged yet
+// @Produce json
+// @Param id path int true "Car ID"
+// @Param If-Match header string false "ETag of the car version being restored"
+// @Success 204
+// @Failure 400,404,409,412 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/cars/{id}/restore [post]
+func New(log *slog.Logger, restorer RestorerCar) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.RestorerCar.New"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//пытаемсяя получить id с запроса
+		carID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			log.Error("failed to get car ID from URL")
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get car ID from URL")
+			return
+		}
+
+		// ожидаемая версия из If-Match, 0 - без проверки
+		version, err := etag.IfMatch(r)
+		if err != nil {
+			log.Error("invalid If-Match", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
+			return
+		}
+
+		//восстанавливаем машину
+		if err := restorer.RestoreCar(r.Context(), carID, version); err != nil {
+			switch {
+			case errors.Is(err, storage.ErrVersionMismatch):
+				log.Info("car version mismatch", slog.Int("id", carID))
+				err_response.Render(w, r, 412, err_response.CodePreconditionFailed, "car was changed, reload it and retry")
+			case errors.Is(err, storage.ErrCarNotFound):
+				log.Info("car not found", slog.Int("id", carID))
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "car with this id was not found")
+			case errors.Is(err, storage.ErrCarNotDeleted):
+				log.Info("car is not deleted", slog.Int("id", carID))
+				err_response.Render(w, r, 409, err_response.CodeConflict, "car is not deleted")
+			case errors.Is(err, storage.ErrCarExists):
+				log.Info("registration number is taken", slog.Int("id", carID))
+				err_response.Render(w, r, 409, err_response.CodeConflict, storage.ErrCarExists.Error())
+			default:
+				log.Error("failed to restore car", "error", err)
+				err_response.Render(w, r, 500, err_response.CodeInternal, "failed to restore car")
+			}
+			return
+		}
+
+		log.Info("car restored", slog.Int("id", carID))
+
+		w.WriteHeader(204)
+	}
+}
@@ -0,0 +1,274 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/models/webhook"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+)
+
+type WebhookStore interface {
+	CreateWebhook(ctx context.Context, w webhook.Webhook) (webhook.Webhook, error)
+	GetWebhooks(ctx context.Context) ([]webhook.Webhook, error)
+	DeleteWebhook(ctx context.Context, id int64) error
+	GetWebhookDeliveries(ctx context.Context, webhookID int64, status string, pageSize, pageToken int) ([]webhook.Delivery, error)
+}
+
+type CreateRequest struct {
+	URL string `json:"url" example:"https://example.com/hooks/cars" validate:"required,http_url,max=2048"`
+	// Events - типы событий, пустой список означает все
+	Events []string `json:"events" example:"created,deleted" validate:"max=3,dive,oneof=created updated deleted"`
+	// Secret - ключ подписи, если не указан, генерируется
+	Secret string `json:"secret" validate:"omitempty,min=16,max=256"`
+}
+
+type WebhookResponse struct {
+	Data webhook.Webhook `json:"data"`
+}
+
+type ListResponse struct {
+	Data []webhook.Webhook `json:"data"`
+}
+
+type DeliveriesResponse struct {
+	Data []webhook.Delivery `json:"data"`
+}
+
+// @Summary Create webhook
+// @Tags webhooks
+// @Description subscribe an URL to car changes. Requests are signed: X-Webhook-Signature is sha256= and hex HMAC-SHA256
+// @Description of "<X-Webhook-Timestamp>.<body>" with the secret. The secret is returned only in this response
+// @Accept json
+// @Produce json
+// @Param input body CreateRequest true "subscription"
+// @Success 201 {object} WebhookResponse
+// @Failure 400,422 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/webhooks [post]
+func NewCreate(log *slog.Logger, store WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.Webhooks.NewCreate"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		//декодируем тело запроса
+		var req CreateRequest
+		if err := render.DecodeJSON(r.Body, &req); err != nil {
+			log.Error("failed to decode request body", "error", err)
+			err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to decode request body")
+			return
+		}
+
+		// секрет в лог не пишем
+		log.Info("request body decoded", slog.String("url", req.URL), slog.Any("events", req.Events))
+
+		violations, err := validation.Struct(req)
+		if err != nil {
+			log.Error("failed to validate request", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to validate request")
+			return
+		}
+		if len(violations) > 0 {
+			log.Info("invalid request", slog.Any("violations", violations))
+			err_response.RenderViolations(w, r, violations)
+			return
+		}
+
+		if req.Secret == "" {
+			req.Secret, err = newSecret()
+			if err != nil {
+				log.Error("failed to generate secret", "error", err)
+				err_response.Render(w, r, 500, err_response.CodeInternal, "failed to create webhook")
+				return
+			}
+		}
+
+		hook, err := store.CreateWebhook(r.Context(), webhook.Webhook{URL: req.URL, Events: req.Events, Secret: req.Secret})
+		if err != nil {
+			log.Error("failed to create webhook", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to create webhook")
+			return
+		}
+
+		log.Info("webhook created", slog.Int64("id", hook.ID))
+
+		render.Status(r, 201)
+		render.JSON(w, r, WebhookResponse{Data: hook})
+	}
+}
+
+// @Summary List webhooks
+// @Tags webhooks
+// @Description get all webhook subscriptions, secrets are not returned
+// @Produce json
+// @Success 200 {object} ListResponse
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/webhooks [get]
+func NewList(log *slog.Logger, store WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.Webhooks.NewList"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		hooks, err := store.GetWebhooks(r.Context())
+		if err != nil {
+			log.Error("failed to get webhooks", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get webhooks. Try later")
+			return
+		}
+
+		render.Status(r, 200)
+		render.JSON(w, r, ListResponse{Data: hooks})
+	}
+}
+
+// @Summary Delete webhook
+// @Tags webhooks
+// @Description delete a webhook subscription together with its pending deliveries
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 204
+// @Failure 400,404 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/webhooks/{id} [delete]
+func NewDelete(log *slog.Logger, store WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.Webhooks.NewDelete"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("failed to get webhook ID from URL")
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get webhook ID from URL")
+			return
+		}
+
+		if err := store.DeleteWebhook(r.Context(), id); err != nil {
+			if errors.Is(err, storage.ErrWebhookNotFound) {
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "webhook with this id was not found")
+				return
+			}
+			log.Error("failed to delete webhook", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to delete webhook")
+			return
+		}
+
+		log.Info("webhook deleted", slog.Int64("id", id))
+
+		w.WriteHeader(204)
+	}
+}
+
+// @Summary Webhook deliveries
+// @Tags webhooks
+// @Description get the delivery log of a webhook, newest first
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param status query string false "Filter by status: pending, delivered or failed"
+// @Param page_size query int false "Page size (default is 100) used for pagination" default:"100"
+// @Param page_token query int false "Page token (default is 1) used for pagination" default:"1"
+// @Success 200 {object} DeliveriesResponse
+// @Failure 400,404 {object} err_response.Problem
+// @Failure 500 {object} err_response.Problem
+// @Failure default {object} err_response.Problem
+// @Security ApiKeyAuth
+// @Router /api/v1/webhooks/{id}/deliveries [get]
+func NewDeliveries(log *slog.Logger, store WebhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.Webhooks.NewDeliveries"
+
+		log = log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("failed to get webhook ID from URL")
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "failed to get webhook ID from URL")
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "", webhook.StatusPending, webhook.StatusDelivered, webhook.StatusFailed:
+		default:
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, "invalid status, need pending, delivered or failed")
+			return
+		}
+
+		pageSize, err := pageParam(r, "page_size", 100)
+		if err != nil {
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
+			return
+		}
+		pageToken, err := pageParam(r, "page_token", 1)
+		if err != nil {
+			err_response.Render(w, r, 400, err_response.CodeInvalidParam, err.Error())
+			return
+		}
+
+		deliveries, err := store.GetWebhookDeliveries(r.Context(), id, status, pageSize, pageToken)
+		if err != nil {
+			if errors.Is(err, storage.ErrWebhookNotFound) {
+				err_response.Render(w, r, 404, err_response.CodeNotFound, "webhook with this id was not found")
+				return
+			}
+			log.Error("failed to get webhook deliveries", "error", err)
+			err_response.Render(w, r, 500, err_response.CodeInternal, "failed to get webhook deliveries. Try later")
+			return
+		}
+
+		render.Status(r, 200)
+		render.JSON(w, r, DeliveriesResponse{Data: deliveries})
+	}
+}
+
+// генерируем случайный секрет подписи
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// получаем положительный параметр пагинации, если не указан - def
+func pageParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 1 {
+		return 0, errors.New("incorrect " + name + ", " + name + " must be an integer greater than 0")
+	}
+	return v, nil
+}
@@ -0,0 +1,111 @@
+package access
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/actor"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/go-chi/chi/middleware"
+)
+
+const (
+	// APIKeyHeader - заголовок с ключом API, альтернатива Authorization: Bearer
+	APIKeyHeader = "X-API-Key"
+	// TenantHeader - заголовок, которым администратор выбирает арендатора
+	TenantHeader = "X-Tenant-ID"
+)
+
+// Token возвращает токен из Authorization: Bearer или X-API-Key
+func Token(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		scheme, token, ok := strings.Cut(h, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(APIKeyHeader))
+}
+
+// New аутентифицирует запрос по токену и сохраняет клиента в контексте,
+// он же становится исполнителем запроса в журнале изменений.
+// Арендатор запроса берётся из клиента или из X-Tenant-ID (см. auth.Principal.ResolveTenant).
+// Запрос без токена проходит дальше без клиента, права проверяет Require
+func New(log *slog.Logger, authenticator auth.Authenticator) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			const op = "middleware.access.New"
+
+			token := Token(r)
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p, err := authenticator.Authenticate(r.Context(), token)
+			if err != nil {
+				if errors.Is(err, auth.ErrUnauthenticated) || errors.Is(err, auth.ErrUnsupported) {
+					unauthorized(w, r, "invalid credentials")
+					return
+				}
+				log.Error("failed to authenticate",
+					slog.String("op", op),
+					slog.String("request_id", middleware.GetReqID(r.Context())),
+					"error", err)
+				err_response.Render(w, r, 500, err_response.CodeInternal, "failed to authenticate")
+				return
+			}
+
+			tenantID, err := p.ResolveTenant(strings.TrimSpace(r.Header.Get(TenantHeader)))
+			if err != nil {
+				if errors.Is(err, auth.ErrInvalidTenant) {
+					err_response.Render(w, r, 400, err_response.CodeInvalidParam, "invalid "+TenantHeader)
+					return
+				}
+				err_response.Render(w, r, 403, err_response.CodeForbidden, "access to tenant denied")
+				return
+			}
+
+			log.Info("request authenticated",
+				slog.String("op", op),
+				slog.String("request_id", middleware.GetReqID(r.Context())),
+				slog.String("actor", p.Subject),
+				slog.String("tenant", tenantID))
+
+			ctx := auth.WithPrincipal(r.Context(), p)
+			ctx = actor.WithActor(ctx, p.Subject)
+			ctx = tenant.WithTenant(ctx, tenantID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Require пропускает только клиентов с правом scope
+func Require(scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			p, ok := auth.FromContext(r.Context())
+			if !ok {
+				unauthorized(w, r, "authentication required")
+				return
+			}
+			if !p.HasScope(scope) {
+				err_response.Render(w, r, 403, err_response.CodeForbidden, "missing scope "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="carinfo"`)
+	err_response.Render(w, r, 401, err_response.CodeUnauthorized, detail)
+}
@@ -0,0 +1,163 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/models/idempotency"
+	"github.com/go-chi/chi/middleware"
+)
+
+// Header - заголовок с ключом идемпотентности
+const Header = "Idempotency-Key"
+
+// ReplayedHeader выставляется в ответе, повторённом из сохранённого
+const ReplayedHeader = "Idempotent-Replayed"
+
+// максимальная длина ключа
+const maxKeyLength = 255
+
+// заголовки ответа, которые сохраняются и повторяются вместе с телом
+var replayHeaders = []string{"Location", "Retry-After", "ETag"}
+
+// сколько ждать сохранения ответа или освобождения ключа после завершения запроса
+const saveTimeout = 5 * time.Second
+
+// Store хранит ключи отдельно для каждого арендатора и исполнителя запроса из контекста
+type Store interface {
+	ReserveIdempotencyKey(ctx context.Context, key, requestHash string, ttl time.Duration) (idempotency.Record, bool, error)
+	CompleteIdempotencyKey(ctx context.Context, rec idempotency.Record) error
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+}
+
+// New сохраняет первый ответ на запрос с Idempotency-Key на время ttl
+// и повторяет его на следующие запросы того же клиента с тем же ключом.
+// Повтор ключа с другим телом запроса отклоняется
+func New(log *slog.Logger, store Store, ttl time.Duration) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			const op = "middleware.idempotency.New"
+
+			key := r.Header.Get(Header)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			log := log.With(
+				slog.String("op", op),
+				slog.String("request_id", middleware.GetReqID(r.Context())),
+				slog.String("idempotency_key", key),
+			)
+
+			if len(key) > maxKeyLength {
+				err_response.Render(w, r, 400, err_response.CodeInvalidParam, "Idempotency-Key is too long")
+				return
+			}
+
+			// читаем тело для хэша и возвращаем его обработчику
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				log.Error("failed to read request body", "error", err)
+				err_response.Render(w, r, 400, err_response.CodeInvalidBody, "failed to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			requestHash := hashRequest(r, body)
+
+			rec, reserved, err := store.ReserveIdempotencyKey(r.Context(), key, requestHash, ttl)
+			if err != nil {
+				log.Error("failed to reserve idempotency key", "error", err)
+				err_response.Render(w, r, 500, err_response.CodeInternal, "failed to check Idempotency-Key")
+				return
+			}
+
+			if !reserved {
+				switch {
+				case rec.RequestHash != requestHash:
+					log.Info("idempotency key reused with different request")
+					err_response.Render(w, r, 422, err_response.CodeIdempotencyKeyReused,
+						"Idempotency-Key was already used with a different request")
+				case !rec.Completed:
+					log.Info("request with idempotency key is in progress")
+					err_response.Render(w, r, 409, err_response.CodeConflict,
+						"request with this Idempotency-Key is still in progress")
+				default:
+					log.Info("replaying stored response", slog.Int("status", rec.StatusCode))
+					if rec.ContentType != "" {
+						w.Header().Set("Content-Type", rec.ContentType)
+					}
+					for name, value := range rec.Headers {
+						w.Header().Set(name, value)
+					}
+					w.Header().Set(ReplayedHeader, "true")
+					w.WriteHeader(rec.StatusCode)
+					w.Write(rec.Body)
+				}
+				return
+			}
+
+			// выполняем запрос и запоминаем ответ
+			buf := &bytes.Buffer{}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(buf)
+
+			defer func() {
+				// контекст запроса уже может быть отменён, если клиент отключился,
+				// а ключ нельзя оставлять "в процессе" до истечения ttl
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), saveTimeout)
+				defer cancel()
+
+				// ошибки сервера и превышение лимита запросов не сохраняем, чтобы запрос можно было повторить,
+				// например после Retry-After
+				if p := recover(); p != nil || ww.Status() >= 500 || ww.Status() == http.StatusTooManyRequests {
+					if err := store.ReleaseIdempotencyKey(ctx, key); err != nil {
+						log.Error("failed to release idempotency key", "error", err)
+					}
+					if p != nil {
+						panic(p)
+					}
+					return
+				}
+
+				rec.Completed = true
+				rec.StatusCode = ww.Status()
+				if rec.StatusCode == 0 {
+					rec.StatusCode = http.StatusOK
+				}
+				rec.ContentType = ww.Header().Get("Content-Type")
+				for _, name := range replayHeaders {
+					if value := ww.Header().Get(name); value != "" {
+						if rec.Headers == nil {
+							rec.Headers = make(map[string]string)
+						}
+						rec.Headers[name] = value
+					}
+				}
+				rec.Body = buf.Bytes()
+				if err := store.CompleteIdempotencyKey(ctx, rec); err != nil {
+					log.Error("failed to save idempotent response", "error", err)
+				}
+			}()
+
+			next.ServeHTTP(ww, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// хэш метода, пути и тела запроса
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
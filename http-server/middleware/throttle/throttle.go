@@ -0,0 +1,162 @@
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/go-chi/chi/middleware"
+)
+
+// Заголовки лимитов запросов (draft-ietf-httpapi-ratelimit-headers)
+const (
+	LimitHeader     = "RateLimit-Limit"
+	RemainingHeader = "RateLimit-Remaining"
+	ResetHeader     = "RateLimit-Reset"
+	PolicyHeader    = "RateLimit-Policy"
+)
+
+// Client определяет клиента запроса для лимитов: аутентифицированный клиент
+// ограничивается по ключу или токену в своём арендаторе, остальные - по IP.
+// Должен стоять после аутентификации
+func Client(limiter *ratelimit.Limiter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := ratelimit.WithClient(r.Context(), limiter, clientName(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func clientName(r *http.Request) string {
+	if p, ok := auth.FromContext(r.Context()); ok {
+		// имена ключей API уникальны только внутри арендатора
+		tenantID, _ := tenant.FromContext(r.Context())
+		return tenantID + "/" + p.Subject
+	}
+	return ipName(r)
+}
+
+func ipName(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// IP списывает по токену за запрос из бюджета IP по адресу клиента.
+// Должен стоять до аутентификации, чтобы запросы с неверными токенами тоже ограничивались
+func IP(log *slog.Logger, limiter *ratelimit.Limiter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := ratelimit.WithClient(r.Context(), limiter, ipName(r))
+			if Take(log, w, r.WithContext(ctx), ratelimit.IP, 1) {
+				next.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Requests списывает по токену за запрос: GET и HEAD из бюджета Read, остальные из Write
+func Requests(log *slog.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			budget := ratelimit.Write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				budget = ratelimit.Read
+			}
+			if Take(log, w, r, budget, 1) {
+				next.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Limit списывает по токену за запрос из бюджета budget
+func Limit(log *slog.Logger, budget ratelimit.Budget) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if Take(log, w, r, budget, 1) {
+				next.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Take списывает n токенов у клиента запроса и выставляет заголовки RateLimit-*.
+// Если токенов не хватает, отвечает 429 и возвращает false.
+// При недоступном хранилище лимитов запрос пропускается
+func Take(log *slog.Logger, w http.ResponseWriter, r *http.Request, budget ratelimit.Budget, n int) bool {
+	const op = "middleware.throttle.Take"
+
+	res, err := ratelimit.Take(r.Context(), budget, n)
+	if errors.Is(err, ratelimit.ErrBatchTooLarge) {
+		// такой запрос не пройдёт и после ожидания, повторять его бессмысленно
+		log.Info("batch exceeds rate limit burst",
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("budget", string(budget)), slog.Int("n", n))
+		err_response.Render(w, r, http.StatusUnprocessableEntity, err_response.CodeValidation,
+			fmt.Sprintf("batch of %d exceeds the %s rate limit burst of %d", n, budget, res.Limit))
+		return false
+	}
+	if err != nil {
+		log.Error("failed to take rate limit tokens",
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			"error", err)
+		return true
+	}
+	if res.Limit == 0 {
+		return true
+	}
+
+	if !res.Allowed {
+		setHeaders(w, res, true)
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		log.Info("rate limit exceeded",
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("budget", string(budget)))
+		err_response.Render(w, r, http.StatusTooManyRequests, err_response.CodeRateLimited,
+			fmt.Sprintf("%s rate limit exceeded, retry in %d seconds", budget, ceilSeconds(res.RetryAfter)))
+		return false
+	}
+
+	setHeaders(w, res, false)
+	return true
+}
+
+// Если запрос списывает токены из нескольких бюджетов, в заголовках остаётся
+// тот, в котором осталось меньше всего
+func setHeaders(w http.ResponseWriter, res ratelimit.Result, force bool) {
+	h := w.Header()
+	if !force {
+		if remaining, err := strconv.Atoi(h.Get(RemainingHeader)); err == nil && remaining <= res.Remaining {
+			return
+		}
+	}
+
+	h.Set(LimitHeader, strconv.Itoa(res.Limit))
+	h.Set(RemainingHeader, strconv.Itoa(res.Remaining))
+	h.Set(ResetHeader, strconv.Itoa(ceilSeconds(res.Reset)))
+	h.Set(PolicyHeader, fmt.Sprintf("%d;w=%d", res.Limit, ceilSeconds(res.Period)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,170 @@
+package router
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/adder"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/apikeys"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/auditlog"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/batch"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/carevents"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/deleter"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/err_response"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/getter"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/graphql"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/patcher"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/refresher"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/replacer"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/restorer"
+	"github.com/P1coFly/CarInfoEM/http-server/handlers/webhooks"
+	"github.com/P1coFly/CarInfoEM/http-server/middleware/access"
+	"github.com/P1coFly/CarInfoEM/http-server/middleware/idempotency"
+	"github.com/P1coFly/CarInfoEM/http-server/middleware/throttle"
+	"github.com/P1coFly/CarInfoEM/http-server/schema"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+	"github.com/P1coFly/CarInfoEM/internal/resync"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	httpSwagger "github.com/swaggo/http-swagger"
+)
+
+// APIPrefix - префикс версионированного API
+const APIPrefix = "/api/v1"
+
+// Storage - всё, что нужно обработчикам от хранилища
+type Storage interface {
+	idempotency.Store
+	adder.AddCar
+	getter.GetCar
+	getter.GetCarByID
+	patcher.PatcherCar
+	replacer.ReplacerCar
+	deleter.DeleterCar
+	restorer.RestorerCar
+	batch.CarFinder
+	resync.Storage
+	auditlog.AuditReader
+	carevents.EventReader
+	webhooks.WebhookStore
+	apikeys.KeyStore
+	auth.KeyStore
+	graphql.Storage
+}
+
+// Options - настройки маршрутов
+type Options struct {
+	// DefaultSchema - версия схемы ответов для устаревших маршрутов, если клиент её не указал
+	DefaultSchema schema.Version
+	// IdempotencyTTL - сколько хранится ответ на запрос с Idempotency-Key
+	IdempotencyTTL time.Duration
+	// Authenticator проверяет токены клиентов, права задаются для каждого маршрута
+	Authenticator auth.Authenticator
+	// Limiter ограничивает частоту запросов клиентов, nil - без ограничений
+	Limiter *ratelimit.Limiter
+}
+
+// New собирает router со всеми endpoints
+// hub - источник новых событий для ленты изменений
+func New(log *slog.Logger, storage Storage, carInfo adder.CarInfo, hub carevents.Subscriber, opts Options) http.Handler {
+	router := chi.NewRouter()
+
+	router.Use(middleware.RequestID)
+	router.Use(middleware.Logger)
+	router.Use(middleware.Recoverer)
+	router.Use(middleware.URLFormat)
+	router.NotFound(err_response.NotFound)
+	router.MethodNotAllowed(err_response.MethodNotAllowed)
+
+	authenticate := access.New(log, opts.Authenticator)
+	read := access.Require(auth.ScopeCarsRead)
+	write := access.Require(auth.ScopeCarsWrite)
+	remove := access.Require(auth.ScopeCarsDelete)
+	admin := access.Require(auth.ScopeAdmin)
+	// запросы с одного адреса ограничиваются до аутентификации, иначе неверные токены можно перебирать без лимита
+	ipLimit := throttle.IP(log, opts.Limiter)
+	client := throttle.Client(opts.Limiter)
+	// запросы к CarInfo ограничиваются отдельно, добавление машин списывает токены по числу номеров
+	carInfoLimit := throttle.Limit(log, ratelimit.CarInfo)
+
+	// версионированное API всегда отвечает по актуальной схеме
+	router.Route(APIPrefix, func(r chi.Router) {
+		r.Use(schema.Middleware(schema.V2, true))
+		r.Use(ipLimit)
+		r.Use(authenticate)
+		r.Use(client)
+		r.Use(throttle.Requests(log))
+
+		r.With(read).Get("/cars", getter.New(log, storage))
+		r.With(read).Get("/cars/events", carevents.New(log, storage, hub))
+		r.With(write, idempotency.New(log, storage, opts.IdempotencyTTL)).Post("/cars", adder.New(log, storage, carInfo))
+		r.With(remove).Post("/cars/batch-delete", batch.NewDelete(log, storage))
+		r.With(write).Post("/cars/batch-patch", batch.NewPatch(log, storage))
+		r.With(read).Get("/cars/{id}", getter.NewByID(log, storage))
+		r.With(write).Patch("/cars/{id}", patcher.New(log, storage))
+		r.With(write).Put("/cars/{id}", replacer.New(log, storage))
+		r.With(remove).Delete("/cars/{id}", deleter.New(log, storage))
+		r.With(write).Post("/cars/{id}/restore", restorer.New(log, storage))
+		r.With(write, carInfoLimit).Post("/cars/{id}/refresh", refresher.New(log, storage, carInfo))
+
+		r.Group(func(r chi.Router) {
+			r.Use(admin)
+
+			// журнал изменений хранит, кто и что менял, поэтому доступен только администратору
+			r.Get("/cars/{id}/history", auditlog.NewCarHistory(log, storage))
+			r.Get("/audit", auditlog.New(log, storage))
+
+			r.Post("/webhooks", webhooks.NewCreate(log, storage))
+			r.Get("/webhooks", webhooks.NewList(log, storage))
+			r.Delete("/webhooks/{id}", webhooks.NewDelete(log, storage))
+			r.Get("/webhooks/{id}/deliveries", webhooks.NewDeliveries(log, storage))
+
+			r.Post("/api-keys", apikeys.NewCreate(log, storage))
+			r.Get("/api-keys", apikeys.NewList(log, storage))
+			r.Delete("/api-keys/{id}", apikeys.NewRevoke(log, storage))
+		})
+	})
+
+	// GraphQL отвечает в своём формате и не зависит от версии схемы REST.
+	// Права на мутации проверяются в резолверах, там же списываются токены изменений
+	router.With(schema.Middleware(schema.V2, true), ipLimit, authenticate, client, throttle.Limit(log, ratelimit.Read), read).
+		Post("/graphql", graphql.New(log, storage, carInfo))
+
+	// устаревшие маршруты оставлены для существующих клиентов
+	router.Group(func(r chi.Router) {
+		r.Use(schema.Middleware(opts.DefaultSchema, false))
+		r.Use(ipLimit)
+		r.Use(authenticate)
+		r.Use(client)
+		r.Use(throttle.Requests(log))
+
+		r.With(deprecated("/cars"), read).Get("/cars", getter.New(log, storage))
+		r.With(deprecated("/cars"), write, idempotency.New(log, storage, opts.IdempotencyTTL)).Post("/car/add", adder.New(log, storage, carInfo))
+		r.With(deprecated("/cars/{id}"), write).Patch("/car/patch/{id}", patcher.New(log, storage))
+		r.With(deprecated("/cars/{id}"), remove).Delete("/car/delete/{id}", deleter.New(log, storage))
+	})
+
+	//Для доступа к swagger надо пройти по URI /swagger/
+	router.Get("/swagger/*", httpSwagger.Handler(
+		httpSwagger.URL("/swagger/doc.json"), //По URI /swagger/doc.json будет ледать спецификация в формате JSON
+	))
+
+	return router
+}
+
+// deprecated помечает маршрут устаревшим и указывает на замену в версионированном API
+func deprecated(successor string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			link := APIPrefix + strings.ReplaceAll(successor, "{id}", chi.URLParam(r, "id"))
+
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+link+`>; rel="successor-version"`)
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,261 @@
+package router_test
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/http-server/carinfo"
+	"github.com/P1coFly/CarInfoEM/http-server/router"
+	"github.com/P1coFly/CarInfoEM/http-server/schema"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/events"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/storage/postgresql"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/guregu/null/v5"
+	_ "github.com/lib/pq"
+)
+
+// Тесты изоляции арендаторов работают с настоящей БД и пропускаются, если TEST_DB_HOST не задан.
+// Все таблицы с машинами очищаются, поэтому БД должна быть отдельной
+func openTestStorage(t *testing.T) *postgresql.Storage {
+	t.Helper()
+
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST is not set")
+	}
+	port, user := os.Getenv("TEST_DB_PORT"), os.Getenv("TEST_DB_USER")
+	password, name := os.Getenv("TEST_DB_PASSWORD"), os.Getenv("TEST_DB_NAME")
+
+	storage, err := postgresql.New(host, port, user, password, name, "../../migrations")
+	if err != nil {
+		t.Fatalf("failed to connect storage: %v", err)
+	}
+
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`TRUNCATE CARS, PEOPLES, AUDIT_LOG, CAR_EVENTS, IDEMPOTENCY_KEYS RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatalf("failed to truncate tables: %v", err)
+	}
+	return storage
+}
+
+type tenantData struct {
+	id    string
+	token string
+	// cars - id всех машин арендатора, включая удалённую
+	cars map[int]bool
+	// deleted - id удалённой машины арендатора
+	deleted int
+}
+
+// seedTenant добавляет арендатору машины с одинаковыми у всех арендаторов номерами и владельцами,
+// чтобы фильтры совпадали с чужими строками. Одна машина изменяется и одна удаляется
+func seedTenant(t *testing.T, storage *postgresql.Storage, id string) *tenantData {
+	t.Helper()
+
+	ctx := tenant.WithTenant(context.Background(), id)
+	td := &tenantData{id: id, token: id + "-token-0123456789abcdef0123456789", cars: map[int]bool{}}
+
+	for _, c := range []*car.Car{
+		car.New("A001AA77", "Lada", "Vesta", null.Int16From(2015), "Ivan", "Ivanov", null.StringFrom("Ivanovich")),
+		car.New("B002BB77", "Kia", "Rio", null.Int16From(2018), "Petr", "Petrov", null.String{}),
+		car.New("C003CC77", "Lada", "Niva", null.Int16From(2010), "Ivan", "Sidorov", null.String{}),
+	} {
+		carID, err := storage.AddCar(ctx, *c, car.SourceManual)
+		if err != nil {
+			t.Fatalf("%s: failed to add car: %v", id, err)
+		}
+		td.cars[carID] = true
+		td.deleted = carID
+	}
+
+	// история изменений и события у каждой машины
+	for carID := range td.cars {
+		if _, err := storage.PatchCar(ctx, carID, car.PatchCar{Model: car.NewPatchField("Granta")}, 0); err != nil {
+			t.Fatalf("%s: failed to patch car: %v", id, err)
+		}
+	}
+
+	// удаляется последняя машина, остальные видны и без include_deleted
+	if _, err := storage.DeleteCar(ctx, td.deleted, 0); err != nil {
+		t.Fatalf("%s: failed to delete car: %v", id, err)
+	}
+	return td
+}
+
+func newTenantServer(t *testing.T, storage *postgresql.Storage, tenants ...*tenantData) *httptest.Server {
+	t.Helper()
+
+	authenticators := make([]auth.Authenticator, 0, len(tenants))
+	for _, td := range tenants {
+		authenticators = append(authenticators, auth.NewStatic(td.token, auth.Principal{
+			Subject: td.id,
+			// admin нужен для журнала изменений, привязанный клиент всё равно видит только своего арендатора
+			Scopes: []string{auth.ScopeAdmin},
+			Tenant: td.id,
+		}))
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := router.New(log, storage, carinfo.New("localhost"), events.NewHub(), router.Options{
+		DefaultSchema:  schema.V2,
+		IdempotencyTTL: time.Hour,
+		Authenticator:  auth.Chain(authenticators...),
+	})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, ctx context.Context, srv *httptest.Server, token, path string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+router.APIPrefix+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", token)
+	if strings.HasPrefix(path, "/cars/events") {
+		req.Header.Set("Last-Event-ID", "0")
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// carIDs читает id из ответа со списком в поле data
+func carIDs(t *testing.T, resp *http.Response, field string) []int {
+	t.Helper()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+	}
+	var body struct {
+		Data []map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0, len(body.Data))
+	for _, row := range body.Data {
+		ids = append(ids, int(row[field].(float64)))
+	}
+	return ids
+}
+
+func TestTenantIsolation(t *testing.T) {
+	storage := openTestStorage(t)
+	start := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	a := seedTenant(t, storage, "tenant-a")
+	b := seedTenant(t, storage, "tenant-b")
+	srv := newTenantServer(t, storage, a, b)
+
+	for _, pair := range [][2]*tenantData{{a, b}, {b, a}} {
+		own, other := pair[0], pair[1]
+
+		t.Run(own.id+" list", func(t *testing.T) {
+			for _, query := range []url.Values{
+				{},
+				{"reg_num": {"A001AA77"}},
+				{"mark": {"Lada"}},
+				{"name": {"Ivan"}},
+				{"surname": {"Petrov"}},
+				{"patronymic": {"Ivanovich"}},
+				{"year": {"2000:2030"}},
+				{"updated_since": {start}},
+				{"include_deleted": {"true"}},
+				{"include_deleted": {"true"}, "reg_num": {"A001AA77"}},
+			} {
+				ids := carIDs(t, get(t, context.Background(), srv, own.token, "/cars?"+query.Encode()), "id")
+				if len(ids) == 0 {
+					t.Errorf("GET /cars?%s: no cars, want own cars", query.Encode())
+				}
+				for _, id := range ids {
+					if !own.cars[id] {
+						t.Errorf("GET /cars?%s: got car %d of another tenant", query.Encode(), id)
+					}
+				}
+			}
+		})
+
+		t.Run(own.id+" by id", func(t *testing.T) {
+			for id := range other.cars {
+				for _, path := range []string{fmt.Sprintf("/cars/%d", id), fmt.Sprintf("/cars/%d?include_deleted=true", id)} {
+					resp := get(t, context.Background(), srv, own.token, path)
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusNotFound {
+						t.Errorf("GET %s: status = %d, want 404", path, resp.StatusCode)
+					}
+				}
+			}
+		})
+
+		t.Run(own.id+" history", func(t *testing.T) {
+			for id := range own.cars {
+				if ids := carIDs(t, get(t, context.Background(), srv, own.token, fmt.Sprintf("/cars/%d/history", id)), "carId"); len(ids) == 0 {
+					t.Errorf("GET /cars/%d/history: no records for own car", id)
+				}
+			}
+			for id := range other.cars {
+				if ids := carIDs(t, get(t, context.Background(), srv, own.token, fmt.Sprintf("/cars/%d/history", id)), "carId"); len(ids) > 0 {
+					t.Errorf("GET /cars/%d/history: got %d records of another tenant", id, len(ids))
+				}
+			}
+		})
+
+		t.Run(own.id+" events", func(t *testing.T) {
+			// поток не заканчивается сам, читаем события из журнала до таймаута
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			resp := get(t, ctx, srv, own.token, "/cars/events")
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET /cars/events: status = %d", resp.StatusCode)
+			}
+
+			var got int
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+				if !ok {
+					continue
+				}
+				var e events.Event
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					t.Fatal(err)
+				}
+				got++
+				if !own.cars[e.CarID] {
+					t.Errorf("GET /cars/events: got event %d of car %d of another tenant", e.ID, e.CarID)
+				}
+			}
+			if got == 0 {
+				t.Error("GET /cars/events: no events for own cars")
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Version - версия схемы JSON-ответов
+type Version int
+
+const (
+	// V1 - исходные ответы, сохраняются для существующих клиентов на время миграции
+	V1 Version = 1
+	// V2 - согласованная схема: camelCase, конверт data/meta/error, ошибки строками с кодами
+	V2 Version = 2
+)
+
+// Header - заголовок, которым клиент выбирает версию схемы.
+// Версия, по которой сформирован ответ, возвращается в том же заголовке
+const Header = "X-Schema-Version"
+
+type ctxKey struct{}
+
+// Parse разбирает номер версии схемы
+func Parse(s string) (Version, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q", s)
+	}
+
+	v := Version(n)
+	if v != V1 && v != V2 {
+		return 0, fmt.Errorf("unsupported schema version %d", n)
+	}
+	return v, nil
+}
+
+// Middleware определяет версию схемы по заголовку запроса.
+// Если заголовок не передан или некорректен, используется def.
+// При force заголовок запроса игнорируется и всегда используется def
+func Middleware(def Version, force bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			v := def
+			if h := r.Header.Get(Header); h != "" && !force {
+				if parsed, err := Parse(h); err == nil {
+					v = parsed
+				}
+			}
+
+			w.Header().Set(Header, strconv.Itoa(int(v)))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, v)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// FromContext возвращает версию схемы запроса, по умолчанию V1
+func FromContext(ctx context.Context) Version {
+	if v, ok := ctx.Value(ctxKey{}).(Version); ok {
+		return v
+	}
+	return V1
+}
+
+// Envelope - конверт ответа схемы V2
+type Envelope struct {
+	Data any `json:"data"`
+	Meta any `json:"meta,omitempty"`
+}
@@ -0,0 +1,23 @@
+package actor
+
+import "context"
+
+const (
+	// Anonymous - исполнитель запроса, если он не известен
+	Anonymous = "anonymous"
+)
+
+type ctxKey struct{}
+
+// WithActor сохраняет в контексте, кто выполняет запрос
+func WithActor(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, name)
+}
+
+// FromContext возвращает исполнителя запроса, по умолчанию Anonymous
+func FromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(ctxKey{}).(string); ok && name != "" {
+		return name
+	}
+	return Anonymous
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/P1coFly/CarInfoEM/internal/models/apikey"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+)
+
+// Права доступа
+const (
+	ScopeCarsRead   = "cars:read"
+	ScopeCarsWrite  = "cars:write"
+	ScopeCarsDelete = "cars:delete"
+	// ScopeOwnersRead - имена владельцев без маскирования, без него имя и отчество сокращаются до инициалов
+	ScopeOwnersRead = "owners:read"
+	// ScopeAdmin включает все остальные права и управление ключами и вебхуками
+	ScopeAdmin = "admin"
+)
+
+// Scopes - все права доступа
+var Scopes = []string{ScopeCarsRead, ScopeCarsWrite, ScopeCarsDelete, ScopeOwnersRead, ScopeAdmin}
+
+var (
+	// ErrUnauthenticated - учётные данные переданы, но неверны
+	ErrUnauthenticated = errors.New("invalid credentials")
+	// ErrUnsupported - аутентификатор не понимает такой формат токена
+	ErrUnsupported = errors.New("unsupported credentials")
+	// ErrInvalidTenant - запрошен арендатор с некорректным идентификатором
+	ErrInvalidTenant = errors.New("invalid tenant id")
+	// ErrTenantForbidden - клиенту нельзя работать с запрошенным арендатором
+	ErrTenantForbidden = errors.New("tenant not allowed")
+)
+
+// Principal - тот, от чьего имени выполняется запрос
+type Principal struct {
+	// Subject - имя для журнала изменений, например apikey:billing
+	Subject string
+	Scopes  []string
+	// Tenant - арендатор, к которому привязан клиент. Пустой - не привязан:
+	// такой клиент работает с арендатором по умолчанию, а с правом ScopeAdmin может выбрать любого
+	Tenant string
+}
+
+// HasScope сообщает, есть ли право scope, ScopeAdmin включает все права
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, ScopeAdmin) || slices.Contains(p.Scopes, scope)
+}
+
+// ResolveTenant выбирает арендатора запроса. requested - арендатор, явно указанный клиентом, пустой - не указан.
+// Привязанный клиент работает только со своим арендатором, другого может выбрать
+// только не привязанный клиент с правом ScopeAdmin
+func (p Principal) ResolveTenant(requested string) (string, error) {
+	own := p.Tenant
+	if own == "" {
+		own = tenant.Default
+	}
+	if requested == "" || requested == own {
+		return own, nil
+	}
+	if !tenant.Valid(requested) {
+		return "", ErrInvalidTenant
+	}
+	if p.Tenant == "" && p.HasScope(ScopeAdmin) {
+		return requested, nil
+	}
+	return "", ErrTenantForbidden
+}
+
+type ctxKey struct{}
+
+// WithPrincipal сохраняет в контексте аутентифицированного клиента
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+// FromContext возвращает аутентифицированного клиента, false - запрос без учётных данных
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(ctxKey{}).(Principal)
+	return p, ok
+}
+
+// ShowOwners сообщает, можно ли отдать клиенту запроса имена владельцев без маскирования
+func ShowOwners(ctx context.Context) bool {
+	p, ok := FromContext(ctx)
+	return ok && p.HasScope(ScopeOwnersRead)
+}
+
+// Authenticator проверяет токен из запроса.
+// Если формат токена ему не подходит, возвращает ErrUnsupported
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (Principal, error)
+}
+
+// Chain пробует аутентификаторы по очереди, пока один из них не примет формат токена
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+type chain []Authenticator
+
+func (c chain) Authenticate(ctx context.Context, token string) (Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(ctx, token)
+		if errors.Is(err, ErrUnsupported) {
+			continue
+		}
+		return p, err
+	}
+	return Principal{}, ErrUnauthenticated
+}
+
+// KeyStore - хранилище ключей API
+type KeyStore interface {
+	// FindAPIKey возвращает ключ и его хеш по префиксу
+	FindAPIKey(ctx context.Context, prefix string) (apikey.Key, string, error)
+}
+
+// APIKeys проверяет ключи API, созданные через API
+type APIKeys struct {
+	store KeyStore
+}
+
+func NewAPIKeys(store KeyStore) *APIKeys {
+	return &APIKeys{store: store}
+}
+
+func (a *APIKeys) Authenticate(ctx context.Context, token string) (Principal, error) {
+	const op = "auth.APIKeys.Authenticate"
+
+	prefix, ok := apikey.Parse(token)
+	if !ok {
+		return Principal{}, ErrUnsupported
+	}
+
+	key, hash, err := a.store.FindAPIKey(ctx, prefix)
+	if err != nil {
+		if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			return Principal{}, ErrUnauthenticated
+		}
+		return Principal{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if key.RevokedAt != nil || subtle.ConstantTimeCompare([]byte(apikey.Hash(token)), []byte(hash)) != 1 {
+		return Principal{}, ErrUnauthenticated
+	}
+
+	return Principal{Subject: "apikey:" + key.Name, Scopes: key.Scopes, Tenant: key.TenantID}, nil
+}
+
+// MinStaticTokenLength - минимальная длина токена Static, короткий ключ легко подобрать
+const MinStaticTokenLength = 32
+
+// Static принимает один заданный в конфигурации токен, например ключ администратора
+// для создания первых ключей API
+type Static struct {
+	token     string
+	principal Principal
+}
+
+func NewStatic(token string, principal Principal) *Static {
+	return &Static{token: token, principal: principal}
+}
+
+func (s *Static) Authenticate(ctx context.Context, token string) (Principal, error) {
+	if s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return Principal{}, ErrUnsupported
+	}
+	return s.principal, nil
+}
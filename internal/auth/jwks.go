@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrKeyNotFound - в JWKS нет ключа, которым подписан токен
+var ErrKeyNotFound = errors.New("signing key not found")
+
+const (
+	// ключи перечитываются не реже jwksTTL
+	jwksTTL = time.Hour
+	// и не чаще jwksMinRefresh, даже если пришёл токен с неизвестным kid
+	jwksMinRefresh = time.Minute
+)
+
+// JWKS - набор открытых ключей для проверки подписи токенов.
+// Ключи загружаются из файла или по URL и перечитываются, когда устаревают
+// или приходит токен, подписанный новым ключом
+type JWKS struct {
+	source string
+	client *http.Client
+	// одновременные запросы с неизвестным kid перечитывают ключи одной загрузкой
+	group singleflight.Group
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWKS создаёт набор ключей, source - путь к файлу или http(s) URL
+func NewJWKS(source string) *JWKS {
+	return &JWKS{source: source, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Load загружает ключи, чтобы ошибка в конфигурации обнаружилась при запуске
+func (j *JWKS) Load(ctx context.Context) error {
+	return j.refresh(ctx)
+}
+
+// Key возвращает ключ по kid. Пустой kid подходит, если ключ в наборе один
+func (j *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	const op = "auth.JWKS.Key"
+
+	j.mu.RLock()
+	key, ok := j.lookup(kid)
+	sinceFetch := time.Since(j.fetchedAt)
+	j.mu.RUnlock()
+
+	stale := sinceFetch > jwksTTL
+	if ok && !stale {
+		return key, nil
+	}
+	if !stale && sinceFetch < jwksMinRefresh {
+		return nil, ErrKeyNotFound
+	}
+
+	if err := j.refresh(ctx); err != nil {
+		// пока источник недоступен, проверяем старыми ключами
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	j.mu.RLock()
+	key, ok = j.lookup(kid)
+	j.mu.RUnlock()
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// lookup вызывается под j.mu
+func (j *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// refresh перечитывает ключи. Загрузка идёт без блокировки, чтобы медленный источник
+// не останавливал проверку токенов известными ключами, j.mu берётся только для замены набора
+func (j *JWKS) refresh(ctx context.Context) error {
+	const op = "auth.JWKS.refresh"
+
+	_, err, _ := j.group.Do("refresh", func() (any, error) {
+		// результат достаётся всем ожидающим, поэтому отмена запроса первого из них
+		// не должна прерывать загрузку, время ограничено таймаутом клиента
+		keys, err := j.fetch(context.WithoutCancel(ctx))
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		// время неудачной попытки тоже запоминаем, чтобы не обращаться к источнику на каждый запрос
+		j.fetchedAt = time.Now()
+		if err != nil {
+			return nil, err
+		}
+		j.keys = keys
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (j *JWKS) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	data, err := j.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+func (j *JWKS) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return os.ReadFile(j.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS разбирает набор ключей в формате RFC 7517.
+// Ключи шифрования и неподдерживаемых типов пропускаются
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey возвращает nil для неподдерживаемого типа ключа
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Роли из токенов корпоративного шлюза
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+// RoleScopes - права, которые даёт роль
+var RoleScopes = map[string][]string{
+	RoleViewer: {ScopeCarsRead},
+	RoleEditor: {ScopeCarsRead, ScopeCarsWrite, ScopeCarsDelete, ScopeOwnersRead},
+	RoleAdmin:  {ScopeAdmin},
+}
+
+// Claims с ролями и арендатором по умолчанию
+const (
+	DefaultRolesClaim  = "roles"
+	DefaultTenantClaim = "tenant"
+)
+
+// JWTOptions - требования к токенам
+type JWTOptions struct {
+	// Issuer - ожидаемый iss, пустой - не проверяется
+	Issuer string
+	// Audience - ожидаемый aud, пустой - не проверяется
+	Audience string
+	// RolesClaim - путь к claim с ролями через точку, например realm_access.roles.
+	// Значение - строка или массив строк
+	RolesClaim string
+	// TenantClaim - путь к claim с арендатором через точку.
+	// Токен без арендатора работает с арендатором по умолчанию
+	TenantClaim string
+}
+
+// JWT проверяет подписанные токены шлюза по ключам из JWKS
+type JWT struct {
+	keys        *JWKS
+	parser      *jwt.Parser
+	rolesClaim  []string
+	tenantClaim []string
+}
+
+func NewJWT(keys *JWKS, opts JWTOptions) *JWT {
+	parserOpts := []jwt.ParserOption{
+		// алгоритмы с открытым ключом, HS256 с ключом из JWKS не принимаем
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+
+	rolesClaim := opts.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = DefaultRolesClaim
+	}
+	tenantClaim := opts.TenantClaim
+	if tenantClaim == "" {
+		tenantClaim = DefaultTenantClaim
+	}
+
+	return &JWT{keys: keys, parser: jwt.NewParser(parserOpts...),
+		rolesClaim: strings.Split(rolesClaim, "."), tenantClaim: strings.Split(tenantClaim, ".")}
+}
+
+func (a *JWT) Authenticate(ctx context.Context, token string) (Principal, error) {
+	const op = "auth.JWT.Authenticate"
+
+	// JWT состоит из трёх частей через точку, остальные токены не наши
+	if strings.Count(token, ".") != 2 {
+		return Principal{}, ErrUnsupported
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.Key(ctx, kid)
+	})
+	if err != nil {
+		// недоступный JWKS - ошибка сервиса, а не клиента
+		if errors.Is(err, jwt.ErrTokenUnverifiable) && !errors.Is(err, ErrKeyNotFound) {
+			return Principal{}, fmt.Errorf("%s: %w", op, err)
+		}
+		return Principal{}, ErrUnauthenticated
+	}
+
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return Principal{}, ErrUnauthenticated
+	}
+
+	var scopes []string
+	for _, role := range a.roles(claims) {
+		scopes = append(scopes, RoleScopes[role]...)
+	}
+
+	// арендатора задаёт шлюз, токен с некорректным арендатором не принимаем
+	tenantID, _ := claimValue(claims, a.tenantClaim).(string)
+	if tenantID != "" && !tenant.Valid(tenantID) {
+		return Principal{}, ErrUnauthenticated
+	}
+
+	return Principal{Subject: sub, Scopes: scopes, Tenant: tenantID}, nil
+}
+
+// claimValue достаёт значение claim по пути, nil - claim нет
+func claimValue(claims jwt.MapClaims, path []string) any {
+	var v any = map[string]any(claims)
+	for _, name := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+// roles достаёт роли из claim, неизвестные роли не дают прав
+func (a *JWT) roles(claims jwt.MapClaims) []string {
+	switch v := claimValue(claims, a.rolesClaim).(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		roles := make([]string, 0, len(v))
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+		return roles
+	}
+	return nil
+}
@@ -1,23 +1,59 @@
 package config
 
 import (
+	"log/slog"
 	"os"
+	"strings"
 )
 
 type config struct {
-	Env            string
-	HostDB         string
-	PortDB         string
-	UserDB         string
-	PasswordDB     string
-	NameDB         string
-	HostCarInfo    string
-	MigrationsPath string
+	Env                 string
+	HostDB              string
+	PortDB              string
+	UserDB              string
+	PasswordDB          string
+	NameDB              string
+	HostCarInfo         string
+	MigrationsPath      string
+	SchemaVersion       string
+	IdempotencyTTL      string
+	SoftDeleteRetention string
+	PurgeInterval       string
+	CarInfoMaxAge       string
+	ResyncInterval      string
+	// AdminAPIKey - служебный ключ с правом admin, нужен для выпуска первых API ключей
+	AdminAPIKey string
+	JWT
+	RateLimit
 	Server
 }
 
+// JWT - проверка токенов корпоративного шлюза
+type JWT struct {
+	// JWKS - путь к файлу или URL с ключами, пустой - токены шлюза не принимаются
+	JWKS       string
+	Issuer     string
+	Audience   string
+	RolesClaim string
+	// TenantClaim - claim с арендатором клиента
+	TenantClaim string
+}
+
+// RateLimit - лимиты запросов клиентов вида 100/1m
+type RateLimit struct {
+	Read    string
+	Write   string
+	CarInfo string
+	// IP - все запросы с одного адреса, считаются до проверки токена
+	IP string
+	// Store - где хранятся корзины: memory или postgres
+	Store string
+}
+
 type Server struct {
 	Port string
+	// GRPCPort - адрес gRPC API, пустой - gRPC API не запускается
+	GRPCPort string
 }
 
 func MustLoad() *config {
@@ -25,5 +61,61 @@ func MustLoad() *config {
 	return &config{Env: os.Getenv("ENV"), HostDB: os.Getenv("HOST_DB"), PortDB: os.Getenv("PORT_DB"),
 		UserDB: os.Getenv("USER_DB"), PasswordDB: os.Getenv("PASSWORD_DB"), NameDB: os.Getenv("NAME_DB"),
 		HostCarInfo: os.Getenv("HOST_CARINFO"), MigrationsPath: os.Getenv("MIGRATIONS_PATH"),
-		Server: Server{Port: os.Getenv("PORT")}}
+		SchemaVersion: os.Getenv("SCHEMA_VERSION"), IdempotencyTTL: os.Getenv("IDEMPOTENCY_TTL"),
+		SoftDeleteRetention: os.Getenv("SOFT_DELETE_RETENTION"), PurgeInterval: os.Getenv("PURGE_INTERVAL"),
+		CarInfoMaxAge: os.Getenv("CARINFO_MAX_AGE"), ResyncInterval: os.Getenv("RESYNC_INTERVAL"),
+		AdminAPIKey: os.Getenv("ADMIN_API_KEY"),
+		JWT: JWT{JWKS: os.Getenv("JWT_JWKS"), Issuer: os.Getenv("JWT_ISSUER"),
+			Audience: os.Getenv("JWT_AUDIENCE"), RolesClaim: os.Getenv("JWT_ROLES_CLAIM"),
+			TenantClaim: os.Getenv("JWT_TENANT_CLAIM")},
+		RateLimit: RateLimit{Read: os.Getenv("RATE_LIMIT_READ"), Write: os.Getenv("RATE_LIMIT_WRITE"),
+			CarInfo: os.Getenv("RATE_LIMIT_CARINFO"), IP: os.Getenv("RATE_LIMIT_IP"), Store: os.Getenv("RATE_LIMIT_STORE")},
+		Server: Server{Port: os.Getenv("PORT"), GRPCPort: os.Getenv("GRPC_PORT")}}
+}
+
+// LogValue пишет конфиг в лог без секретов: пароль БД и ключ администратора заменяются пометкой
+func (c config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("env", c.Env),
+		slog.String("hostDB", c.HostDB),
+		slog.String("portDB", c.PortDB),
+		slog.String("userDB", c.UserDB),
+		slog.String("passwordDB", redact(c.PasswordDB)),
+		slog.String("nameDB", c.NameDB),
+		slog.String("hostCarInfo", c.HostCarInfo),
+		slog.String("migrationsPath", c.MigrationsPath),
+		slog.String("schemaVersion", c.SchemaVersion),
+		slog.String("idempotencyTTL", c.IdempotencyTTL),
+		slog.String("softDeleteRetention", c.SoftDeleteRetention),
+		slog.String("purgeInterval", c.PurgeInterval),
+		slog.String("carInfoMaxAge", c.CarInfoMaxAge),
+		slog.String("resyncInterval", c.ResyncInterval),
+		slog.String("adminAPIKey", redact(c.AdminAPIKey)),
+		slog.Any("jwt", c.JWT),
+		slog.Any("rateLimit", c.RateLimit),
+		slog.Any("server", c.Server),
+	)
+}
+
+// LogValue пишет JWKS только если это путь к файлу, в URL может быть токен доступа
+func (j JWT) LogValue() slog.Value {
+	jwks := j.JWKS
+	if strings.Contains(jwks, "://") {
+		jwks = redact(jwks)
+	}
+	return slog.GroupValue(
+		slog.String("jwks", jwks),
+		slog.String("issuer", j.Issuer),
+		slog.String("audience", j.Audience),
+		slog.String("rolesClaim", j.RolesClaim),
+		slog.String("tenantClaim", j.TenantClaim),
+	)
+}
+
+// redact скрывает значение секрета, по пустой строке видно, что секрет не задан
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "[REDACTED]"
 }
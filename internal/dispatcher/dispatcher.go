@@ -0,0 +1,136 @@
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/models/webhook"
+)
+
+const (
+	// MaxAttempts - после стольких неудачных попыток доставка считается проваленной
+	MaxAttempts = 10
+	// сколько доставок берётся в работу за раз
+	batchSize = 50
+	// время на отправку взятых доставок, после него их может взять другой экземпляр
+	lease = 2 * time.Minute
+	// таймаут запроса к подписчику
+	requestTimeout = 10 * time.Second
+	// задержка перед второй попыткой, дальше она удваивается
+	baseBackoff = 10 * time.Second
+	maxBackoff  = 6 * time.Hour
+)
+
+type Store interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhook.Task, error)
+	CompleteWebhookDelivery(ctx context.Context, id int64, statusCode int) error
+	FailWebhookDelivery(ctx context.Context, id int64, statusCode int, lastError string, nextAttemptAt time.Time) error
+}
+
+// Run раз в interval отправляет подписчикам накопившиеся события.
+// Работает до отмены ctx
+func Run(ctx context.Context, log *slog.Logger, store Store, interval time.Duration) {
+	const op = "dispatcher.Run"
+
+	log = log.With(slog.String("op", op))
+	client := &http.Client{Timeout: requestTimeout}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for ctx.Err() == nil {
+			tasks, err := store.ClaimWebhookDeliveries(ctx, batchSize, lease)
+			if err != nil {
+				log.Error("failed to claim webhook deliveries", "error", err)
+				break
+			}
+
+			for _, t := range tasks {
+				deliver(ctx, log, store, client, t)
+			}
+
+			if len(tasks) < batchSize {
+				break
+			}
+		}
+	}
+}
+
+// отправляем одну доставку и сохраняем результат
+func deliver(ctx context.Context, log *slog.Logger, store Store, client *http.Client, t webhook.Task) {
+	log = log.With(slog.Int64("delivery_id", t.ID), slog.Int64("webhook_id", t.WebhookID))
+
+	statusCode, err := send(ctx, client, t)
+	if err == nil {
+		if err := store.CompleteWebhookDelivery(ctx, t.ID, statusCode); err != nil {
+			log.Error("failed to save webhook delivery", "error", err)
+		}
+		log.Debug("webhook delivered")
+		return
+	}
+
+	attempts := t.Attempts + 1
+	var next time.Time
+	if attempts < MaxAttempts {
+		next = time.Now().Add(Backoff(attempts))
+	}
+	log.Info("webhook delivery failed", slog.Int("attempts", attempts), "error", err)
+
+	if err := store.FailWebhookDelivery(ctx, t.ID, statusCode, err.Error(), next); err != nil {
+		log.Error("failed to save webhook delivery", "error", err)
+	}
+}
+
+// отправляем событие подписчику, успехом считается ответ 2xx
+func send(ctx context.Context, client *http.Client, t webhook.Task) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(t.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.HeaderEvent, t.EventType)
+	req.Header.Set(webhook.HeaderDelivery, strconv.FormatInt(t.ID, 10))
+	req.Header.Set(webhook.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhook.HeaderSignature, webhook.Sign(t.Secret, timestamp, t.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Backoff возвращает задержку после attempts неудачных попыток:
+// экспоненциальный рост от baseBackoff до maxBackoff со случайным разбросом до 20%
+func Backoff(attempts int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
@@ -0,0 +1,123 @@
+package events
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/models/audit"
+)
+
+// Типы событий ленты изменений
+const (
+	TypeCreated = "created"
+	TypeUpdated = "updated"
+	TypeDeleted = "deleted"
+)
+
+// Event - событие ленты изменений машины
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type" example:"updated"`
+	CarID     int             `json:"carId"`
+	Car       json.RawMessage `json:"car" swaggertype:"object"`
+	CreatedAt time.Time       `json:"createdAt"`
+	// TenantID - арендатор машины, события получают только подписчики этого арендатора
+	TenantID string `json:"-"`
+}
+
+// TypeForAction возвращает тип события для действия из журнала изменений.
+// Пустая строка означает, что событие не отправляется
+func TypeForAction(action string) string {
+	switch action {
+	case audit.ActionCreate:
+		return TypeCreated
+	case audit.ActionUpdate, audit.ActionReplace, audit.ActionRefresh, audit.ActionRestore:
+		return TypeUpdated
+	case audit.ActionDelete:
+		return TypeDeleted
+	}
+	// окончательная очистка уже удалённой машины подписчикам не интересна
+	return ""
+}
+
+// Filter - условия подписки, пустые поля не учитываются. Сравнение без учёта регистра
+type Filter struct {
+	// TenantID - арендатор подписчика, сравнивается точно
+	TenantID string
+	Mark     string
+	Name     string
+	Surname  string
+}
+
+// Match сообщает, подходит ли событие под фильтр
+func (f Filter) Match(e Event) bool {
+	if f.TenantID != "" && f.TenantID != e.TenantID {
+		return false
+	}
+	if f.Mark == "" && f.Name == "" && f.Surname == "" {
+		return true
+	}
+
+	var c struct {
+		Mark  string `json:"mark"`
+		Owner struct {
+			Name    string `json:"name"`
+			Surname string `json:"surname"`
+		} `json:"owner"`
+	}
+	if err := json.Unmarshal(e.Car, &c); err != nil {
+		return false
+	}
+	return match(f.Mark, c.Mark) && match(f.Name, c.Owner.Name) && match(f.Surname, c.Owner.Surname)
+}
+
+func match(want, got string) bool {
+	return want == "" || strings.EqualFold(want, got)
+}
+
+// Hub рассылает события подписчикам внутри процесса
+type Hub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe возвращает канал новых событий, buffer - его размер.
+// Канал закрывается, если подписчик не успевает читать, или после Unsubscribe
+func (h *Hub) Subscribe(buffer int) chan Event {
+	ch := make(chan Event, buffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe отписывает и закрывает канал
+func (h *Hub) Unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Publish отправляет событие всем подписчикам, не блокируясь на медленных
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// подписчик отстал, он переподключится с Last-Event-ID и дочитает из журнала
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
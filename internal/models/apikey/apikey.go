@@ -0,0 +1,62 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Key - ключ API. Сам ключ не хранится, только его хеш
+type Key struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name" example:"billing"`
+	// Prefix - открытая часть ключа, по ней ключ находится в БД и узнаётся в списке
+	Prefix string   `json:"prefix" example:"3f9a1c2b"`
+	Scopes []string `json:"scopes" example:"cars:read,cars:write"`
+	// TenantID - арендатор, к данным которого ключ даёт доступ, совпадает с арендатором запроса на создание
+	TenantID   string     `json:"tenant" example:"default"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// keyTag - начало каждого ключа, по нему ключ API отличается от других токенов
+const keyTag = "cie_"
+
+// Generate создаёт ключ вида cie_<prefix>_<secret> и возвращает его вместе с префиксом и хешем
+func Generate() (plain, prefix, hash string, err error) {
+	p := make([]byte, 4)
+	if _, err := rand.Read(p); err != nil {
+		return "", "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+
+	prefix = hex.EncodeToString(p)
+	plain = keyTag + prefix + "_" + hex.EncodeToString(secret)
+	return plain, prefix, Hash(plain), nil
+}
+
+// Parse возвращает префикс ключа, false - строка не похожа на ключ API
+func Parse(plain string) (string, bool) {
+	rest, ok := strings.CutPrefix(plain, keyTag)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" || secret == "" {
+		return "", false
+	}
+	return prefix, true
+}
+
+// Hash возвращает хеш ключа для хранения и сравнения.
+// Ключ случайный и длинный, поэтому медленный хеш не нужен
+func Hash(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
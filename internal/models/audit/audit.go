@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// Действия над машиной
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionReplace = "replace"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionRefresh = "refresh"
+	ActionPurge   = "purge"
+)
+
+// Record - запись журнала изменений
+type Record struct {
+	ID        int64             `json:"id"`
+	CarID     int               `json:"carId"`
+	Action    string            `json:"action" example:"update"`
+	Actor     string            `json:"actor" example:"anonymous"`
+	RequestID string            `json:"requestId"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Before    json.RawMessage   `json:"before" swaggertype:"object"`
+	After     json.RawMessage   `json:"after" swaggertype:"object"`
+	Diff      map[string]Change `json:"diff"`
+}
+
+// Change - изменение одного поля, путь к полю - ключ в Record.Diff
+type Change struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// Filter - условия выборки журнала, пустые поля не учитываются
+type Filter struct {
+	CarID int
+	Actor string
+	Since time.Time
+}
+
+// Diff сравнивает два JSON-документа и возвращает изменившиеся поля.
+// Вложенные объекты раскрываются в пути вида owner.name, nil означает отсутствие документа
+func Diff(before, after []byte) (map[string]Change, error) {
+	from, err := flatten(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := flatten(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := make(map[string]Change)
+	for path, v := range from {
+		if w, ok := to[path]; !ok || !reflect.DeepEqual(v, w) {
+			diff[path] = Change{From: v, To: to[path]}
+		}
+	}
+	for path, w := range to {
+		if _, ok := from[path]; !ok {
+			diff[path] = Change{From: nil, To: w}
+		}
+	}
+	return diff, nil
+}
+
+func flatten(doc []byte) (map[string]any, error) {
+	res := make(map[string]any)
+	if doc == nil {
+		return res, nil
+	}
+
+	var m map[string]any
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return nil, err
+	}
+	flattenInto(res, "", m)
+	return res, nil
+}
+
+func flattenInto(res map[string]any, prefix string, m map[string]any) {
+	for k, v := range m {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]any); ok {
+			flattenInto(res, path, nested)
+			continue
+		}
+		res[path] = v
+	}
+}
@@ -1,42 +1,133 @@
 package car
 
-import "github.com/guregu/null/v5"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guregu/null/v5"
+)
 
 type Car struct {
-	RegNum string     `json:"regNum" required:"true" example:"X123XX150"`
-	Mark   string     `json:"mark" required:"true" example:"Lada"`
-	Model  string     `json:"model" required:"true" example:"Vesta"`
-	Year   null.Int16 `json:"year" swaggertype:"integer" example:"2001"`
-	Owner  People
+	RegNum string     `json:"regNum" required:"true" example:"X123XX150" validate:"required,regnum"`
+	Mark   string     `json:"mark" required:"true" example:"Lada" validate:"required,max=64"`
+	Model  string     `json:"model" required:"true" example:"Vesta" validate:"required,max=64"`
+	Year   null.Int16 `json:"year" swaggertype:"integer" example:"2001" validate:"omitnil,caryear"`
+	Owner  People     `json:"owner"`
 }
 
 type People struct {
-	Name       string      `json:"name" required:"true" example:"Ivan"`
-	Surname    string      `json:"surname" required:"true" example:"Ivanov"`
-	Patronymic null.String `json:"patronymic" swaggertype:"string" example:"Ivanovich"`
+	Name       string      `json:"name" required:"true" example:"Ivan" validate:"required,max=100"`
+	Surname    string      `json:"surname" required:"true" example:"Ivanov" validate:"required,max=100"`
+	Patronymic null.String `json:"patronymic" swaggertype:"string" example:"Ivanovich" validate:"omitnil,max=100"`
 }
 
+// Источники данных машины и владельца
+const (
+	SourceCarInfo = "carinfo"
+	SourceManual  = "manual"
+	SourceImport  = "import"
+)
+
 type CarWithOwner struct {
 	Id     int        `json:"id" required:"true"`
 	RegNum string     `json:"regNum" required:"true"`
 	Mark   string     `json:"mark" required:"true"`
 	Model  string     `json:"model" required:"true"`
 	Year   null.Int16 `json:"year" swaggertype:"integer"`
-	People `json:"owner"`
+	// Source - откуда получены текущие данные машины: carinfo, manual или import
+	Source string `json:"source" example:"carinfo"`
+	// CarInfoFetchedAt - когда данные последний раз получены из CarInfo
+	CarInfoFetchedAt *time.Time `json:"carinfoFetchedAt"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	UpdatedAt        time.Time  `json:"updatedAt"`
+	Owner            `json:"owner"`
+	// DeletedAt - время удаления, заполнено только у удалённых машин
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// Version - версия записи для оптимистичной блокировки, отдаётся в ETag
+	Version int `json:"-"`
+	// TenantID - арендатор машины, клиентам не отдаётся
+	TenantID string `json:"-"`
+}
+
+// Owner - владелец машины вместе со служебными полями
+type Owner struct {
+	People
+	Source    string    `json:"source" example:"carinfo"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// PatchField - поле патча, различающее отсутствие поля и явный null
+type PatchField[T any] struct {
+	// Set - поле передано в запросе
+	Set bool
+	// Null - поле передано со значением null
+	Null  bool
+	Value T
+}
+
+// NewPatchField возвращает поле патча с переданным значением
+func NewPatchField[T any](v T) PatchField[T] {
+	return PatchField[T]{Set: true, Value: v}
+}
+
+// UnmarshalJSON вызывается только для присутствующих в JSON полей
+func (f *PatchField[T]) UnmarshalJSON(data []byte) error {
+	f.Set = true
+	if string(data) == "null" {
+		f.Null = true
+		return nil
+	}
+	return json.Unmarshal(data, &f.Value)
+}
+
+func (f PatchField[T]) MarshalJSON() ([]byte, error) {
+	if !f.Set || f.Null {
+		return []byte("null"), nil
+	}
+	return json.Marshal(f.Value)
+}
+
+// IsNull сообщает, передан ли явный null
+func (f PatchField[T]) IsNull() bool {
+	return f.Set && f.Null
 }
 
+// ValuePtr возвращает указатель на значение или nil, если значения нет
+func (f PatchField[T]) ValuePtr() any {
+	if !f.Set || f.Null {
+		return (*T)(nil)
+	}
+	return &f.Value
+}
+
+// SQLValue возвращает значение для запроса, null передаётся как NULL
+func (f PatchField[T]) SQLValue() any {
+	if f.Null {
+		return nil
+	}
+	return f.Value
+}
+
+// Поля патча необязательны, но переданное значение должно быть корректным.
+// null допустим только для полей, которые могут быть пустыми в БД
 type PatchPeople struct {
-	Name       null.String `json:"name,omitempty"`
-	Surname    null.String `json:"surname,omitempty"`
-	Patronymic null.String `json:"patronymic,omitempty"`
+	Name       PatchField[string] `json:"name" swaggertype:"string" validate:"notnull,omitnil,min=1,max=100"`
+	Surname    PatchField[string] `json:"surname" swaggertype:"string" validate:"notnull,omitnil,min=1,max=100"`
+	Patronymic PatchField[string] `json:"patronymic" swaggertype:"string" validate:"omitnil,max=100"`
 }
 
 type PatchCar struct {
-	RegNum      null.String `json:"reg_num,omitempty"`
-	Mark        null.String `json:"mark,omitempty"`
-	Model       null.String `json:"model,omitempty"`
-	Year        null.Int16  `json:"year,omitempty"`
-	PatchPeople `json:"owner,omitempty"`
+	RegNum      PatchField[string] `json:"regNum" swaggertype:"string" validate:"notnull,omitnil,regnum"`
+	Mark        PatchField[string] `json:"mark" swaggertype:"string" validate:"notnull,omitnil,min=1,max=64"`
+	Model       PatchField[string] `json:"model" swaggertype:"string" validate:"notnull,omitnil,min=1,max=64"`
+	Year        PatchField[int16]  `json:"year" swaggertype:"integer" validate:"omitnil,caryear"`
+	PatchPeople `json:"owner"`
 }
 
 type CarFilter struct {
@@ -47,9 +138,248 @@ type CarFilter struct {
 	NameFilter       string
 	SurnameFilter    string
 	PatronymicFilter string
+	// UpdatedSince - только машины, изменённые не раньше этого времени
+	UpdatedSince time.Time
+	// IncludeDeleted - показывать удалённые машины
+	IncludeDeleted bool
+	// Sort - порядок выборки, при равенстве и по умолчанию машины упорядочены по id
+	Sort []SortField
+}
+
+// SortField - поле сортировки списка машин
+type SortField struct {
+	Field string
+	Desc  bool
 }
 
 func New(regNum, mark, model string, year null.Int16, name, surname string, patronymic null.String) *Car {
 	return &Car{RegNum: regNum, Mark: mark, Model: model, Year: year,
 		Owner: People{Name: name, Surname: surname, Patronymic: patronymic}}
 }
+
+// Поля, которые можно запросить через параметр fields (?fields=id,regNum,owner.surname)
+const (
+	FieldID         = "id"
+	FieldRegNum     = "regNum"
+	FieldMark       = "mark"
+	FieldModel      = "model"
+	FieldYear       = "year"
+	FieldName       = "owner.name"
+	FieldSurname    = "owner.surname"
+	FieldPatronymic = "owner.patronymic"
+
+	FieldSource           = "source"
+	FieldCarInfoFetchedAt = "carinfoFetchedAt"
+	FieldCreatedAt        = "createdAt"
+	FieldUpdatedAt        = "updatedAt"
+	FieldOwnerSource      = "owner.source"
+	FieldOwnerCreatedAt   = "owner.createdAt"
+	FieldOwnerUpdatedAt   = "owner.updatedAt"
+
+	// fieldOwner раскрывается во все поля владельца
+	fieldOwner = "owner"
+)
+
+// Fields - все поля в порядке их вывода
+var Fields = []string{FieldID, FieldRegNum, FieldMark, FieldModel, FieldYear,
+	FieldSource, FieldCarInfoFetchedAt, FieldCreatedAt, FieldUpdatedAt,
+	FieldName, FieldSurname, FieldPatronymic, FieldOwnerSource, FieldOwnerCreatedAt, FieldOwnerUpdatedAt}
+
+// ReadOnlyFields - поля, которые заполняет сервис и нельзя изменить патчем
+var ReadOnlyFields = []string{FieldID, FieldSource, FieldCarInfoFetchedAt, FieldCreatedAt, FieldUpdatedAt,
+	FieldOwnerSource, FieldOwnerCreatedAt, FieldOwnerUpdatedAt}
+
+// SortableFields - поля, по которым можно сортировать список машин
+var SortableFields = []string{FieldID, FieldRegNum, FieldMark, FieldModel, FieldYear,
+	FieldCreatedAt, FieldUpdatedAt, FieldName, FieldSurname}
+
+// ParseFields разбирает значение параметра fields.
+// Пустая строка означает все поля и возвращает nil
+func ParseFields(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	requested := make(map[string]bool)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == fieldOwner {
+			for _, of := range Fields {
+				if strings.HasPrefix(of, fieldOwner+".") {
+					requested[of] = true
+				}
+			}
+			continue
+		}
+		if !slices.Contains(Fields, f) {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		requested[f] = true
+	}
+
+	// сохраняем порядок из Fields, чтобы выборка не зависела от порядка в запросе
+	var fields []string
+	for _, f := range Fields {
+		if requested[f] {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// HasOwnerFields сообщает, запрошено ли хотя бы одно поле владельца
+func HasOwnerFields(fields []string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+	for _, f := range fields {
+		if strings.HasPrefix(f, fieldOwner+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// HasOwnerFilter сообщает, есть ли в фильтре условия по владельцу
+func (f CarFilter) HasOwnerFilter() bool {
+	return f.NameFilter != "" || f.SurnameFilter != "" || f.PatronymicFilter != ""
+}
+
+// HasOwnerSort сообщает, есть ли в сортировке поля владельца
+func (f CarFilter) HasOwnerSort() bool {
+	for _, sf := range f.Sort {
+		if strings.HasPrefix(sf.Field, fieldOwner+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesOwnerName сообщает, выбираются или упорядочиваются ли машины по имени или отчеству владельца.
+// Такой запрос раскрывает полное имя даже при замаскированном ответе. Фамилия не маскируется и не учитывается
+func (f CarFilter) UsesOwnerName() bool {
+	if f.NameFilter != "" || f.PatronymicFilter != "" {
+		return true
+	}
+	for _, sf := range f.Sort {
+		if sf.Field == FieldName || sf.Field == FieldPatronymic {
+			return true
+		}
+	}
+	return false
+}
+
+// YearRange разбирает YearFilter вида 'start:end'
+func (f CarFilter) YearRange() (int, int, error) {
+	years := strings.Split(f.YearFilter, ":")
+	if len(years) != 2 {
+		return 0, 0, errors.New("invalid year filter format")
+	}
+
+	startYear, err := strconv.Atoi(years[0])
+	if err != nil {
+		return 0, 0, errors.New("invalid start year")
+	}
+
+	endYear, err := strconv.Atoi(years[1])
+	if err != nil {
+		return 0, 0, errors.New("invalid end year")
+	}
+
+	if startYear > endYear {
+		return 0, 0, errors.New("start year cannot be greater than end year")
+	}
+	return startYear, endYear, nil
+}
+
+// IsEmpty сообщает, что в фильтре нет ни одного условия на поля машины
+func (f CarFilter) IsEmpty() bool {
+	return f.YearFilter == "" && f.RegNumFilter == "" && f.ModelFilter == "" && f.MarkFilter == "" &&
+		!f.HasOwnerFilter()
+}
+
+// Select возвращает только запрошенные поля машины в виде, готовом для сериализации в JSON
+func (c CarWithOwner) Select(fields []string) map[string]any {
+	res := make(map[string]any)
+	owner := make(map[string]any)
+	for _, f := range fields {
+		switch f {
+		case FieldID:
+			res["id"] = c.Id
+		case FieldRegNum:
+			res["regNum"] = c.RegNum
+		case FieldMark:
+			res["mark"] = c.Mark
+		case FieldModel:
+			res["model"] = c.Model
+		case FieldYear:
+			res["year"] = c.Year
+		case FieldSource:
+			res["source"] = c.Source
+		case FieldCarInfoFetchedAt:
+			res["carinfoFetchedAt"] = c.CarInfoFetchedAt
+		case FieldCreatedAt:
+			res["createdAt"] = c.CreatedAt
+		case FieldUpdatedAt:
+			res["updatedAt"] = c.UpdatedAt
+		case FieldName:
+			owner["name"] = c.Name
+		case FieldSurname:
+			owner["surname"] = c.Surname
+		case FieldPatronymic:
+			owner["patronymic"] = c.Patronymic
+		case FieldOwnerSource:
+			owner["source"] = c.Owner.Source
+		case FieldOwnerCreatedAt:
+			owner["createdAt"] = c.Owner.CreatedAt
+		case FieldOwnerUpdatedAt:
+			owner["updatedAt"] = c.Owner.UpdatedAt
+		}
+	}
+	if len(owner) > 0 {
+		res[fieldOwner] = owner
+	}
+	// удалённую машину всегда помечаем, иначе её не отличить от обычной
+	if c.DeletedAt != nil {
+		res["deletedAt"] = c.DeletedAt
+	}
+	return res
+}
+
+// Car возвращает данные машины без id
+func (c CarWithOwner) Car() Car {
+	return Car{RegNum: c.RegNum, Mark: c.Mark, Model: c.Model, Year: c.Year, Owner: c.People}
+}
+
+// Diff формирует патч только из полей, которые отличаются в to
+func Diff(from CarWithOwner, to Car) PatchCar {
+	var pc PatchCar
+	if from.RegNum != to.RegNum {
+		pc.RegNum = NewPatchField(to.RegNum)
+	}
+	if from.Mark != to.Mark {
+		pc.Mark = NewPatchField(to.Mark)
+	}
+	if from.Model != to.Model {
+		pc.Model = NewPatchField(to.Model)
+	}
+	if from.Year != to.Year {
+		pc.Year = PatchField[int16]{Set: true, Null: !to.Year.Valid, Value: to.Year.Int16}
+	}
+	if from.Name != to.Owner.Name {
+		pc.Name = NewPatchField(to.Owner.Name)
+	}
+	if from.Surname != to.Owner.Surname {
+		pc.Surname = NewPatchField(to.Owner.Surname)
+	}
+	if from.Patronymic != to.Owner.Patronymic {
+		pc.Patronymic = PatchField[string]{Set: true, Null: !to.Owner.Patronymic.Valid, Value: to.Owner.Patronymic.String}
+	}
+	return pc
+}
+
+// IsEmpty сообщает, что патч ничего не меняет
+func (pc PatchCar) IsEmpty() bool {
+	return !pc.RegNum.Set && !pc.Mark.Set && !pc.Model.Set && !pc.Year.Set &&
+		!pc.Name.Set && !pc.Surname.Set && !pc.Patronymic.Set
+}
@@ -0,0 +1,129 @@
+package car
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Initial сокращает имя до инициала: Иван - И.
+func Initial(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ""
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + "."
+}
+
+// Masked возвращает владельца с именем и отчеством, сокращёнными до инициалов (Иванов И. И.).
+// Так владелец отдаётся клиентам без права на персональные данные
+func (p People) Masked() People {
+	p.Name = Initial(p.Name)
+	if p.Patronymic.Valid {
+		p.Patronymic.String = Initial(p.Patronymic.String)
+	}
+	return p
+}
+
+// MaskOwner возвращает машину с замаскированным владельцем
+func (c CarWithOwner) MaskOwner() CarWithOwner {
+	c.People = c.People.Masked()
+	return c
+}
+
+// MaskDocument маскирует владельца в JSON-документе машины из журнала изменений или ленты событий.
+// Документы без владельца возвращаются как есть
+func MaskDocument(doc json.RawMessage) (json.RawMessage, error) {
+	if len(doc) == 0 || string(doc) == "null" {
+		return doc, nil
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return nil, err
+	}
+	raw, ok := m["owner"]
+	if !ok {
+		return doc, nil
+	}
+
+	var owner map[string]any
+	if err := json.Unmarshal(raw, &owner); err != nil {
+		return nil, err
+	}
+	for _, field := range []string{FieldName, FieldPatronymic} {
+		name := strings.TrimPrefix(field, "owner.")
+		if _, ok := owner[name]; ok {
+			owner[name] = MaskField(field, owner[name])
+		}
+	}
+
+	raw, err := json.Marshal(owner)
+	if err != nil {
+		return nil, err
+	}
+	m["owner"] = raw
+	return json.Marshal(m)
+}
+
+// MaskField маскирует значение поля по пути вида owner.name, остальные поля не меняются
+func MaskField(field string, v any) any {
+	if field != FieldName && field != FieldPatronymic {
+		return v
+	}
+	if s, ok := v.(string); ok {
+		return Initial(s)
+	}
+	return v
+}
+
+// LogValue не даёт персональным данным владельца попасть в логи: пишутся только инициалы
+func (p People) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("surname", Initial(p.Surname)),
+		slog.String("name", Initial(p.Name)),
+	}
+	if p.Patronymic.Valid {
+		attrs = append(attrs, slog.String("patronymic", Initial(p.Patronymic.String)))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// LogValue пишет машину в лог, владелец маскируется People.LogValue
+func (c Car) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("regNum", c.RegNum),
+		slog.String("mark", c.Mark),
+		slog.String("model", c.Model),
+	}
+	if c.Year.Valid {
+		attrs = append(attrs, slog.Int("year", int(c.Year.Int16)))
+	}
+	attrs = append(attrs, slog.Any("owner", c.Owner))
+	return slog.GroupValue(attrs...)
+}
+
+// LogValue пишет в лог только названия изменяемых полей, без значений
+func (pc PatchCar) LogValue() slog.Value {
+	fields := []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{FieldRegNum, pc.RegNum.Set},
+		{FieldMark, pc.Mark.Set},
+		{FieldModel, pc.Model.Set},
+		{FieldYear, pc.Year.Set},
+		{FieldName, pc.Name.Set},
+		{FieldSurname, pc.Surname.Set},
+		{FieldPatronymic, pc.Patronymic.Set},
+	} {
+		if f.set {
+			fields = append(fields, f.name)
+		}
+	}
+	return slog.GroupValue(slog.Any("fields", fields))
+}
@@ -0,0 +1,15 @@
+package idempotency
+
+// Record - сохранённый ответ на запрос с Idempotency-Key
+type Record struct {
+	Key string
+	// RequestHash - хэш метода, пути и тела первого запроса
+	RequestHash string
+	// Completed - ответ уже сохранён, до этого запрос считается выполняющимся
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	// Headers - заголовки ответа, которые повторяются вместе с телом, например Location
+	Headers map[string]string
+	Body    []byte
+}
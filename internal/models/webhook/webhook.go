@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Статусы доставки
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Webhook - подписка внешней системы на изменения машин
+type Webhook struct {
+	ID  int64  `json:"id"`
+	URL string `json:"url" example:"https://example.com/hooks/cars"`
+	// Events - типы событий, пустой список означает все
+	Events []string `json:"events" example:"created,deleted"`
+	// Secret - ключ подписи HMAC, возвращается только при создании
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Delivery - доставка одного события одной подписке
+type Delivery struct {
+	ID             int64      `json:"id"`
+	WebhookID      int64      `json:"webhookId"`
+	EventID        int64      `json:"eventId"`
+	EventType      string     `json:"eventType" example:"updated"`
+	Status         string     `json:"status" example:"pending"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty"`
+	LastStatusCode *int       `json:"lastStatusCode,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// Task - доставка, взятая в работу, вместе с данными для отправки
+type Task struct {
+	Delivery
+	URL     string
+	Secret  string
+	Payload json.RawMessage
+}
+
+// Payload - тело запроса к подписчику
+type Payload struct {
+	EventID    int64           `json:"eventId"`
+	Type       string          `json:"type"`
+	CarID      int             `json:"carId"`
+	Car        json.RawMessage `json:"car"`
+	Changes    json.RawMessage `json:"changes"`
+	OccurredAt time.Time       `json:"occurredAt"`
+}
+
+// Заголовки запроса к подписчику
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Sign возвращает подпись тела запроса для заголовка X-Webhook-Signature:
+// sha256= и HMAC-SHA256 от "<timestamp>.<body>" в hex.
+// Временная метка в подписи не даёт повторно отправить старый запрос
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
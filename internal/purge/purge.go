@@ -0,0 +1,66 @@
+package purge
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/actor"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+)
+
+// Actor - исполнитель очистки в журнале изменений
+const Actor = "purge"
+
+// batchSize - сколько машин очищается за одну транзакцию
+const batchSize = 500
+
+type Purger interface {
+	PurgeDeletedCars(ctx context.Context, deletedBefore time.Time, limit int) (int, error)
+	PurgeRateLimits(ctx context.Context) (int, error)
+}
+
+// Run раз в interval окончательно удаляет машины, удалённые больше retention назад,
+// и наполнившиеся корзины лимитов запросов.
+// Работает до отмены ctx
+func Run(ctx context.Context, log *slog.Logger, purger Purger, interval, retention time.Duration) {
+	const op = "purge.Run"
+
+	log = log.With(slog.String("op", op))
+	ctx = actor.WithActor(ctx, Actor)
+	// машины всех арендаторов, изменения остаются в журнале арендатора машины
+	ctx = tenant.WithAll(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deletedBefore := time.Now().Add(-retention)
+		total := 0
+		for {
+			n, err := purger.PurgeDeletedCars(ctx, deletedBefore, batchSize)
+			if err != nil {
+				log.Error("failed to purge deleted cars", "error", err)
+				break
+			}
+			total += n
+			if n < batchSize {
+				break
+			}
+		}
+
+		if total > 0 {
+			log.Info("deleted cars purged", slog.Int("count", total))
+		}
+
+		if _, err := purger.PurgeRateLimits(ctx); err != nil {
+			log.Error("failed to purge rate limits", "error", err)
+		}
+	}
+}
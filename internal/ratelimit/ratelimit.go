@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Budget - вид операций со своим лимитом
+type Budget string
+
+const (
+	// Read - чтение машин
+	Read Budget = "read"
+	// Write - изменения машин
+	Write Budget = "write"
+	// CarInfo - запросы к CarInfo, одна единица на гос. номер
+	CarInfo Budget = "carinfo"
+	// IP - все запросы с одного адреса до проверки токена, ограничивает подбор токенов
+	IP Budget = "ip"
+)
+
+// ErrBatchTooLarge - операция требует больше токенов, чем помещается в корзину,
+// и не выполнится даже после ожидания
+var ErrBatchTooLarge = errors.New("batch exceeds rate limit burst")
+
+// Limit - корзина токенов: не больше Burst операций подряд,
+// токены восстанавливаются равномерно, Burst штук за Period.
+// Нулевой Limit не ограничивает операции
+type Limit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// ParseLimit разбирает лимит вида 100/1m, off отключает ограничение
+func ParseLimit(s string) (Limit, error) {
+	if s == "off" {
+		return Limit{}, nil
+	}
+
+	burst, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected <count>/<period>", s)
+	}
+	n, err := strconv.Atoi(burst)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit count %q", burst)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit period %q", period)
+	}
+	return Limit{Burst: n, Period: d}, nil
+}
+
+// Unlimited сообщает, что лимит не задан
+func (l Limit) Unlimited() bool {
+	return l.Burst <= 0 || l.Period <= 0
+}
+
+// Result - результат списания токенов
+type Result struct {
+	Allowed bool
+	// Limit - размер корзины
+	Limit int
+	// Period - за сколько восстанавливается полная корзина
+	Period time.Duration
+	// Remaining - сколько токенов осталось
+	Remaining int
+	// Reset - через сколько корзина снова будет полной
+	Reset time.Duration
+	// RetryAfter - через сколько хватит токенов на отклонённую операцию
+	RetryAfter time.Duration
+}
+
+// Take пополняет корзину с tokens токенами за прошедшее время elapsed и списывает n токенов,
+// если их хватает. Возвращает новое количество токенов.
+// Используется хранилищами, чтобы корзина считалась одинаково
+func (l Limit) Take(tokens float64, elapsed time.Duration, n int) (float64, Result) {
+	rate := float64(l.Burst) / l.Period.Seconds()
+	tokens = math.Min(float64(l.Burst), tokens+math.Max(elapsed.Seconds(), 0)*rate)
+
+	res := Result{Limit: l.Burst, Period: l.Period}
+	if tokens >= float64(n) {
+		tokens -= float64(n)
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((float64(n) - tokens) / rate)
+	}
+
+	res.Remaining = int(tokens)
+	res.Reset = seconds((float64(l.Burst) - tokens) / rate)
+	return tokens, res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
+
+// Store хранит корзины. Общее хранилище (например Postgres) делает лимиты общими для всех экземпляров сервиса
+type Store interface {
+	// TakeRateLimit списывает n токенов из корзины key, создавая полную корзину при первом обращении
+	TakeRateLimit(ctx context.Context, key string, limit Limit, n int) (Result, error)
+}
+
+// Limiter списывает токены из корзин клиентов по видам операций
+type Limiter struct {
+	store  Store
+	limits map[Budget]Limit
+}
+
+func New(store Store, limits map[Budget]Limit) *Limiter {
+	return &Limiter{store: store, limits: limits}
+}
+
+// Take списывает n токенов из корзины клиента client для операций budget
+func (l *Limiter) Take(ctx context.Context, client string, budget Budget, n int) (Result, error) {
+	const op = "ratelimit.Limiter.Take"
+
+	limit := l.limits[budget]
+	if limit.Unlimited() {
+		return Result{Allowed: true}, nil
+	}
+	if n > limit.Burst {
+		return Result{Limit: limit.Burst, Period: limit.Period}, fmt.Errorf("%s: %d %s operations, burst is %d: %w",
+			op, n, budget, limit.Burst, ErrBatchTooLarge)
+	}
+
+	res, err := l.store.TakeRateLimit(ctx, string(budget)+":"+client, limit, n)
+	if err != nil {
+		return Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return res, nil
+}
+
+type ctxKey struct{}
+
+type client struct {
+	limiter *Limiter
+	name    string
+}
+
+// WithClient сохраняет в контексте клиента, из корзин которого списываются токены в Take
+func WithClient(ctx context.Context, limiter *Limiter, name string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, client{limiter: limiter, name: name})
+}
+
+// Take списывает n токенов у клиента из контекста.
+// Без клиента в контексте операция не ограничивается
+func Take(ctx context.Context, budget Budget, n int) (Result, error) {
+	c, ok := ctx.Value(ctxKey{}).(client)
+	if !ok || c.limiter == nil {
+		return Result{Allowed: true}, nil
+	}
+	return c.limiter.Take(ctx, c.name, budget, n)
+}
@@ -0,0 +1,129 @@
+package resync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/actor"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	strg "github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/P1coFly/CarInfoEM/internal/validation"
+)
+
+// Actor - исполнитель фоновой синхронизации в журнале изменений
+const Actor = "resync"
+
+// batchSize - сколько машин выбирается за один запрос к хранилищу
+const batchSize = 100
+
+var (
+	// ErrCarInfo - CarInfo не вернул данные машины
+	ErrCarInfo = errors.New("carinfo request failed")
+	// ErrInvalidCarInfo - CarInfo вернул данные, не прошедшие проверку
+	ErrInvalidCarInfo = errors.New("invalid car data from carinfo")
+)
+
+type Storage interface {
+	GetCar(ctx context.Context, carID int, fields []string, includeDeleted bool) (car.CarWithOwner, error)
+	RefreshCar(ctx context.Context, carID int, c car.Car, version int) (bool, error)
+	FindStaleCarIDs(ctx context.Context, fetchedBefore time.Time, afterID, limit int) ([]int, error)
+}
+
+type CarInfo interface {
+	Get(regNum string) (car.Car, int, error)
+}
+
+// Refresh заново получает данные машины из CarInfo и сохраняет изменения.
+// version - ожидаемая версия машины, 0 отключает проверку.
+// Возвращает false, если данные не изменились
+func Refresh(ctx context.Context, storage Storage, carInfo CarInfo, carID, version int) (bool, error) {
+	const op = "resync.Refresh"
+
+	current, err := storage.GetCar(ctx, carID, []string{car.FieldRegNum}, false)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if version != 0 && version != current.Version {
+		return false, fmt.Errorf("%s: %w", op, strg.ErrVersionMismatch)
+	}
+
+	fetched, _, err := carInfo.Get(current.RegNum)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w: %v", op, ErrCarInfo, err)
+	}
+
+	violations, err := validation.Struct(fetched)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(violations) > 0 {
+		return false, fmt.Errorf("%s: %w: %v", op, ErrInvalidCarInfo, violations)
+	}
+
+	// сохраняем, только если машина не изменилась, пока шёл запрос в CarInfo
+	changed, err := storage.RefreshCar(ctx, carID, fetched, current.Version)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return changed, nil
+}
+
+// Run раз в interval заново получает из CarInfo машины, данные которых старше maxAge.
+// Работает до отмены ctx
+func Run(ctx context.Context, log *slog.Logger, storage Storage, carInfo CarInfo, interval, maxAge time.Duration) {
+	const op = "resync.Run"
+
+	log = log.With(slog.String("op", op))
+	ctx = actor.WithActor(ctx, Actor)
+	// машины всех арендаторов, изменения остаются в журнале арендатора машины
+	ctx = tenant.WithAll(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fetchedBefore := time.Now().Add(-maxAge)
+		var checked, changed, failed int
+		// идём по id, чтобы не выбирать снова машины, которые не удалось обновить
+		afterID := 0
+		for ctx.Err() == nil {
+			ids, err := storage.FindStaleCarIDs(ctx, fetchedBefore, afterID, batchSize)
+			if err != nil {
+				log.Error("failed to find stale cars", "error", err)
+				break
+			}
+
+			for _, id := range ids {
+				checked++
+				ok, err := Refresh(ctx, storage, carInfo, id, 0)
+				if err != nil {
+					failed++
+					log.Error("failed to refresh car", slog.Int("id", id), "error", err)
+					continue
+				}
+				if ok {
+					changed++
+				}
+			}
+
+			if len(ids) < batchSize {
+				break
+			}
+			afterID = ids[len(ids)-1]
+		}
+
+		if checked > 0 {
+			log.Info("cars resynced", slog.Int("checked", checked), slog.Int("changed", changed), slog.Int("failed", failed))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/P1coFly/CarInfoEM/internal/models/apikey"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/lib/pq"
+)
+
+// сохраняем ключ API, хранится только хеш
+func (s *Storage) CreateAPIKey(ctx context.Context, key apikey.Key, hash string) (apikey.Key, error) {
+	const op = "storage.postgresql.CreateAPIKey"
+
+	key.TenantID = ownerTenant(ctx)
+	err := s.db.QueryRowContext(ctx, `INSERT INTO API_KEYS (name, prefix, key_hash, scopes, tenant_id) VALUES ($1, $2, $3, $4, $5)
+		returning id, created_at`,
+		key.Name, key.Prefix, hash, pq.Array(key.Scopes), key.TenantID).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return apikey.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return key, nil
+}
+
+// получаем все ключи, в том числе отозванные
+func (s *Storage) GetAPIKeys(ctx context.Context) ([]apikey.Key, error) {
+	const op = "storage.postgresql.GetAPIKeys"
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, prefix, scopes, tenant_id, created_at, last_used_at, revoked_at
+		FROM API_KEYS WHERE ($1 = '' OR tenant_id = $1) ORDER BY id`, tenantArg(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	keys := []apikey.Key{}
+	for rows.Next() {
+		var k apikey.Key
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.TenantID, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return keys, nil
+}
+
+// отзываем ключ, повторный отзыв не меняет время отзыва
+func (s *Storage) RevokeAPIKey(ctx context.Context, id int64) error {
+	const op = "storage.postgresql.RevokeAPIKey"
+
+	res, err := s.db.ExecContext(ctx, `UPDATE API_KEYS SET revoked_at = COALESCE(revoked_at, now())
+		WHERE id = $1 AND ($2 = '' OR tenant_id = $2)`, id, tenantArg(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+	return nil
+}
+
+// находим ключ по префиксу и отмечаем его использование.
+// Время использования обновляется не чаще раза в минуту, чтобы не писать в БД на каждый запрос
+func (s *Storage) FindAPIKey(ctx context.Context, prefix string) (apikey.Key, string, error) {
+	const op = "storage.postgresql.FindAPIKey"
+
+	var k apikey.Key
+	var hash string
+	// ключ ищется до того, как известен арендатор запроса, поэтому без ограничения по арендатору
+	err := s.db.QueryRowContext(ctx, `SELECT id, name, prefix, key_hash, scopes, tenant_id, created_at, last_used_at, revoked_at
+		FROM API_KEYS WHERE prefix = $1`, prefix).
+		Scan(&k.ID, &k.Name, &k.Prefix, &hash, pq.Array(&k.Scopes), &k.TenantID, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return k, "", fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+		}
+		return k, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if k.RevokedAt == nil {
+		_, err = s.db.ExecContext(ctx, `UPDATE API_KEYS SET last_used_at = now()
+			WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')`, k.ID)
+		if err != nil {
+			return k, "", fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return k, hash, nil
+}
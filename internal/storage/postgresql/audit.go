@@ -0,0 +1,198 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/P1coFly/CarInfoEM/internal/actor"
+	"github.com/P1coFly/CarInfoEM/internal/models/audit"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/go-chi/chi/middleware"
+	"github.com/lib/pq"
+)
+
+// читаем текущее состояние машины внутри транзакции для журнала изменений
+func (s *Storage) snapshotCar(ctx context.Context, tx *sql.Tx, carID int) (*car.CarWithOwner, error) {
+	const op = "storage.postgresql.snapshotCar"
+
+	sqlQuery := "SELECT CARS.version, CARS.deleted_at, CARS.tenant_id, " + selectColumns(car.Fields) +
+		" FROM CARS JOIN PEOPLES ON CARS.owner_id = PEOPLES.id WHERE CARS.id = $1"
+
+	cwo := car.CarWithOwner{}
+	dest := append([]any{&cwo.Version, &cwo.DeletedAt, &cwo.TenantID}, scanDest(&cwo, car.Fields)...)
+	err := tx.QueryRowContext(ctx, sqlQuery, carID).Scan(dest...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return &cwo, nil
+}
+
+// записываем изменение машины в журнал и ленту событий в той же транзакции, что и само изменение.
+// before - состояние до изменения, nil для создания; состояние после читается из транзакции
+func (s *Storage) recordMutation(ctx context.Context, tx *sql.Tx, action string, carID int, before *car.CarWithOwner) error {
+	const op = "storage.postgresql.recordMutation"
+
+	after, err := s.snapshotCar(ctx, tx, carID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	beforeDoc, err := marshalSnapshot(before)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	afterDoc, err := marshalSnapshot(after)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	diff, err := audit.Diff(beforeDoc, afterDoc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	diffDoc, err := json.Marshal(diff)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// запись журнала принадлежит арендатору машины, фоновые задачи меняют машины всех арендаторов
+	snapshot := after
+	if snapshot == nil {
+		snapshot = before
+	}
+	tenantID := ownerTenant(ctx)
+	if snapshot != nil {
+		tenantID = snapshot.TenantID
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO AUDIT_LOG (car_id, action, actor, request_id, before, after, diff, tenant_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		carID, action, actor.FromContext(ctx), middleware.GetReqID(ctx), nullJSON(beforeDoc), nullJSON(afterDoc), diffDoc, tenantID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// в событии передаём состояние после изменения, а для исчезнувшей машины - последнее известное
+	doc := afterDoc
+	if doc == nil {
+		doc = beforeDoc
+	}
+	if err := s.recordEvent(ctx, tx, action, carID, tenantID, doc, diffDoc); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// получаем записи журнала изменений по фильтру, от новых к старым
+func (s *Storage) GetAuditRecords(ctx context.Context, filter audit.Filter, pageSize, pageToken int) ([]audit.Record, error) {
+	const op = "storage.postgresql.GetAuditRecords"
+
+	conditions, args := tenantCondition(ctx, "tenant_id", nil)
+	if filter.CarID != 0 {
+		args = append(args, filter.CarID)
+		conditions = append(conditions, fmt.Sprintf("car_id = $%d", len(args)))
+	}
+	if filter.Actor != "" {
+		args = append(args, filter.Actor)
+		conditions = append(conditions, fmt.Sprintf("actor = $%d", len(args)))
+	}
+	if !filter.Since.IsZero() {
+		args = append(args, filter.Since)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+
+	sqlQuery := "SELECT id, car_id, action, actor, request_id, created_at, before, after, diff FROM AUDIT_LOG"
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += fmt.Sprintf(" ORDER BY id DESC LIMIT %d OFFSET %d", pageSize, (pageToken-1)*pageSize)
+
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	records, err := scanAuditRecords(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return records, nil
+}
+
+// получаем историю владельцев нескольких машин одним запросом: записи о создании машины
+// и об изменении имени владельца, от старых к новым
+func (s *Storage) GetOwnerHistory(ctx context.Context, carIDs []int) (map[int][]audit.Record, error) {
+	const op = "storage.postgresql.GetOwnerHistory"
+
+	ids := make([]int64, 0, len(carIDs))
+	for _, id := range carIDs {
+		ids = append(ids, int64(id))
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, car_id, action, actor, request_id, created_at, before, after, diff
+		FROM AUDIT_LOG
+		WHERE car_id = ANY($1) AND ($2 = '' OR tenant_id = $2) AND after IS NOT NULL
+			AND (action = $3 OR diff ?| $4)
+		ORDER BY car_id, id`,
+		pq.Array(ids), tenantArg(ctx), audit.ActionCreate, pq.Array([]string{car.FieldName, car.FieldSurname, car.FieldPatronymic}))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	records, err := scanAuditRecords(rows)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	history := make(map[int][]audit.Record, len(carIDs))
+	for _, rec := range records {
+		history[rec.CarID] = append(history[rec.CarID], rec)
+	}
+	return history, nil
+}
+
+func scanAuditRecords(rows *sql.Rows) ([]audit.Record, error) {
+	records := []audit.Record{}
+	for rows.Next() {
+		var rec audit.Record
+		var requestID sql.NullString
+		var before, after, diff []byte
+		err := rows.Scan(&rec.ID, &rec.CarID, &rec.Action, &rec.Actor, &requestID, &rec.CreatedAt, &before, &after, &diff)
+		if err != nil {
+			return nil, err
+		}
+		rec.RequestID = requestID.String
+		rec.Before = before
+		rec.After = after
+		if err := json.Unmarshal(diff, &rec.Diff); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// сериализуем состояние машины, nil означает отсутствие машины
+func marshalSnapshot(cwo *car.CarWithOwner) ([]byte, error) {
+	if cwo == nil {
+		return nil, nil
+	}
+	return json.Marshal(cwo)
+}
+
+// пустой документ пишем в jsonb как NULL
+func nullJSON(doc []byte) any {
+	if doc == nil {
+		return nil
+	}
+	return string(doc)
+}
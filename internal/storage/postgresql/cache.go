@@ -0,0 +1,92 @@
+package postgresql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+)
+
+// cacheTTL - сколько машина хранится в кэше. Изменения сбрасывают кэш через уведомления,
+// срок хранения ограничивает устаревание, если уведомление было потеряно
+const cacheTTL = time.Minute
+
+type cacheEntry struct {
+	car     car.CarWithOwner
+	expires time.Time
+}
+
+// carCache - кэш машин по id в памяти процесса
+type carCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[int]cacheEntry
+	// gen увеличивается при каждом сбросе, чтобы не сохранить машину, прочитанную до изменения
+	gen uint64
+}
+
+func newCarCache(ttl time.Duration) *carCache {
+	return &carCache{ttl: ttl, items: make(map[int]cacheEntry)}
+}
+
+func (c *carCache) get(carID int) (car.CarWithOwner, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[carID]
+	if !ok {
+		return car.CarWithOwner{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.items, carID)
+		return car.CarWithOwner{}, false
+	}
+	return e.car, true
+}
+
+// getTenant отдаёт машину из кэша, только если она принадлежит арендатору tenantID.
+// Пустой tenantID - контекст без ограничения по арендатору
+func (c *carCache) getTenant(carID int, tenantID string) (car.CarWithOwner, bool) {
+	cwo, ok := c.get(carID)
+	if !ok || (tenantID != "" && cwo.TenantID != tenantID) {
+		return car.CarWithOwner{}, false
+	}
+	return cwo, true
+}
+
+// generation нужно получить до чтения машины из БД и передать в put
+func (c *carCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// сохраняем машину, если с начала её чтения кэш не сбрасывался
+func (c *carCache) put(carID int, cwo car.CarWithOwner, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	c.items[carID] = cacheEntry{car: cwo, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *carCache) invalidate(carIDs ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, id := range carIDs {
+		delete(c.items, id)
+	}
+}
+
+// сбрасываем весь кэш, например, если уведомления могли быть пропущены
+func (c *carCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.items = make(map[int]cacheEntry)
+}
@@ -0,0 +1,128 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/P1coFly/CarInfoEM/internal/events"
+)
+
+// Publisher получает события изменений, зафиксированные любым экземпляром сервиса
+type Publisher interface {
+	Publish(e events.Event)
+}
+
+// SetPublisher задаёт получателя событий изменений машин
+func (s *Storage) SetPublisher(p Publisher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.publisher = p
+}
+
+// записываем событие в ленту изменений и очередь вебхуков в той же транзакции, что и изменение.
+// Уведомление в канал ChangeChannel Postgres доставит слушателям только после фиксации транзакции
+// changes - изменённые поля в формате audit.Record.Diff
+func (s *Storage) recordEvent(ctx context.Context, tx *sql.Tx, action string, carID int, tenantID string, doc, changes []byte) error {
+	const op = "storage.postgresql.recordEvent"
+
+	eventType := events.TypeForAction(action)
+	if eventType == "" {
+		return nil
+	}
+
+	e := events.Event{Type: eventType, CarID: carID, Car: doc, TenantID: tenantID}
+	err := tx.QueryRowContext(ctx, `INSERT INTO CAR_EVENTS (car_id, type, car, tenant_id) VALUES ($1, $2, $3, $4) returning id, created_at`,
+		carID, eventType, string(doc), tenantID).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.enqueueWebhooks(ctx, tx, e, changes); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// в уведомлении только id, размер его данных ограничен
+	payload, err := json.Marshal(notification{EventID: e.ID, CarID: carID})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, ChangeChannel, string(payload)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.mu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[*sql.Tx][]events.Event)
+	}
+	s.pending[tx] = append(s.pending[tx], e)
+	s.mu.Unlock()
+	return nil
+}
+
+// фиксируем транзакцию и сразу сбрасываем кэш изменённых в ней машин,
+// не дожидаясь уведомления. Подписчикам события отправляет Listen
+func (s *Storage) commit(tx *sql.Tx) error {
+	err := tx.Commit()
+
+	s.mu.Lock()
+	pending := s.pending[tx]
+	delete(s.pending, tx)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	carIDs := make([]int, 0, len(pending))
+	for _, e := range pending {
+		carIDs = append(carIDs, e.CarID)
+	}
+	s.cache.invalidate(carIDs...)
+	return nil
+}
+
+// откатываем транзакцию, если она не зафиксирована, и забываем её события
+func (s *Storage) rollback(tx *sql.Tx) {
+	tx.Rollback()
+
+	s.mu.Lock()
+	delete(s.pending, tx)
+	s.mu.Unlock()
+}
+
+// получаем события ленты изменений с id больше afterID по возрастанию
+func (s *Storage) GetEvents(ctx context.Context, afterID int64, filter events.Filter, limit int) ([]events.Event, error) {
+	const op = "storage.postgresql.GetEvents"
+
+	// условия совпадают с events.Filter.Match для новых событий,
+	// арендатор берётся из контекста, а не из фильтра
+	rows, err := s.db.QueryContext(ctx, `SELECT id, car_id, type, car, created_at, tenant_id FROM CAR_EVENTS
+		WHERE id > $1
+			AND ($2 = '' OR lower(car->>'mark') = lower($2))
+			AND ($3 = '' OR lower(car->'owner'->>'name') = lower($3))
+			AND ($4 = '' OR lower(car->'owner'->>'surname') = lower($4))
+			AND ($6 = '' OR tenant_id = $6)
+		ORDER BY id LIMIT $5`,
+		afterID, filter.Mark, filter.Name, filter.Surname, limit, tenantArg(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var res []events.Event
+	for rows.Next() {
+		var e events.Event
+		var doc []byte
+		if err := rows.Scan(&e.ID, &e.CarID, &e.Type, &doc, &e.CreatedAt, &e.TenantID); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		e.Car = json.RawMessage(doc)
+		res = append(res, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return res, nil
+}
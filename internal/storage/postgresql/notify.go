@@ -0,0 +1,162 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/events"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/lib/pq"
+)
+
+// ChangeChannel - канал Postgres, в который отправляется уведомление о каждом изменении машины
+const ChangeChannel = "car_changed"
+
+const (
+	// задержки переподключения слушателя после обрыва соединения
+	listenMinReconnect = time.Second
+	listenMaxReconnect = time.Minute
+	// как часто проверяем соединение, если уведомлений нет
+	listenPingInterval = 90 * time.Second
+	// сколько пропущенных событий отправляем за раз после переподключения
+	catchUpBatch = 500
+)
+
+// notification - данные уведомления в канале ChangeChannel
+type notification struct {
+	EventID int64 `json:"eventId"`
+	CarID   int   `json:"carId"`
+}
+
+// Listen слушает уведомления об изменениях машин от всех экземпляров сервиса:
+// сбрасывает кэш изменённой машины и отправляет событие в Publisher.
+// При обрыве соединения переподключается, сбрасывает весь кэш и досылает пропущенные события.
+// Работает до отмены ctx
+func (s *Storage) Listen(ctx context.Context, log *slog.Logger) {
+	const op = "storage.postgresql.Listen"
+
+	log = log.With(slog.String("op", op))
+	// события всех арендаторов, подписчиков разделяет events.Filter
+	ctx = tenant.WithAll(ctx)
+
+	listener := pq.NewListener(s.connStr, listenMinReconnect, listenMaxReconnect,
+		func(ev pq.ListenerEventType, err error) {
+			switch ev {
+			case pq.ListenerEventDisconnected:
+				log.Error("listener disconnected", "error", err)
+			case pq.ListenerEventConnectionAttemptFailed:
+				log.Error("listener failed to reconnect", "error", err)
+			case pq.ListenerEventReconnected:
+				log.Info("listener reconnected")
+			}
+		})
+	defer listener.Close()
+
+	if err := listener.Listen(ChangeChannel); err != nil {
+		log.Error("failed to listen", "error", err)
+		return
+	}
+
+	// события до запуска уже не нужны подписчикам: они получают их по Last-Event-ID
+	lastID, err := s.lastEventID(ctx)
+	if err != nil {
+		log.Error("failed to get last event id", "error", err)
+		return
+	}
+
+	log.Info("listening for car changes", slog.String("channel", ChangeChannel))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-listener.Notify:
+			// nil приходит после переподключения, уведомления за время обрыва потеряны
+			if n == nil {
+				s.cache.clear()
+				lastID = s.catchUp(ctx, log, lastID)
+				continue
+			}
+
+			var msg notification
+			if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+				log.Error("invalid notification", slog.String("payload", n.Extra), "error", err)
+				continue
+			}
+			s.cache.invalidate(msg.CarID)
+
+			e, err := s.getEvent(ctx, msg.EventID)
+			if err != nil {
+				log.Error("failed to get event", slog.Int64("event_id", msg.EventID), "error", err)
+				continue
+			}
+			s.publish(e)
+			lastID = max(lastID, e.ID)
+		case <-time.After(listenPingInterval):
+			// Ping обнаруживает обрыв, о котором иначе не узнать без уведомлений
+			go listener.Ping()
+		}
+	}
+}
+
+// досылаем события с id больше afterID, возвращаем id последнего отправленного
+func (s *Storage) catchUp(ctx context.Context, log *slog.Logger, afterID int64) int64 {
+	for {
+		batch, err := s.GetEvents(ctx, afterID, events.Filter{}, catchUpBatch)
+		if err != nil {
+			log.Error("failed to get missed events", "error", err)
+			return afterID
+		}
+		for _, e := range batch {
+			s.publish(e)
+			afterID = e.ID
+		}
+		if len(batch) < catchUpBatch {
+			return afterID
+		}
+	}
+}
+
+func (s *Storage) publish(e events.Event) {
+	s.mu.Lock()
+	publisher := s.publisher
+	s.mu.Unlock()
+
+	if publisher != nil {
+		publisher.Publish(e)
+	}
+}
+
+// получаем событие ленты изменений по id
+func (s *Storage) getEvent(ctx context.Context, id int64) (events.Event, error) {
+	const op = "storage.postgresql.getEvent"
+
+	var e events.Event
+	var doc []byte
+	err := s.db.QueryRowContext(ctx, `SELECT id, car_id, type, car, created_at, tenant_id FROM CAR_EVENTS WHERE id = $1`, id).
+		Scan(&e.ID, &e.CarID, &e.Type, &doc, &e.CreatedAt, &e.TenantID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return e, fmt.Errorf("%s: event %d not found", op, id)
+		}
+		return e, fmt.Errorf("%s: %w", op, err)
+	}
+	e.Car = json.RawMessage(doc)
+
+	return e, nil
+}
+
+func (s *Storage) lastEventID(ctx context.Context) (int64, error) {
+	const op = "storage.postgresql.lastEventID"
+
+	var id int64
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(max(id), 0) FROM CAR_EVENTS`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
@@ -1,20 +1,38 @@
 package postgresql
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/P1coFly/CarInfoEM/internal/actor"
+	"github.com/P1coFly/CarInfoEM/internal/events"
+	"github.com/P1coFly/CarInfoEM/internal/models/audit"
 	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/models/idempotency"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Storage struct {
 	db *sql.DB
+	// connStr нужен для отдельного соединения, слушающего уведомления
+	connStr string
+	cache   *carCache
+
+	// события изменений, записанные в ещё не завершённых транзакциях
+	mu        sync.Mutex
+	pending   map[*sql.Tx][]events.Event
+	publisher Publisher
 }
 
 // Функция для инициализации storage
@@ -51,28 +69,48 @@ func New(urlPath, portDB, userDB, password, nameDB, migrationsPath string) (*Sto
 	if err := m.Up(); err != nil {
 		if errors.Is(err, migrate.ErrNoChange) {
 			fmt.Println("no migrations to apply")
-			return &Storage{db: db}, nil
+		} else {
+			return nil, fmt.Errorf("%s: %w", op, err)
 		}
-
-		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return &Storage{db: db}, nil
+	return &Storage{db: db, connStr: connStr, cache: newCarCache(cacheTTL)}, nil
 }
 
 // Метод для регистрации авто
-func (s *Storage) AddCar(car car.Car) (int, error) {
+// source - откуда получены данные, для car.SourceCarInfo запоминается время получения
+func (s *Storage) AddCar(ctx context.Context, car car.Car, source string) (int, error) {
 	const op = "storage.postgresql.AddCar"
 
-	PeopleID, err := s.addPeople(car.Owner)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.rollback(tx)
+
+	tenantID := ownerTenant(ctx)
+
+	PeopleID, err := s.addPeople(ctx, tx, car.Owner, source, tenantID)
 	if err != nil {
 		return -1, fmt.Errorf("%s: %w", op, err)
 	}
 
 	var carID int
-	err = s.db.QueryRow(`INSERT INTO CARS (reg_num, mark,model,year,owner_id) VALUES ($1, $2, $3, $4, $5) returning id`,
-		car.RegNum, car.Mark, car.Model, car.Year, PeopleID).Scan(&carID)
+	err = tx.QueryRowContext(ctx, `INSERT INTO CARS (reg_num, mark,model,year,owner_id, source, carinfo_fetched_at, tenant_id)
+		VALUES ($1, $2, $3, $4, $5, $6, CASE WHEN $6 = 'carinfo' THEN now() END, $7) returning id`,
+		car.RegNum, car.Mark, car.Model, car.Year, PeopleID, source, tenantID).Scan(&carID)
 	if err != nil {
+		if uniqueViolation(err) {
+			return -1, fmt.Errorf("%s: %w", op, storage.ErrCarExists)
+		}
+		return -1, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.recordMutation(ctx, tx, audit.ActionCreate, carID, nil); err != nil {
+		return -1, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.commit(tx); err != nil {
 		return -1, fmt.Errorf("%s: %w", op, err)
 	}
 	return carID, nil
@@ -80,12 +118,12 @@ func (s *Storage) AddCar(car car.Car) (int, error) {
 }
 
 // Метод для регистрации человека
-func (s *Storage) addPeople(people car.People) (int, error) {
+func (s *Storage) addPeople(ctx context.Context, tx *sql.Tx, people car.People, source, tenantID string) (int, error) {
 	const op = "storage.postgresql.AddPeople"
 
 	var id int
-	err := s.db.QueryRow(`INSERT INTO PEOPLES (name, surname, patronymic) VALUES ($1, $2, $3) returning id`,
-		people.Name, people.Surname, people.Patronymic).Scan(&id)
+	err := tx.QueryRowContext(ctx, `INSERT INTO PEOPLES (name, surname, patronymic, source, tenant_id) VALUES ($1, $2, $3, $4, $5) returning id`,
+		people.Name, people.Surname, people.Patronymic, source, tenantID).Scan(&id)
 	if err != nil {
 		return -1, fmt.Errorf("%s: %w", op, err)
 	}
@@ -93,100 +131,251 @@ func (s *Storage) addPeople(people car.People) (int, error) {
 
 }
 
-// Метод для удаления авто и владельца
-func (s *Storage) DeleteCar(carID int) (int, error) {
+// Метод для удаления авто. Машина помечается удалённой и вместе с владельцем
+// остаётся в БД до очистки PurgeDeletedCars
+// version - ожидаемая версия машины, 0 отключает проверку
+func (s *Storage) DeleteCar(ctx context.Context, carID, version int) (int, error) {
 	const op = "storage.postgresql.DeleteCar"
 
-	ownerID, err := s.getOwnerIDByCarID(carID)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return ownerID, fmt.Errorf("%s: %w", op, err)
+		return carID, fmt.Errorf("%s: %w", op, err)
 	}
+	defer s.rollback(tx)
 
-	result, err := s.db.Exec(`DELETE FROM CARS WHERE id = $1`, carID)
+	if _, err := s.lockCar(ctx, tx, carID, version); err != nil {
+		if errors.Is(err, storage.ErrCarNotFound) {
+			return -1, fmt.Errorf("%s: %w", op, err)
+		}
+		return carID, fmt.Errorf("%s: %w", op, err)
+	}
+
+	before, err := s.snapshotCar(ctx, tx, carID)
 	if err != nil {
 		return carID, fmt.Errorf("%s: %w", op, err)
 	}
 
-	// Проверка на количество удаленных записей
-	rowsAffected, err := result.RowsAffected()
+	_, err = tx.ExecContext(ctx, `UPDATE CARS SET deleted_at = now() WHERE id = $1`, carID)
 	if err != nil {
 		return carID, fmt.Errorf("%s: %w", op, err)
 	}
-	if rowsAffected == 0 {
-		return -1, fmt.Errorf("%s: %w", op, errors.New("car not found"))
+
+	if err := s.bumpVersion(ctx, tx, carID); err != nil {
+		return carID, fmt.Errorf("%s: %w", op, err)
 	}
 
-	_, err = s.db.Exec(`DELETE FROM PEOPLES WHERE id = $1`, ownerID)
-	if err != nil {
-		return ownerID, fmt.Errorf("%s: %w", op, err)
+	if err := s.recordMutation(ctx, tx, audit.ActionDelete, carID, before); err != nil {
+		return carID, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.commit(tx); err != nil {
+		return carID, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return carID, nil
 }
 
-// получаем id владельца по id машины
-func (s *Storage) getOwnerIDByCarID(carID int) (int, error) {
-	const op = "storage.postgresql.getOwnerIDByCarID"
-	row := s.db.QueryRow("SELECT owner_id FROM CARS WHERE id = $1", carID)
+// восстанавливаем удалённую машину
+// version - ожидаемая версия машины, 0 отключает проверку
+func (s *Storage) RestoreCar(ctx context.Context, carID, version int) error {
+	const op = "storage.postgresql.RestoreCar"
 
-	var id int
-	err := row.Scan(&id)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.rollback(tx)
+
+	var current int
+	var deletedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT version, deleted_at FROM CARS WHERE id = $1 AND ($2 = '' OR tenant_id = $2) FOR UPDATE",
+		carID, tenantArg(ctx)).Scan(&current, &deletedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return -1, fmt.Errorf("%s: %w", op, errors.New("car not found"))
+			return fmt.Errorf("%s: %w", op, storage.ErrCarNotFound)
 		}
-		return carID, fmt.Errorf("%s: %w", op, err)
+		return fmt.Errorf("%s: %w", op, err)
 	}
-	return id, nil
+	if version != 0 && version != current {
+		return fmt.Errorf("%s: %w", op, storage.ErrVersionMismatch)
+	}
+	if !deletedAt.Valid {
+		return fmt.Errorf("%s: %w", op, storage.ErrCarNotDeleted)
+	}
+
+	before, err := s.snapshotCar(ctx, tx, carID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// пока машина была удалена, её гос. номер могла занять другая машина
+	_, err = tx.ExecContext(ctx, `UPDATE CARS SET deleted_at = NULL WHERE id = $1`, carID)
+	if err != nil {
+		if uniqueViolation(err) {
+			return fmt.Errorf("%s: %w", op, storage.ErrCarExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.bumpVersion(ctx, tx, carID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.recordMutation(ctx, tx, audit.ActionRestore, carID, before); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.commit(tx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
 }
 
-// получаем выборку машин с указаной фильтрацией и параметрами пагинации
-func (s *Storage) GetCars(pageSize, pageToken int, carFilter car.CarFilter) ([]car.CarWithOwner, error) {
-	const op = "storage.postgresql.GetCars"
+// окончательно удаляем машины и их владельцев, удалённые раньше deletedBefore.
+// За вызов обрабатывается не больше limit машин, возвращается их количество
+func (s *Storage) PurgeDeletedCars(ctx context.Context, deletedBefore time.Time, limit int) (int, error) {
+	const op = "storage.postgresql.PurgeDeletedCars"
 
-	// Создаем базовый SQL-запрос
-	sqlQuery := "SELECT CARS.ID, CARS.reg_num, CARS.mark, CARS.model, CARS.year, PEOPLES.name, PEOPLES.surname, PEOPLES.patronymic FROM CARS " +
-		"JOIN PEOPLES ON CARS.owner_id = PEOPLES.id"
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.rollback(tx)
 
-	// Формируем условия фильтрации, если они указаны
-	var conditions []string
+	// заблокированные другими транзакциями машины очистим в следующий раз
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM CARS WHERE deleted_at < $1 AND ($3 = '' OR tenant_id = $3)
+		ORDER BY deleted_at LIMIT $2 FOR UPDATE SKIP LOCKED`,
+		deletedBefore, limit, tenantArg(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	var carIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		carIDs = append(carIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
 
-	if carFilter.YearFilter != "" {
-		years := strings.Split(carFilter.YearFilter, ":")
-		startYear := years[0]
-		endYear := years[1]
-		conditions = append(conditions, fmt.Sprintf("CARS.year BETWEEN %s AND %s", startYear, endYear))
+	for _, carID := range carIDs {
+		before, err := s.snapshotCar(ctx, tx, carID)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		var ownerID int
+		err = tx.QueryRowContext(ctx, `DELETE FROM CARS WHERE id = $1 returning owner_id`, carID).Scan(&ownerID)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM PEOPLES WHERE id = $1`, ownerID)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		if err := s.recordMutation(ctx, tx, audit.ActionPurge, carID, before); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
 	}
 
-	if carFilter.RegNumFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("CARS.reg_num LIKE '%%%s%%'", carFilter.RegNumFilter))
+	if err := s.commit(tx); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
 	}
+	return len(carIDs), nil
+}
 
-	if carFilter.ModelFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("CARS.model LIKE '%%%s%%'", carFilter.ModelFilter))
+// блокируем машину до конца транзакции, проверяем ожидаемую версию и получаем id владельца.
+// Удалённая машина и машина другого арендатора считаются не найденными
+// version - ожидаемая версия машины, 0 отключает проверку
+func (s *Storage) lockCar(ctx context.Context, tx *sql.Tx, carID, version int) (int, error) {
+	const op = "storage.postgresql.lockCar"
+	row := tx.QueryRowContext(ctx, "SELECT owner_id, version FROM CARS WHERE id = $1 AND deleted_at IS NULL AND ($2 = '' OR tenant_id = $2) FOR UPDATE",
+		carID, tenantArg(ctx))
+
+	var ownerID, current int
+	err := row.Scan(&ownerID, &current)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return -1, fmt.Errorf("%s: %w", op, storage.ErrCarNotFound)
+		}
+		return -1, fmt.Errorf("%s: %w", op, err)
 	}
 
-	if carFilter.MarkFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("CARS.mark LIKE '%%%s%%'", carFilter.MarkFilter))
+	if version != 0 && version != current {
+		return -1, fmt.Errorf("%s: %w", op, storage.ErrVersionMismatch)
 	}
+	return ownerID, nil
+}
 
-	if carFilter.NameFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("PEOPLES.name LIKE '%%%s%%'", carFilter.NameFilter))
+// увеличиваем версию машины после изменения её или владельца
+func (s *Storage) bumpVersion(ctx context.Context, tx *sql.Tx, carID int) error {
+	const op = "storage.postgresql.bumpVersion"
+
+	_, err := tx.ExecContext(ctx, `UPDATE CARS SET version = version + 1, updated_at = now() WHERE id = $1`, carID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
 	}
-	if carFilter.SurnameFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("PEOPLES.surname LIKE '%%%s%%'", carFilter.SurnameFilter))
+	return nil
+}
+
+// колонки, соответствующие полям из car.Fields
+var carColumns = map[string]string{
+	car.FieldID:         "CARS.id",
+	car.FieldRegNum:     "CARS.reg_num",
+	car.FieldMark:       "CARS.mark",
+	car.FieldModel:      "CARS.model",
+	car.FieldYear:       "CARS.year",
+	car.FieldName:       "PEOPLES.name",
+	car.FieldSurname:    "PEOPLES.surname",
+	car.FieldPatronymic: "PEOPLES.patronymic",
+
+	car.FieldSource:           "CARS.source",
+	car.FieldCarInfoFetchedAt: "CARS.carinfo_fetched_at",
+	car.FieldCreatedAt:        "CARS.created_at",
+	car.FieldUpdatedAt:        "CARS.updated_at",
+	car.FieldOwnerSource:      "PEOPLES.source",
+	car.FieldOwnerCreatedAt:   "PEOPLES.created_at",
+	car.FieldOwnerUpdatedAt:   "PEOPLES.updated_at",
+}
+
+// получаем выборку машин с указаной фильтрацией и параметрами пагинации
+// fields ограничивает набор выбираемых колонок, пустой fields означает все поля
+func (s *Storage) GetCars(ctx context.Context, pageSize, pageToken int, carFilter car.CarFilter, fields []string) ([]car.CarWithOwner, error) {
+	const op = "storage.postgresql.GetCars"
+
+	if len(fields) == 0 {
+		fields = car.Fields
 	}
-	if carFilter.PatronymicFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("PEOPLES.patronymic LIKE '%%%s%%'", carFilter.PatronymicFilter))
+
+	// Создаем базовый SQL-запрос
+	// PEOPLES присоединяем только если нужны поля владельца или фильтр по нему
+	// время удаления выбираем всегда, им помечаются удалённые машины
+	sqlQuery := "SELECT CARS.deleted_at, " + selectColumns(fields) + " FROM CARS"
+	if car.HasOwnerFields(fields) || carFilter.HasOwnerFilter() || carFilter.HasOwnerSort() {
+		sqlQuery += " JOIN PEOPLES ON CARS.owner_id = PEOPLES.id"
 	}
 
+	// Формируем условия фильтрации, если они указаны
+	conditions, args := filterConditions(ctx, carFilter, nil)
 	if len(conditions) > 0 {
 		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
 	}
 
+	orderBy, err := orderByClause(carFilter.Sort)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	sqlQuery += orderBy
 	sqlQuery += fmt.Sprintf(" LIMIT %d OFFSET %d", pageSize, (pageToken-1)*pageSize)
 
-	rows, err := s.db.Query(sqlQuery)
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
@@ -195,7 +384,7 @@ func (s *Storage) GetCars(pageSize, pageToken int, carFilter car.CarFilter) ([]c
 	var cars []car.CarWithOwner
 	for rows.Next() {
 		cwo := car.CarWithOwner{}
-		err := rows.Scan(&cwo.Id, &cwo.RegNum, &cwo.Mark, &cwo.Model, &cwo.Year, &cwo.Name, &cwo.Surname, &cwo.Patronymic)
+		err := rows.Scan(append([]any{&cwo.DeletedAt}, scanDest(&cwo, fields)...)...)
 		if err != nil {
 			return nil, fmt.Errorf("%s: %w", op, err)
 		}
@@ -205,63 +394,407 @@ func (s *Storage) GetCars(pageSize, pageToken int, carFilter car.CarFilter) ([]c
 	return cars, nil
 }
 
+// получаем машину по id
+// fields ограничивает набор выбираемых колонок, пустой fields означает все поля
+// includeDeleted - искать и среди удалённых машин
+func (s *Storage) GetCar(ctx context.Context, carID int, fields []string, includeDeleted bool) (car.CarWithOwner, error) {
+	const op = "storage.postgresql.GetCar"
+
+	// в кэше хранятся только машины со всеми полями, лишние поля отбрасывает Select.
+	// Машина другого арендатора из кэша не отдаётся
+	tenantID := tenantArg(ctx)
+	if !includeDeleted {
+		if cwo, ok := s.cache.getTenant(carID, tenantID); ok {
+			return cwo, nil
+		}
+	}
+	cacheable := len(fields) == 0 && !includeDeleted
+	gen := s.cache.generation()
+
+	if len(fields) == 0 {
+		fields = car.Fields
+	}
+
+	// версию выбираем всегда, по ней формируется ETag
+	sqlQuery := "SELECT CARS.version, CARS.deleted_at, CARS.tenant_id, " + selectColumns(fields) + " FROM CARS"
+	if car.HasOwnerFields(fields) {
+		sqlQuery += " JOIN PEOPLES ON CARS.owner_id = PEOPLES.id"
+	}
+	sqlQuery += " WHERE CARS.id = $1 AND ($2 = '' OR CARS.tenant_id = $2)"
+	if !includeDeleted {
+		sqlQuery += " AND CARS.deleted_at IS NULL"
+	}
+
+	cwo := car.CarWithOwner{}
+	dest := append([]any{&cwo.Version, &cwo.DeletedAt, &cwo.TenantID}, scanDest(&cwo, fields)...)
+	err := s.db.QueryRowContext(ctx, sqlQuery, carID, tenantID).Scan(dest...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return cwo, fmt.Errorf("%s: %w", op, storage.ErrCarNotFound)
+		}
+		return cwo, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if cacheable {
+		s.cache.put(carID, cwo, gen)
+	}
+
+	return cwo, nil
+}
+
+// получаем владельцев машин одним запросом, ключ - id машины.
+// Машины без записи, в том числе удалённые окончательно, в результат не попадают
+func (s *Storage) GetOwners(ctx context.Context, carIDs []int) (map[int]car.Owner, error) {
+	const op = "storage.postgresql.GetOwners"
+
+	ids := make([]int64, 0, len(carIDs))
+	for _, id := range carIDs {
+		ids = append(ids, int64(id))
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT CARS.id, PEOPLES.name, PEOPLES.surname, PEOPLES.patronymic,
+			PEOPLES.source, PEOPLES.created_at, PEOPLES.updated_at
+		FROM CARS JOIN PEOPLES ON CARS.owner_id = PEOPLES.id
+		WHERE CARS.id = ANY($1) AND ($2 = '' OR CARS.tenant_id = $2)`, pq.Array(ids), tenantArg(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	owners := make(map[int]car.Owner, len(carIDs))
+	for rows.Next() {
+		var carID int
+		var o car.Owner
+		if err := rows.Scan(&carID, &o.Name, &o.Surname, &o.Patronymic, &o.Source, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		owners[carID] = o
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return owners, nil
+}
+
 // получаем общее кол-во машин
-func (s *Storage) GetTotalCarsCount(carFilter car.CarFilter) (int, error) {
+func (s *Storage) GetTotalCarsCount(ctx context.Context, carFilter car.CarFilter) (int, error) {
 	const op = "storage.postgresql.GetTotalCarsCount"
 
 	// Запрос для получения общего количества записей
-	sqlQuery := "SELECT COUNT(DISTINCT CARS.ID) FROM CARS LEFT JOIN PEOPLES ON CARS.owner_id = PEOPLES.id"
+	sqlQuery := "SELECT COUNT(DISTINCT CARS.ID) FROM CARS"
+	if carFilter.HasOwnerFilter() {
+		sqlQuery += " LEFT JOIN PEOPLES ON CARS.owner_id = PEOPLES.id"
+	}
 
 	// Формируем условия фильтрации, если они указаны
-	var conditions []string
+	conditions, args := filterConditions(ctx, carFilter, nil)
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var totalCount int
+	err := s.db.QueryRowContext(ctx, sqlQuery, args...).Scan(&totalCount)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return totalCount, nil
+}
+
+// получаем id машин с данными из CarInfo, полученными раньше fetchedBefore.
+// Выбираются машины с id больше afterID по возрастанию, не больше limit
+func (s *Storage) FindStaleCarIDs(ctx context.Context, fetchedBefore time.Time, afterID, limit int) ([]int, error) {
+	const op = "storage.postgresql.FindStaleCarIDs"
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM CARS
+		WHERE source = $1 AND deleted_at IS NULL AND (carinfo_fetched_at IS NULL OR carinfo_fetched_at < $2) AND id > $3
+			AND ($5 = '' OR tenant_id = $5)
+		ORDER BY id LIMIT $4`, car.SourceCarInfo, fetchedBefore, afterID, limit, tenantArg(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return ids, nil
+}
+
+// получаем id машин, подходящих под фильтр, по возрастанию.
+// Непустой ids дополнительно ограничивает выборку этими машинами,
+// limit - максимальное число возвращаемых id
+func (s *Storage) FindCarIDs(ctx context.Context, ids []int, carFilter car.CarFilter, limit int) ([]int, error) {
+	const op = "storage.postgresql.FindCarIDs"
+
+	sqlQuery := "SELECT CARS.id FROM CARS"
+	if carFilter.HasOwnerFilter() {
+		sqlQuery += " JOIN PEOPLES ON CARS.owner_id = PEOPLES.id"
+	}
+
+	var args []any
+	if len(ids) > 0 {
+		arr := make([]int64, 0, len(ids))
+		for _, id := range ids {
+			arr = append(arr, int64(id))
+		}
+		args = append(args, pq.Array(arr))
+	}
+	conditions, args := filterConditions(ctx, carFilter, args)
+	if len(ids) > 0 {
+		conditions = append(conditions, "CARS.id = ANY($1)")
+	}
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += fmt.Sprintf(" ORDER BY CARS.id LIMIT %d", limit)
+
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var found []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		found = append(found, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return found, nil
+}
+
+// формируем список колонок для SELECT по запрошенным полям
+func selectColumns(fields []string) string {
+	columns := make([]string, 0, len(fields))
+	for _, f := range fields {
+		columns = append(columns, carColumns[f])
+	}
+	return strings.Join(columns, ", ")
+}
+
+// формируем ORDER BY, последним всегда идёт id, чтобы страницы не пересекались
+func orderByClause(sort []car.SortField) (string, error) {
+	terms := make([]string, 0, len(sort)+1)
+	for _, sf := range sort {
+		if !slices.Contains(car.SortableFields, sf.Field) {
+			return "", fmt.Errorf("unsupported sort field %q", sf.Field)
+		}
+		term := carColumns[sf.Field]
+		if sf.Desc {
+			term += " DESC"
+		}
+		terms = append(terms, term)
+		if sf.Field == car.FieldID {
+			return " ORDER BY " + strings.Join(terms, ", "), nil
+		}
+	}
+	terms = append(terms, carColumns[car.FieldID])
+	return " ORDER BY " + strings.Join(terms, ", "), nil
+}
+
+// формируем указатели для Scan в том же порядке, что и selectColumns
+func scanDest(cwo *car.CarWithOwner, fields []string) []any {
+	dest := make([]any, 0, len(fields))
+	for _, f := range fields {
+		switch f {
+		case car.FieldID:
+			dest = append(dest, &cwo.Id)
+		case car.FieldRegNum:
+			dest = append(dest, &cwo.RegNum)
+		case car.FieldMark:
+			dest = append(dest, &cwo.Mark)
+		case car.FieldModel:
+			dest = append(dest, &cwo.Model)
+		case car.FieldYear:
+			dest = append(dest, &cwo.Year)
+		case car.FieldName:
+			dest = append(dest, &cwo.Name)
+		case car.FieldSurname:
+			dest = append(dest, &cwo.Surname)
+		case car.FieldPatronymic:
+			dest = append(dest, &cwo.Patronymic)
+		case car.FieldSource:
+			dest = append(dest, &cwo.Source)
+		case car.FieldCarInfoFetchedAt:
+			dest = append(dest, &cwo.CarInfoFetchedAt)
+		case car.FieldCreatedAt:
+			dest = append(dest, &cwo.CreatedAt)
+		case car.FieldUpdatedAt:
+			dest = append(dest, &cwo.UpdatedAt)
+		case car.FieldOwnerSource:
+			dest = append(dest, &cwo.Owner.Source)
+		case car.FieldOwnerCreatedAt:
+			dest = append(dest, &cwo.Owner.CreatedAt)
+		case car.FieldOwnerUpdatedAt:
+			dest = append(dest, &cwo.Owner.UpdatedAt)
+		}
+	}
+	return dest
+}
+
+// Формируем условия фильтрации, если они указаны.
+// Выборка всегда ограничена арендатором из контекста, фильтры не могут это условие обойти.
+// Значения передаются параметрами запроса, их номера продолжают args
+func filterConditions(ctx context.Context, carFilter car.CarFilter, args []any) ([]string, []any) {
+	conditions, args := tenantCondition(ctx, "CARS.tenant_id", args)
+
+	// добавляем значение в параметры и возвращаем его плейсхолдер
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
 
 	if carFilter.YearFilter != "" {
-		years := strings.Split(carFilter.YearFilter, ":")
-		startYear := years[0]
-		endYear := years[1]
-		conditions = append(conditions, fmt.Sprintf("CARS.year BETWEEN %s AND %s", startYear, endYear))
+		// формат проверяется в обработчике, неразобранный фильтр не должен ничего находить
+		startYear, endYear, err := carFilter.YearRange()
+		if err != nil {
+			conditions = append(conditions, "FALSE")
+		} else {
+			conditions = append(conditions, fmt.Sprintf("CARS.year BETWEEN %s AND %s", arg(startYear), arg(endYear)))
+		}
 	}
 
 	if carFilter.RegNumFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("CARS.reg_num LIKE '%%%s%%'", carFilter.RegNumFilter))
+		conditions = append(conditions, fmt.Sprintf("CARS.reg_num LIKE '%%' || %s || '%%'", arg(carFilter.RegNumFilter)))
 	}
 
 	if carFilter.ModelFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("CARS.model LIKE '%%%s%%'", carFilter.ModelFilter))
+		conditions = append(conditions, fmt.Sprintf("CARS.model LIKE '%%' || %s || '%%'", arg(carFilter.ModelFilter)))
 	}
 
 	if carFilter.MarkFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("CARS.mark LIKE '%%%s%%'", carFilter.MarkFilter))
+		conditions = append(conditions, fmt.Sprintf("CARS.mark LIKE '%%' || %s || '%%'", arg(carFilter.MarkFilter)))
 	}
 
 	if carFilter.NameFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("PEOPLES.name LIKE '%%%s%%'", carFilter.NameFilter))
+		conditions = append(conditions, fmt.Sprintf("PEOPLES.name LIKE '%%' || %s || '%%'", arg(carFilter.NameFilter)))
 	}
 	if carFilter.SurnameFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("PEOPLES.surname LIKE '%%%s%%'", carFilter.SurnameFilter))
+		conditions = append(conditions, fmt.Sprintf("PEOPLES.surname LIKE '%%' || %s || '%%'", arg(carFilter.SurnameFilter)))
 	}
 	if carFilter.PatronymicFilter != "" {
-		conditions = append(conditions, fmt.Sprintf("PEOPLES.patronymic LIKE '%%%s%%'", carFilter.PatronymicFilter))
+		conditions = append(conditions, fmt.Sprintf("PEOPLES.patronymic LIKE '%%' || %s || '%%'", arg(carFilter.PatronymicFilter)))
 	}
 
-	if len(conditions) > 0 {
-		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	if !carFilter.UpdatedSince.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("CARS.updated_at >= %s", arg(carFilter.UpdatedSince)))
 	}
 
-	var totalCount int
-	err := s.db.QueryRow(sqlQuery).Scan(&totalCount)
-	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+	if !carFilter.IncludeDeleted {
+		conditions = append(conditions, "CARS.deleted_at IS NULL")
 	}
 
-	return totalCount, nil
+	return conditions, args
 }
 
 // обновляем данные о машине
-func (s *Storage) PatchCar(carID int, pc car.PatchCar) (int, error) {
+// version - ожидаемая версия машины, 0 отключает проверку
+func (s *Storage) PatchCar(ctx context.Context, carID int, pc car.PatchCar, version int) (int, error) {
 	const op = "storage.postgresql.PatchCar"
 
-	code, err := s.patchOwner(carID, pc.PatchPeople)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.rollback(tx)
+
+	if _, err := s.lockCar(ctx, tx, carID, version); err != nil {
+		if errors.Is(err, storage.ErrCarNotFound) {
+			return -1, fmt.Errorf("%s: %w", op, err)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	before, err := s.snapshotCar(ctx, tx, carID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	code, err := s.applyPatch(ctx, tx, carID, pc, car.SourceManual)
+	if err != nil || code == 2 {
+		return code, err
+	}
+
+	if err := s.recordMutation(ctx, tx, audit.ActionUpdate, carID, before); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.commit(tx); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return 0, nil
+}
+
+// обновляем данные машины из CarInfo и время их получения.
+// Возвращаем false, если данные не изменились
+// version - ожидаемая версия машины, 0 отключает проверку
+func (s *Storage) RefreshCar(ctx context.Context, carID int, c car.Car, version int) (bool, error) {
+	const op = "storage.postgresql.RefreshCar"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.rollback(tx)
+
+	if _, err := s.lockCar(ctx, tx, carID, version); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	before, err := s.snapshotCar(ctx, tx, carID)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// время получения обновляем, даже если данные не изменились
+	_, err = tx.ExecContext(ctx, `UPDATE CARS SET carinfo_fetched_at = now() WHERE id = $1`, carID)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	code, err := s.applyPatch(ctx, tx, carID, car.Diff(*before, c), car.SourceCarInfo)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if code != 2 {
+		if err := s.recordMutation(ctx, tx, audit.ActionRefresh, carID, before); err != nil {
+			return false, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := s.commit(tx); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return code != 2, nil
+}
+
+// применяем патч к заблокированной машине и её владельцу и увеличиваем версию.
+// source - источник новых данных для изменённых записей
+// Возвращаем 2, если патч ничего не меняет
+func (s *Storage) applyPatch(ctx context.Context, tx *sql.Tx, carID int, pc car.PatchCar, source string) (int, error) {
+	const op = "storage.postgresql.applyPatch"
+
+	code, err := s.patchOwner(ctx, tx, carID, pc.PatchPeople, source)
 	if err != nil {
 		return code, err
 	}
@@ -271,77 +804,85 @@ func (s *Storage) PatchCar(carID int, pc car.PatchCar) (int, error) {
 	// Формируем параметры на обновлениие
 	var params []interface{}
 	var sql []string
-	if pc.RegNum.Valid {
+	if pc.RegNum.Set {
 		sql = append(sql, fmt.Sprintf("reg_num = $%d,", len(sql)+1))
-		params = append(params, pc.RegNum.String)
+		params = append(params, pc.RegNum.SQLValue())
 	}
-	if pc.Mark.Valid {
+	if pc.Mark.Set {
 		sql = append(sql, fmt.Sprintf("mark = $%d,", len(sql)+1))
-		params = append(params, pc.Mark.String)
+		params = append(params, pc.Mark.SQLValue())
 	}
-	if pc.Model.Valid {
+	if pc.Model.Set {
 		sql = append(sql, fmt.Sprintf("model = $%d,", len(sql)+1))
-		params = append(params, pc.Model.String)
+		params = append(params, pc.Model.SQLValue())
 	}
-	if pc.Year.Valid {
+	if pc.Year.Set {
 		sql = append(sql, fmt.Sprintf("year = $%d,", len(sql)+1))
-		params = append(params, pc.Year.Int16)
+		params = append(params, pc.Year.SQLValue())
 	}
 
-	if len(sql) == 0 {
+	// нет изменений ни у машины, ни у владельца
+	if len(sql) == 0 && code == 2 {
 		return code, nil
 	}
-	carQuery += strings.Join(sql, " ")
 
-	carQuery = carQuery[:len(carQuery)-1] + fmt.Sprintf(" WHERE id = $%d", len(sql)+1)
-	params = append(params, carID)
+	if len(sql) > 0 {
+		// источником данных машины становится источник патча
+		sql = append(sql, fmt.Sprintf("source = $%d,", len(sql)+1))
+		params = append(params, source)
 
-	result, err := s.db.Exec(carQuery, params...)
-	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+		carQuery += strings.Join(sql, " ")
+
+		carQuery = carQuery[:len(carQuery)-1] + fmt.Sprintf(" WHERE id = $%d", len(sql)+1)
+		params = append(params, carID)
+
+		if _, err := tx.ExecContext(ctx, carQuery, params...); err != nil {
+			if uniqueViolation(err) {
+				return 0, fmt.Errorf("%s: %w", op, storage.ErrCarExists)
+			}
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
+	if err := s.bumpVersion(ctx, tx, carID); err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
-	if rowsAffected == 0 {
-		return -1, fmt.Errorf("%s: %w", op, errors.New("car not found"))
-	}
 
 	return 0, nil
 }
 
 // обновляем данные о владельце
-func (s *Storage) patchOwner(carID int, patchOwner car.PatchPeople) (int, error) {
+func (s *Storage) patchOwner(ctx context.Context, tx *sql.Tx, carID int, patchOwner car.PatchPeople, source string) (int, error) {
 	const op = "storage.postgresql.PatchOwner"
 	ownerQuery := "UPDATE PEOPLES SET "
 
 	// Формируем параметры на обновлениие
 	var params []interface{}
 	var sql []string
-	if patchOwner.Name.Valid {
+	if patchOwner.Name.Set {
 		sql = append(sql, fmt.Sprintf("name = $%d,", len(sql)+1))
-		params = append(params, patchOwner.Name.String)
+		params = append(params, patchOwner.Name.SQLValue())
 	}
-	if patchOwner.Surname.Valid {
+	if patchOwner.Surname.Set {
 		sql = append(sql, fmt.Sprintf("surname = $%d,", len(sql)+1))
-		params = append(params, patchOwner.Surname.String)
+		params = append(params, patchOwner.Surname.SQLValue())
 	}
-	if patchOwner.Patronymic.Valid {
+	if patchOwner.Patronymic.Set {
 		sql = append(sql, fmt.Sprintf("patronymic = $%d,", len(sql)+1))
-		params = append(params, patchOwner.Patronymic.String)
+		params = append(params, patchOwner.Patronymic.SQLValue())
 	}
 
 	if len(sql) == 0 {
 		return 2, nil
 	}
+	sql = append(sql, fmt.Sprintf("source = $%d,", len(sql)+1), "updated_at = now(),")
+	params = append(params, source)
 	ownerQuery += strings.Join(sql, " ")
 
 	ownerQuery = ownerQuery[:len(ownerQuery)-1] + fmt.Sprintf(" WHERE id = (SELECT owner_id FROM CARS WHERE id = $%d)", len(sql)+1)
 	params = append(params, carID)
 
-	result, err := s.db.Exec(ownerQuery, params...)
+	result, err := tx.ExecContext(ctx, ownerQuery, params...)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
@@ -351,9 +892,155 @@ func (s *Storage) patchOwner(carID int, patchOwner car.PatchPeople) (int, error)
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 	if rowsAffected == 0 {
-		return -1, fmt.Errorf("%s: %w", op, errors.New("car not found"))
+		return -1, fmt.Errorf("%s: %w", op, storage.ErrCarNotFound)
 	}
 
 	return 0, nil
 
 }
+
+// полностью заменяем данные о машине и владельце
+// version - ожидаемая версия машины, 0 отключает проверку
+func (s *Storage) ReplaceCar(ctx context.Context, carID int, c car.Car, version int) error {
+	const op = "storage.postgresql.ReplaceCar"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer s.rollback(tx)
+
+	ownerID, err := s.lockCar(ctx, tx, carID, version)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	before, err := s.snapshotCar(ctx, tx, carID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE CARS SET reg_num = $1, mark = $2, model = $3, year = $4, source = $5 WHERE id = $6`,
+		c.RegNum, c.Mark, c.Model, c.Year, car.SourceManual, carID)
+	if err != nil {
+		if uniqueViolation(err) {
+			return fmt.Errorf("%s: %w", op, storage.ErrCarExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE PEOPLES SET name = $1, surname = $2, patronymic = $3, source = $4, updated_at = now() WHERE id = $5`,
+		c.Owner.Name, c.Owner.Surname, c.Owner.Patronymic, car.SourceManual, ownerID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.bumpVersion(ctx, tx, carID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.recordMutation(ctx, tx, audit.ActionReplace, carID, before); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.commit(tx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// резервируем ключ идемпотентности за текущим запросом.
+// Ключи у каждого арендатора свои.
+// Если ключ уже занят и не истёк, возвращаем его запись и false
+func (s *Storage) ReserveIdempotencyKey(ctx context.Context, key, requestHash string, ttl time.Duration) (idempotency.Record, bool, error) {
+	const op = "storage.postgresql.ReserveIdempotencyKey"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// ключ принадлежит клиенту, выполнившему запрос: чужой ответ по тому же ключу не повторяется.
+	// Истёкший ключ можно использовать заново
+	tenantID, subject := ownerTenant(ctx), actor.FromContext(ctx)
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM IDEMPOTENCY_KEYS
+		WHERE tenant_id = $1 AND subject = $2 AND key = $3 AND created_at < now() - $4 * interval '1 second'`,
+		tenantID, subject, key, ttl.Seconds())
+	if err != nil {
+		return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO IDEMPOTENCY_KEYS (tenant_id, subject, key, request_hash) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, subject, key) DO NOTHING`,
+		tenantID, subject, key, requestHash)
+	if err != nil {
+		return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rec := idempotency.Record{Key: key, RequestHash: requestHash}
+	if rowsAffected == 0 {
+		var status sql.NullInt32
+		var contentType sql.NullString
+		var headers []byte
+		err := tx.QueryRowContext(ctx, `SELECT request_hash, completed_at IS NOT NULL, status_code, content_type, headers, body
+			FROM IDEMPOTENCY_KEYS WHERE tenant_id = $1 AND subject = $2 AND key = $3`,
+			tenantID, subject, key).Scan(&rec.RequestHash, &rec.Completed, &status, &contentType, &headers, &rec.Body)
+		if err != nil {
+			return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+		}
+		rec.StatusCode = int(status.Int32)
+		rec.ContentType = contentType.String
+		if headers != nil {
+			if err := json.Unmarshal(headers, &rec.Headers); err != nil {
+				return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return rec, rowsAffected == 1, nil
+}
+
+// сохраняем ответ на запрос с ключом идемпотентности
+func (s *Storage) CompleteIdempotencyKey(ctx context.Context, rec idempotency.Record) error {
+	const op = "storage.postgresql.CompleteIdempotencyKey"
+
+	var headers []byte
+	if len(rec.Headers) > 0 {
+		var err error
+		if headers, err = json.Marshal(rec.Headers); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	_, err := s.db.ExecContext(ctx, `UPDATE IDEMPOTENCY_KEYS SET status_code = $1, content_type = $2, headers = $3, body = $4, completed_at = now()
+		WHERE tenant_id = $5 AND subject = $6 AND key = $7`,
+		rec.StatusCode, rec.ContentType, nullJSON(headers), rec.Body, ownerTenant(ctx), actor.FromContext(ctx), rec.Key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// освобождаем ключ, если запрос не удалось выполнить и его можно повторить
+func (s *Storage) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	const op = "storage.postgresql.ReleaseIdempotencyKey"
+
+	_, err := s.db.ExecContext(ctx, `DELETE FROM IDEMPOTENCY_KEYS WHERE tenant_id = $1 AND subject = $2 AND key = $3 AND completed_at IS NULL`,
+		ownerTenant(ctx), actor.FromContext(ctx), key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
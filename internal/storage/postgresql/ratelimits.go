@@ -0,0 +1,62 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+)
+
+// списываем токены из корзины, общей для всех экземпляров сервиса.
+// Строка корзины блокируется до конца транзакции, время берётся из БД
+func (s *Storage) TakeRateLimit(ctx context.Context, key string, limit ratelimit.Limit, n int) (ratelimit.Result, error) {
+	const op = "storage.postgresql.TakeRateLimit"
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ratelimit.Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO RATE_LIMITS (key, tokens, period) VALUES ($1, $2, $3 * interval '1 second')
+		ON CONFLICT (key) DO NOTHING`, key, limit.Burst, limit.Period.Seconds())
+	if err != nil {
+		return ratelimit.Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var tokens, elapsed float64
+	err = tx.QueryRowContext(ctx, `SELECT tokens, EXTRACT(EPOCH FROM now() - updated_at) FROM RATE_LIMITS WHERE key = $1 FOR UPDATE`,
+		key).Scan(&tokens, &elapsed)
+	if err != nil {
+		return ratelimit.Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	tokens, res := limit.Take(tokens, time.Duration(elapsed*float64(time.Second)), n)
+
+	_, err = tx.ExecContext(ctx, `UPDATE RATE_LIMITS SET tokens = $1, period = $2 * interval '1 second', updated_at = now() WHERE key = $3`,
+		tokens, limit.Period.Seconds(), key)
+	if err != nil {
+		return ratelimit.Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ratelimit.Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return res, nil
+}
+
+// удаляем корзины, которые успели наполниться: новая корзина будет такой же
+func (s *Storage) PurgeRateLimits(ctx context.Context) (int, error) {
+	const op = "storage.postgresql.PurgeRateLimits"
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM RATE_LIMITS WHERE updated_at + period < now()`)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return int(n), nil
+}
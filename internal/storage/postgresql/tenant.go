@@ -0,0 +1,46 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+	"github.com/lib/pq"
+)
+
+// tenantArg возвращает арендатора из контекста для условий вида ($n = пустая строка OR tenant_id = $n).
+// Пустая строка - контекст фоновой задачи без ограничения по арендатору
+func tenantArg(ctx context.Context) string {
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// ownerTenant возвращает арендатора для новых записей
+func ownerTenant(ctx context.Context) string {
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		return tenant.Default
+	}
+	return id
+}
+
+// tenantCondition добавляет условие по арендатору из контекста для колонки column.
+// Номер параметра продолжает args
+func tenantCondition(ctx context.Context, column string, args []any) ([]string, []any) {
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		return nil, args
+	}
+	args = append(args, id)
+	return []string{fmt.Sprintf("%s = $%d", column, len(args))}, args
+}
+
+// uniqueViolation сообщает, что запрос нарушил уникальный индекс
+func uniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
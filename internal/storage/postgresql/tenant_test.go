@@ -0,0 +1,119 @@
+package postgresql
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/tenant"
+)
+
+// Условия по арендатору проверяются без БД, запросы с ними проверяет router.TestTenantIsolation
+
+func TestTenantCondition(t *testing.T) {
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		wantConditions []string
+		wantArgs       []any
+	}{
+		{
+			name:           "no tenant",
+			ctx:            context.Background(),
+			wantConditions: []string{"CARS.tenant_id = $2"},
+			wantArgs:       []any{10, tenant.Default},
+		},
+		{
+			name:           "tenant",
+			ctx:            tenant.WithTenant(context.Background(), "tenant-a"),
+			wantConditions: []string{"CARS.tenant_id = $2"},
+			wantArgs:       []any{10, "tenant-a"},
+		},
+		{
+			name:     "all tenants",
+			ctx:      tenant.WithAll(context.Background()),
+			wantArgs: []any{10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conditions, args := tenantCondition(tt.ctx, "CARS.tenant_id", []any{10})
+			if !reflect.DeepEqual(conditions, tt.wantConditions) {
+				t.Errorf("conditions = %q, want %q", conditions, tt.wantConditions)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestFilterConditionsTenant(t *testing.T) {
+	filter := car.CarFilter{MarkFilter: "Lada", SurnameFilter: "Ivanov"}
+
+	conditions, args := filterConditions(tenant.WithTenant(context.Background(), "tenant-a"), filter, nil)
+	wantConditions := []string{
+		"CARS.tenant_id = $1",
+		"CARS.mark LIKE '%' || $2 || '%'",
+		"PEOPLES.surname LIKE '%' || $3 || '%'",
+		"CARS.deleted_at IS NULL",
+	}
+	if !reflect.DeepEqual(conditions, wantConditions) {
+		t.Errorf("conditions = %q, want %q", conditions, wantConditions)
+	}
+	if want := []any{"tenant-a", "Lada", "Ivanov"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+
+	// условие по арендатору не пропадает и с включёнными удалёнными машинами
+	filter.IncludeDeleted = true
+	conditions, _ = filterConditions(tenant.WithTenant(context.Background(), "tenant-a"), filter, nil)
+	if len(conditions) == 0 || conditions[0] != "CARS.tenant_id = $1" {
+		t.Errorf("include_deleted: conditions = %q, want tenant condition first", conditions)
+	}
+
+	conditions, args = filterConditions(tenant.WithAll(context.Background()), filter, nil)
+	for _, c := range conditions {
+		if c == "CARS.tenant_id = $1" {
+			t.Errorf("all tenants: unexpected tenant condition in %q", conditions)
+		}
+	}
+	if want := []any{"Lada", "Ivanov"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("all tenants: args = %v, want %v", args, want)
+	}
+}
+
+func TestCarCacheTenant(t *testing.T) {
+	cache := newCarCache(time.Minute)
+	cache.put(1, car.CarWithOwner{TenantID: "tenant-a", Version: 3}, cache.generation())
+
+	if _, ok := cache.getTenant(1, "tenant-b"); ok {
+		t.Error("car of tenant-a returned to tenant-b")
+	}
+	if cwo, ok := cache.getTenant(1, "tenant-a"); !ok || cwo.Version != 3 {
+		t.Errorf("getTenant(tenant-a) = %+v, %v, want cached car", cwo, ok)
+	}
+	// фоновые задачи работают без ограничения по арендатору
+	if _, ok := cache.getTenant(1, tenantArg(tenant.WithAll(context.Background()))); !ok {
+		t.Error("car not returned without tenant restriction")
+	}
+	if _, ok := cache.getTenant(2, "tenant-a"); ok {
+		t.Error("got car missing from cache")
+	}
+}
+
+func TestCarCacheStaleGeneration(t *testing.T) {
+	cache := newCarCache(time.Minute)
+
+	// машина прочитана до изменения и не должна попасть в кэш
+	gen := cache.generation()
+	cache.invalidate(1)
+	cache.put(1, car.CarWithOwner{TenantID: "tenant-a"}, gen)
+
+	if _, ok := cache.getTenant(1, "tenant-a"); ok {
+		t.Error("car read before invalidation was cached")
+	}
+}
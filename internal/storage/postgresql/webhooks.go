@@ -0,0 +1,219 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/events"
+	"github.com/P1coFly/CarInfoEM/internal/models/webhook"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/lib/pq"
+)
+
+// кладём событие в очередь доставки каждой подходящей подписки арендатора машины (transactional outbox)
+func (s *Storage) enqueueWebhooks(ctx context.Context, tx *sql.Tx, e events.Event, changes []byte) error {
+	const op = "storage.postgresql.enqueueWebhooks"
+
+	payload, err := json.Marshal(webhook.Payload{EventID: e.ID, Type: e.Type, CarID: e.CarID, Car: e.Car,
+		Changes: changes, OccurredAt: e.CreatedAt})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO WEBHOOK_DELIVERIES (webhook_id, event_id, event_type, payload)
+		SELECT id, $1, $2, $3 FROM WEBHOOKS WHERE tenant_id = $4 AND (cardinality(events) = 0 OR $2 = ANY(events))`,
+		e.ID, e.Type, string(payload), e.TenantID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// создаём подписку
+func (s *Storage) CreateWebhook(ctx context.Context, w webhook.Webhook) (webhook.Webhook, error) {
+	const op = "storage.postgresql.CreateWebhook"
+
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+	err := s.db.QueryRowContext(ctx, `INSERT INTO WEBHOOKS (url, secret, events, tenant_id) VALUES ($1, $2, $3, $4) returning id, created_at`,
+		w.URL, w.Secret, pq.Array(w.Events), ownerTenant(ctx)).Scan(&w.ID, &w.CreatedAt)
+	if err != nil {
+		return webhook.Webhook{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return w, nil
+}
+
+// получаем все подписки без секретов
+func (s *Storage) GetWebhooks(ctx context.Context) ([]webhook.Webhook, error) {
+	const op = "storage.postgresql.GetWebhooks"
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, url, events, created_at FROM WEBHOOKS WHERE ($1 = '' OR tenant_id = $1) ORDER BY id`,
+		tenantArg(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	hooks := []webhook.Webhook{}
+	for rows.Next() {
+		var w webhook.Webhook
+		if err := rows.Scan(&w.ID, &w.URL, pq.Array(&w.Events), &w.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		hooks = append(hooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return hooks, nil
+}
+
+// удаляем подписку вместе с её очередью доставки
+func (s *Storage) DeleteWebhook(ctx context.Context, id int64) error {
+	const op = "storage.postgresql.DeleteWebhook"
+
+	result, err := s.db.ExecContext(ctx, `DELETE FROM WEBHOOKS WHERE id = $1 AND ($2 = '' OR tenant_id = $2)`, id, tenantArg(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrWebhookNotFound)
+	}
+	return nil
+}
+
+// получаем журнал доставок подписки, от новых к старым
+// status - фильтр по статусу, пустой - все
+func (s *Storage) GetWebhookDeliveries(ctx context.Context, webhookID int64, status string, pageSize, pageToken int) ([]webhook.Delivery, error) {
+	const op = "storage.postgresql.GetWebhookDeliveries"
+
+	var exists bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM WEBHOOKS WHERE id = $1 AND ($2 = '' OR tenant_id = $2))`,
+		webhookID, tenantArg(ctx)).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrWebhookNotFound)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id, webhook_id, event_id, event_type, status, attempts, next_attempt_at,
+			last_status_code, last_error, created_at, delivered_at
+		FROM WEBHOOK_DELIVERIES WHERE webhook_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY id DESC LIMIT $3 OFFSET $4`,
+		webhookID, status, pageSize, (pageToken-1)*pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	deliveries := []webhook.Delivery{}
+	for rows.Next() {
+		var d webhook.Delivery
+		var nextAttemptAt time.Time
+		var lastStatusCode sql.NullInt32
+		var lastError sql.NullString
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &nextAttemptAt,
+			&lastStatusCode, &lastError, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		// время следующей попытки имеет смысл только для ожидающих доставок
+		if d.Status == webhook.StatusPending {
+			d.NextAttemptAt = &nextAttemptAt
+		}
+		if lastStatusCode.Valid {
+			code := int(lastStatusCode.Int32)
+			d.LastStatusCode = &code
+		}
+		d.LastError = lastError.String
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return deliveries, nil
+}
+
+// берём в работу доставки, время попытки которых наступило.
+// До lease другие экземпляры сервиса их не возьмут
+func (s *Storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhook.Task, error) {
+	const op = "storage.postgresql.ClaimWebhookDeliveries"
+
+	rows, err := s.db.QueryContext(ctx, `UPDATE WEBHOOK_DELIVERIES d
+		SET next_attempt_at = now() + $2 * interval '1 second'
+		FROM WEBHOOKS w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id FROM WEBHOOK_DELIVERIES
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING d.id, d.webhook_id, d.event_id, d.event_type, d.attempts, d.payload, w.url, w.secret`,
+		limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var tasks []webhook.Task
+	for rows.Next() {
+		var t webhook.Task
+		var payload []byte
+		err := rows.Scan(&t.ID, &t.WebhookID, &t.EventID, &t.EventType, &t.Attempts, &payload, &t.URL, &t.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		t.Status = webhook.StatusPending
+		t.Payload = payload
+		tasks = append(tasks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return tasks, nil
+}
+
+// отмечаем успешную доставку
+func (s *Storage) CompleteWebhookDelivery(ctx context.Context, id int64, statusCode int) error {
+	const op = "storage.postgresql.CompleteWebhookDelivery"
+
+	_, err := s.db.ExecContext(ctx, `UPDATE WEBHOOK_DELIVERIES
+		SET status = 'delivered', attempts = attempts + 1, last_status_code = $2, last_error = NULL, delivered_at = now()
+		WHERE id = $1`, id, statusCode)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// отмечаем неудачную попытку. Нулевой nextAttemptAt означает, что попытки закончились
+// statusCode - код ответа подписчика, 0 если ответа не было
+func (s *Storage) FailWebhookDelivery(ctx context.Context, id int64, statusCode int, lastError string, nextAttemptAt time.Time) error {
+	const op = "storage.postgresql.FailWebhookDelivery"
+
+	status := webhook.StatusPending
+	if nextAttemptAt.IsZero() {
+		status = webhook.StatusFailed
+		nextAttemptAt = time.Now()
+	}
+
+	var code sql.NullInt32
+	if statusCode != 0 {
+		code = sql.NullInt32{Int32: int32(statusCode), Valid: true}
+	}
+
+	_, err := s.db.ExecContext(ctx, `UPDATE WEBHOOK_DELIVERIES
+		SET status = $2, attempts = attempts + 1, last_status_code = $3, last_error = $4, next_attempt_at = $5
+		WHERE id = $1`, id, status, code, lastError, nextAttemptAt)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package storage
+
+import "errors"
+
+var (
+	ErrCarNotFound = errors.New("car not found")
+	// ErrVersionMismatch - версия машины изменилась с момента чтения
+	ErrVersionMismatch = errors.New("car version mismatch")
+	// ErrCarNotDeleted - восстанавливаемая машина не удалена
+	ErrCarNotDeleted = errors.New("car is not deleted")
+	// ErrCarExists - у арендатора уже есть машина с таким гос. номером
+	ErrCarExists       = errors.New("car with this registration number already exists")
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrAPIKeyNotFound  = errors.New("api key not found")
+)
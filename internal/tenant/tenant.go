@@ -0,0 +1,45 @@
+package tenant
+
+import (
+	"context"
+	"regexp"
+)
+
+// Default - арендатор запросов, для которых арендатор не указан, и данных, созданных до разделения
+const Default = "default"
+
+var idRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Valid сообщает, подходит ли строка как идентификатор арендатора
+func Valid(id string) bool {
+	return idRe.MatchString(id)
+}
+
+type ctxKey struct{}
+
+// allTenants - значение в контексте фоновых задач, работающих с данными всех арендаторов
+const allTenants = "*"
+
+// WithTenant сохраняет в контексте арендатора, которым хранилище ограничивает все запросы
+func WithTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// WithAll снимает ограничение по арендатору для фоновых задач: очистки, синхронизации с CarInfo, рассылки событий.
+// Записи, которые они изменяют, остаются у своих арендаторов
+func WithAll(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKey{}, allTenants)
+}
+
+// FromContext возвращает арендатора запроса, по умолчанию Default.
+// false означает, что контекст не ограничен арендатором (WithAll)
+func FromContext(ctx context.Context) (string, bool) {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	switch id {
+	case "":
+		return Default, true
+	case allTenants:
+		return "", false
+	}
+	return id, true
+}
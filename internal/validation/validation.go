@@ -0,0 +1,164 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/go-playground/validator/v10"
+	"github.com/guregu/null/v5"
+)
+
+// MinYear - год выпуска первого серийного автомобиля
+const MinYear = 1886
+
+// допустимые буквы в гос. номере: кириллица и совпадающая с ней по написанию латиница
+const plateLetters = "ABEKMHOPCTYXАВЕКМНОРСТУХ"
+
+var plateRe = regexp.MustCompile(`^[` + plateLetters + `]\d{3}[` + plateLetters + `]{2}\d{2,3}$`)
+
+// Violation - нарушение правила валидации
+type Violation struct {
+	// Field - путь к полю в JSON, например owner.name или regNums[0]
+	Field   string
+	Message string
+}
+
+// embeddedName - сегмент пути встроенной структуры, убирается из пути к полю
+const embeddedName = "-embedded-"
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	// в путях к полям используем имена из JSON
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		// поля встроенной структуры без имени в JSON лежат на уровне родителя,
+		// пустое имя validator заменил бы именем типа
+		if name == "" && f.Anonymous {
+			return embeddedName
+		}
+		return name
+	})
+
+	// null-типы и поля патча проверяем как указатели: отсутствующее значение - nil,
+	// чтобы omitnil пропускал только его, а не пустую строку
+	v.RegisterCustomTypeFunc(func(field reflect.Value) interface{} {
+		switch n := field.Interface().(type) {
+		case null.String:
+			return n.Ptr()
+		case null.Int16:
+			return n.Ptr()
+		case car.PatchField[string]:
+			return n.ValuePtr()
+		case car.PatchField[int16]:
+			return n.ValuePtr()
+		}
+		return nil
+	}, null.String{}, null.Int16{}, car.PatchField[string]{}, car.PatchField[int16]{})
+
+	// notnull запрещает явный null в поле патча.
+	// Значение уже преобразовано в указатель, поэтому смотрим на исходное поле
+	v.RegisterValidation("notnull", func(fl validator.FieldLevel) bool {
+		field := fl.Parent().FieldByName(fl.StructFieldName())
+		n, ok := field.Interface().(interface{ IsNull() bool })
+		return !ok || !n.IsNull()
+	}, true)
+
+	v.RegisterValidation("regnum", func(fl validator.FieldLevel) bool {
+		return plateRe.MatchString(fl.Field().String())
+	})
+
+	v.RegisterValidation("caryear", func(fl validator.FieldLevel) bool {
+		year := fl.Field().Int()
+		return year >= MinYear && year <= int64(maxYear())
+	})
+
+	return v
+}
+
+// год выпуска не может быть больше следующего года
+func maxYear() int {
+	return time.Now().Year() + 1
+}
+
+// Struct проверяет структуру по тегам validate и возвращает все нарушения
+func Struct(s any) ([]Violation, error) {
+	err := validate.Struct(s)
+	if err == nil {
+		return nil, nil
+	}
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return nil, err
+	}
+
+	violations := make([]Violation, 0, len(verrs))
+	for _, fe := range verrs {
+		violations = append(violations, Violation{Field: fieldPath(fe.Namespace()), Message: message(fe)})
+	}
+	return violations, nil
+}
+
+// убираем имя корневой структуры и пустые сегменты встроенных структур
+func fieldPath(namespace string) string {
+	parts := strings.Split(namespace, ".")
+	var path []string
+	for _, p := range parts[1:] {
+		if p != "" && p != embeddedName {
+			path = append(path, p)
+		}
+	}
+	return strings.Join(path, ".")
+}
+
+func message(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		if fe.Kind() == reflect.Slice {
+			return fmt.Sprintf("must contain at least %s items", fe.Param())
+		}
+		if isNumber(fe.Kind()) {
+			return fmt.Sprintf("must be at least %s", fe.Param())
+		}
+		if fe.Param() == "1" {
+			return "must not be empty"
+		}
+		return fmt.Sprintf("must be at least %s characters long", fe.Param())
+	case "max":
+		if fe.Kind() == reflect.Slice {
+			return fmt.Sprintf("must contain at most %s items", fe.Param())
+		}
+		if isNumber(fe.Kind()) {
+			return fmt.Sprintf("must be at most %s", fe.Param())
+		}
+		return fmt.Sprintf("must be at most %s characters long", fe.Param())
+	case "notnull":
+		return "must not be null"
+	case "oneof":
+		return "must be one of: " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "http_url":
+		return "must be an http or https URL"
+	case "regnum":
+		return "must be a registration number like X123XX150"
+	case "caryear":
+		return fmt.Sprintf("must be between %d and %d", MinYear, maxYear())
+	}
+	return fmt.Sprintf("failed on the %q rule", fe.Tag())
+}
+
+func isNumber(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
@@ -0,0 +1,8 @@
+CREATE TABLE RATE_LIMITS
+(
+    key text NOT NULL,
+    tokens double precision NOT NULL,
+    period interval NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (key)
+);
@@ -0,0 +1,19 @@
+ALTER TABLE IDEMPOTENCY_KEYS DROP CONSTRAINT idempotency_keys_pkey;
+DELETE FROM IDEMPOTENCY_KEYS WHERE tenant_id <> 'default';
+ALTER TABLE IDEMPOTENCY_KEYS DROP COLUMN tenant_id;
+ALTER TABLE IDEMPOTENCY_KEYS ADD PRIMARY KEY (key);
+
+ALTER TABLE API_KEYS DROP COLUMN tenant_id;
+ALTER TABLE WEBHOOKS DROP COLUMN tenant_id;
+
+DROP INDEX IF EXISTS car_events_tenant_id_idx;
+ALTER TABLE CAR_EVENTS DROP COLUMN tenant_id;
+
+DROP INDEX IF EXISTS audit_log_tenant_id_idx;
+ALTER TABLE AUDIT_LOG DROP COLUMN tenant_id;
+
+DROP INDEX IF EXISTS cars_tenant_reg_num_idx;
+DROP INDEX IF EXISTS cars_tenant_id_idx;
+ALTER TABLE CARS DROP COLUMN tenant_id;
+
+ALTER TABLE PEOPLES DROP COLUMN tenant_id;
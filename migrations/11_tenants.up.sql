@@ -0,0 +1,30 @@
+-- существующие данные относятся к арендатору по умолчанию,
+-- после заполнения значение по умолчанию убираем, чтобы арендатор всегда указывался явно
+ALTER TABLE PEOPLES ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE PEOPLES ALTER COLUMN tenant_id DROP DEFAULT;
+
+ALTER TABLE CARS ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE CARS ALTER COLUMN tenant_id DROP DEFAULT;
+CREATE INDEX cars_tenant_id_idx ON CARS (tenant_id, id);
+-- гос. номер уникален среди машин арендатора, удалённые машины не учитываются.
+-- Повторяющиеся номера, добавленные до миграции, нужно удалить заранее, иначе индекс не создастся
+CREATE UNIQUE INDEX cars_tenant_reg_num_idx ON CARS (tenant_id, reg_num) WHERE deleted_at IS NULL;
+
+ALTER TABLE AUDIT_LOG ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE AUDIT_LOG ALTER COLUMN tenant_id DROP DEFAULT;
+CREATE INDEX audit_log_tenant_id_idx ON AUDIT_LOG (tenant_id, id);
+
+ALTER TABLE CAR_EVENTS ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE CAR_EVENTS ALTER COLUMN tenant_id DROP DEFAULT;
+CREATE INDEX car_events_tenant_id_idx ON CAR_EVENTS (tenant_id, id);
+
+ALTER TABLE WEBHOOKS ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE WEBHOOKS ALTER COLUMN tenant_id DROP DEFAULT;
+
+ALTER TABLE API_KEYS ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE API_KEYS ALTER COLUMN tenant_id DROP DEFAULT;
+
+ALTER TABLE IDEMPOTENCY_KEYS ADD COLUMN tenant_id text NOT NULL DEFAULT 'default';
+ALTER TABLE IDEMPOTENCY_KEYS ALTER COLUMN tenant_id DROP DEFAULT;
+ALTER TABLE IDEMPOTENCY_KEYS DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE IDEMPOTENCY_KEYS ADD PRIMARY KEY (tenant_id, key);
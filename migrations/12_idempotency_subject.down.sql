@@ -0,0 +1,5 @@
+ALTER TABLE IDEMPOTENCY_KEYS DROP CONSTRAINT idempotency_keys_pkey;
+DELETE FROM IDEMPOTENCY_KEYS;
+ALTER TABLE IDEMPOTENCY_KEYS DROP COLUMN headers;
+ALTER TABLE IDEMPOTENCY_KEYS DROP COLUMN subject;
+ALTER TABLE IDEMPOTENCY_KEYS ADD PRIMARY KEY (tenant_id, key);
@@ -0,0 +1,7 @@
+-- ключ идемпотентности принадлежит клиенту, выполнившему запрос.
+-- Для сохранённых ответов клиент не известен, поэтому они удаляются
+DELETE FROM IDEMPOTENCY_KEYS;
+ALTER TABLE IDEMPOTENCY_KEYS ADD COLUMN subject text NOT NULL;
+ALTER TABLE IDEMPOTENCY_KEYS ADD COLUMN headers jsonb;
+ALTER TABLE IDEMPOTENCY_KEYS DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE IDEMPOTENCY_KEYS ADD PRIMARY KEY (tenant_id, subject, key);
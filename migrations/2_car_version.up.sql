@@ -0,0 +1,3 @@
+ALTER TABLE CARS
+    ADD COLUMN version integer NOT NULL DEFAULT 1,
+    ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
@@ -0,0 +1,11 @@
+CREATE TABLE IDEMPOTENCY_KEYS
+(
+    key text NOT NULL,
+    request_hash text NOT NULL,
+    status_code integer,
+    content_type text,
+    body bytea,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    completed_at timestamptz,
+    PRIMARY KEY (key)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE AUDIT_LOG
+(
+    id bigserial NOT NULL,
+    car_id bigint NOT NULL,
+    action text NOT NULL,
+    actor text NOT NULL,
+    request_id text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    before jsonb,
+    after jsonb,
+    diff jsonb NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX audit_log_car_id_idx ON AUDIT_LOG (car_id, id);
+CREATE INDEX audit_log_actor_idx ON AUDIT_LOG (actor, created_at);
+CREATE INDEX audit_log_created_at_idx ON AUDIT_LOG (created_at);
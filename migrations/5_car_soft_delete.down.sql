@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS cars_deleted_at_idx;
+ALTER TABLE CARS DROP COLUMN IF EXISTS deleted_at;
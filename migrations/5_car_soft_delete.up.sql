@@ -0,0 +1,3 @@
+ALTER TABLE CARS ADD COLUMN deleted_at timestamptz;
+
+CREATE INDEX cars_deleted_at_idx ON CARS (deleted_at) WHERE deleted_at IS NOT NULL;
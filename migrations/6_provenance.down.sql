@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS cars_updated_at_idx;
+
+ALTER TABLE PEOPLES
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS source;
+
+ALTER TABLE CARS
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS source,
+    DROP COLUMN IF EXISTS carinfo_fetched_at;
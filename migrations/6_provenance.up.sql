@@ -0,0 +1,14 @@
+ALTER TABLE CARS
+    ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN source text NOT NULL DEFAULT 'carinfo' CHECK (source IN ('carinfo', 'manual', 'import')),
+    ADD COLUMN carinfo_fetched_at timestamptz;
+
+-- у существующих машин точное время неизвестно, берём время последнего изменения
+UPDATE CARS SET created_at = updated_at, carinfo_fetched_at = updated_at;
+
+ALTER TABLE PEOPLES
+    ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN source text NOT NULL DEFAULT 'carinfo' CHECK (source IN ('carinfo', 'manual', 'import'));
+
+CREATE INDEX cars_updated_at_idx ON CARS (updated_at);
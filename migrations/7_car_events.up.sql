@@ -0,0 +1,9 @@
+CREATE TABLE CAR_EVENTS
+(
+    id bigserial NOT NULL,
+    car_id bigint NOT NULL,
+    type text NOT NULL,
+    car jsonb NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
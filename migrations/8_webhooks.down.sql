@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS WEBHOOK_DELIVERIES;
+DROP TABLE IF EXISTS WEBHOOKS;
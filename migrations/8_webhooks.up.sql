@@ -0,0 +1,30 @@
+CREATE TABLE WEBHOOKS
+(
+    id bigserial NOT NULL,
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text[] NOT NULL DEFAULT '{}',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE WEBHOOK_DELIVERIES
+(
+    id bigserial NOT NULL,
+    webhook_id bigint NOT NULL,
+    event_id bigint NOT NULL,
+    event_type text NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL DEFAULT now(),
+    last_status_code integer,
+    last_error text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    delivered_at timestamptz,
+    PRIMARY KEY (id),
+    FOREIGN KEY (webhook_id) REFERENCES WEBHOOKS(id) ON DELETE CASCADE
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON WEBHOOK_DELIVERIES (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_webhook_idx ON WEBHOOK_DELIVERIES (webhook_id, id);
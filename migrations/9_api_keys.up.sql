@@ -0,0 +1,13 @@
+CREATE TABLE API_KEYS
+(
+    id bigserial NOT NULL,
+    name text NOT NULL,
+    prefix text NOT NULL,
+    key_hash text NOT NULL,
+    scopes text[] NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    last_used_at timestamptz,
+    revoked_at timestamptz,
+    PRIMARY KEY (id),
+    UNIQUE (prefix)
+);
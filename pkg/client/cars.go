@@ -0,0 +1,309 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Owner - владелец машины
+type Owner struct {
+	Name       string    `json:"name"`
+	Surname    string    `json:"surname"`
+	Patronymic *string   `json:"patronymic"`
+	Source     string    `json:"source"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Car - машина вместе с владельцем
+type Car struct {
+	ID               int        `json:"id"`
+	RegNum           string     `json:"regNum"`
+	Mark             string     `json:"mark"`
+	Model            string     `json:"model"`
+	Year             *int       `json:"year"`
+	Source           string     `json:"source"`
+	CarInfoFetchedAt *time.Time `json:"carinfoFetchedAt"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	UpdatedAt        time.Time  `json:"updatedAt"`
+	Owner            Owner      `json:"owner"`
+	// DeletedAt заполнено только у удалённых машин
+	DeletedAt *time.Time `json:"deletedAt"`
+	// Version - версия из ETag, передаётся в PatchCar и DeleteCar. Заполняется только GetCar
+	Version int `json:"-"`
+}
+
+// FailedCar - номер, который не удалось добавить
+type FailedCar struct {
+	RegNum  string `json:"regNum"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AddResult - результат AddCars
+type AddResult struct {
+	CarIDs []int       `json:"carIds"`
+	Failed []FailedCar `json:"failed"`
+}
+
+// AddCars получает данные машин по номерам из CarInfo и сохраняет их.
+// Номера, которые не удалось добавить, перечислены в Failed.
+// Если не добавлен ни один номер, возвращается *Error.
+// Непустой idempotencyKey позволяет безопасно повторить запрос
+func (c *Client) AddCars(ctx context.Context, regNums []string, idempotencyKey string) (AddResult, error) {
+	header := http.Header{}
+	if idempotencyKey != "" {
+		header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	var resp struct {
+		Data AddResult `json:"data"`
+	}
+	_, err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   "/cars",
+		body:   map[string][]string{"regNums": regNums},
+		header: header,
+	}, &resp)
+	if err != nil {
+		return AddResult{}, err
+	}
+	return resp.Data, nil
+}
+
+// ListOptions - фильтры и размер страницы ListCars, пустые поля не учитываются
+type ListOptions struct {
+	// PageSize - размер страницы, по умолчанию 100
+	PageSize int
+	RegNum   string
+	Mark     string
+	Model    string
+	// Year - диапазон годов в формате start:end
+	Year            string
+	OwnerName       string
+	OwnerSurname    string
+	OwnerPatronymic string
+	UpdatedSince    time.Time
+	IncludeDeleted  bool
+}
+
+func (o ListOptions) query(page int) url.Values {
+	q := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if o.PageSize > 0 {
+		q.Set("page_size", strconv.Itoa(o.PageSize))
+	}
+	q.Set("page_token", strconv.Itoa(page))
+	set("reg_num", o.RegNum)
+	set("mark", o.Mark)
+	set("model", o.Model)
+	set("year", o.Year)
+	set("name", o.OwnerName)
+	set("surname", o.OwnerSurname)
+	set("patronymic", o.OwnerPatronymic)
+	if !o.UpdatedSince.IsZero() {
+		q.Set("updated_since", o.UpdatedSince.Format(time.RFC3339))
+	}
+	if o.IncludeDeleted {
+		q.Set("include_deleted", "true")
+	}
+	return q
+}
+
+// Page - страница списка машин
+type Page struct {
+	Cars     []Car
+	Total    int
+	Page     int
+	LastPage int
+}
+
+// ListCarsPage возвращает одну страницу списка машин, страницы нумеруются с 1
+func (c *Client) ListCarsPage(ctx context.Context, opts ListOptions, page int) (Page, error) {
+	var resp struct {
+		Data []Car `json:"data"`
+		Meta struct {
+			Total    int `json:"total"`
+			Page     int `json:"page"`
+			LastPage int `json:"lastPage"`
+		} `json:"meta"`
+	}
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/cars", query: opts.query(page)}, &resp)
+	if err != nil {
+		return Page{}, err
+	}
+	return Page{Cars: resp.Data, Total: resp.Meta.Total, Page: resp.Meta.Page, LastPage: resp.Meta.LastPage}, nil
+}
+
+// ListCars возвращает итератор по всем машинам, страницы запрашиваются по мере чтения:
+//
+//	it := c.ListCars(ctx, client.ListOptions{Mark: "Lada"})
+//	for it.Next() {
+//		car := it.Car()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+func (c *Client) ListCars(ctx context.Context, opts ListOptions) *CarIterator {
+	return &CarIterator{ctx: ctx, client: c, opts: opts}
+}
+
+// CarIterator - итератор по машинам ListCars
+type CarIterator struct {
+	ctx    context.Context
+	client *Client
+	opts   ListOptions
+
+	page    int
+	buf     []Car
+	current Car
+	done    bool
+	err     error
+}
+
+// Next переходит к следующей машине, false - машины кончились или произошла ошибка
+func (it *CarIterator) Next() bool {
+	for len(it.buf) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.page++
+		p, err := it.client.ListCarsPage(it.ctx, it.opts, it.page)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.buf = p.Cars
+		if p.Page >= p.LastPage || len(p.Cars) == 0 {
+			it.done = true
+		}
+	}
+	it.current, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Car возвращает текущую машину
+func (it *CarIterator) Car() Car {
+	return it.current
+}
+
+// Err возвращает ошибку, на которой остановился итератор
+func (it *CarIterator) Err() error {
+	return it.err
+}
+
+// GetCar возвращает машину по id вместе с её версией
+func (c *Client) GetCar(ctx context.Context, id int) (Car, error) {
+	var resp struct {
+		Data Car `json:"data"`
+	}
+	httpResp, err := c.do(ctx, request{method: http.MethodGet, path: "/cars/" + strconv.Itoa(id)}, &resp)
+	if err != nil {
+		return Car{}, err
+	}
+	resp.Data.Version = versionFromETag(httpResp.Header.Get("ETag"))
+	return resp.Data, nil
+}
+
+// versionFromETag возвращает версию из ETag вида W/"<версия>-<вариант представления>", 0 - ETag не разобран
+func versionFromETag(tag string) int {
+	v, _, _ := strings.Cut(strings.Trim(strings.TrimPrefix(tag, "W/"), `"`), "-")
+	version, _ := strconv.Atoi(v)
+	return version
+}
+
+// Field - поле патча: не передано, передано со значением или очищается
+type Field[T any] struct {
+	set   bool
+	null  bool
+	value T
+}
+
+// Set возвращает поле патча с новым значением
+func Set[T any](v T) Field[T] {
+	return Field[T]{set: true, value: v}
+}
+
+// Null возвращает поле патча, очищающее значение. Допустимо для Year и Patronymic
+func Null[T any]() Field[T] {
+	return Field[T]{set: true, null: true}
+}
+
+func (f Field[T]) add(m map[string]any, key string) {
+	if !f.set {
+		return
+	}
+	if f.null {
+		m[key] = nil
+		return
+	}
+	m[key] = f.value
+}
+
+// CarPatch - изменения машины, не заданные поля не меняются
+type CarPatch struct {
+	RegNum          Field[string]
+	Mark            Field[string]
+	Model           Field[string]
+	Year            Field[int]
+	OwnerName       Field[string]
+	OwnerSurname    Field[string]
+	OwnerPatronymic Field[string]
+}
+
+func (p CarPatch) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any)
+	p.RegNum.add(m, "regNum")
+	p.Mark.add(m, "mark")
+	p.Model.add(m, "model")
+	p.Year.add(m, "year")
+
+	owner := make(map[string]any)
+	p.OwnerName.add(owner, "name")
+	p.OwnerSurname.add(owner, "surname")
+	p.OwnerPatronymic.add(owner, "patronymic")
+	if len(owner) > 0 {
+		m["owner"] = owner
+	}
+	return json.Marshal(m)
+}
+
+// PatchCar изменяет поля машины.
+// version - версия из GetCar, при несовпадении возвращается ошибка ErrVersionMismatch; 0 - без проверки
+func (c *Client) PatchCar(ctx context.Context, id int, patch CarPatch, version int) error {
+	_, err := c.do(ctx, request{
+		method: http.MethodPatch,
+		path:   "/cars/" + strconv.Itoa(id),
+		body:   patch,
+		header: ifMatch(version),
+	}, nil)
+	return err
+}
+
+// DeleteCar удаляет машину, до окончательной очистки её можно восстановить.
+// version - версия из GetCar, 0 - без проверки
+func (c *Client) DeleteCar(ctx context.Context, id int, version int) error {
+	_, err := c.do(ctx, request{
+		method: http.MethodDelete,
+		path:   "/cars/" + strconv.Itoa(id),
+		header: ifMatch(version),
+	}, nil)
+	return err
+}
+
+func ifMatch(version int) http.Header {
+	header := http.Header{}
+	if version > 0 {
+		header.Set("If-Match", fmt.Sprintf("%q", strconv.Itoa(version)))
+	}
+	return header
+}
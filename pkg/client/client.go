@@ -0,0 +1,248 @@
+// Package client - клиент REST API каталога автомобилей (/api/v1)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIPrefix - префикс версионированного API, с которым работает клиент
+const APIPrefix = "/api/v1"
+
+const problemContentType = "application/problem+json"
+
+// Client - клиент API. Безопасен для одновременного использования из нескольких горутин
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+}
+
+// Option - настройка клиента
+type Option func(*Client)
+
+// WithHTTPClient задаёт HTTP клиент, по умолчанию используется клиент с таймаутом 30 секунд
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithToken задаёт ключ API, он передаётся в Authorization: Bearer.
+// Имя ключа записывается исполнителем в журнал изменений
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New создаёт клиент для сервиса по адресу baseURL, например http://localhost:8080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Коды ошибок сервера, значение Error.Code
+const (
+	CodeBadRequest           = "bad_request"
+	CodeInvalidBody          = "invalid_body"
+	CodeInvalidParam         = "invalid_param"
+	CodeValidation           = "validation_failed"
+	CodeNotFound             = "not_found"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeConflict             = "conflict"
+	CodePreconditionFailed   = "precondition_failed"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeRateLimited          = "rate_limited"
+	CodeInternal             = "internal"
+	CodeCarInfo              = "carinfo_failed"
+	CodeStorage              = "storage_failed"
+)
+
+// Ошибки для проверки через errors.Is
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrVersionMismatch - машину изменили после чтения версии, её нужно перечитать
+	ErrVersionMismatch = errors.New("version mismatch")
+	ErrValidation      = errors.New("validation failed")
+	// ErrUnauthorized - ключ API не передан, неверен или у него нет нужного права
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrRateLimited - превышен лимит запросов, повторить можно через RetryAfter
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// FieldError - ошибка валидации поля
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error - ошибка, которую вернул сервер (RFC 7807)
+type Error struct {
+	StatusCode int
+	// Code - код ошибки из type, например not_found
+	Code      string
+	Title     string
+	Detail    string
+	RequestID string
+	Fields    []FieldError
+	// RetryAfter - когда можно повторить запрос после 429, из заголовка Retry-After
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("carinfo api: %d %s", e.StatusCode, e.Code)
+	// в Detail сервер уже перечисляет ошибки полей
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// Is сопоставляет ошибку с ErrNotFound, ErrVersionMismatch, ErrValidation, ErrUnauthorized и ErrRateLimited
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Code == CodeNotFound
+	case ErrVersionMismatch:
+		return e.Code == CodePreconditionFailed
+	case ErrValidation:
+		return e.Code == CodeValidation
+	case ErrUnauthorized:
+		return e.Code == CodeUnauthorized || e.Code == CodeForbidden
+	case ErrRateLimited:
+		return e.Code == CodeRateLimited
+	}
+	return false
+}
+
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	RequestID string       `json:"requestId"`
+	Errors    []FieldError `json:"errors"`
+}
+
+// request - параметры запроса к API
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   any
+	header http.Header
+}
+
+// do отправляет запрос и разбирает ответ в out, если он передан.
+// Ответ с кодом не 2xx возвращается как *Error
+func (c *Client) do(ctx context.Context, req request, out any) (*http.Response, error) {
+	u := c.baseURL + APIPrefix + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	var body io.Reader
+	if req.body != nil {
+		b, err := json.Marshal(req.body)
+		if err != nil {
+			return nil, fmt.Errorf("carinfo api: encode request: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("carinfo api: %w", err)
+	}
+	for k, v := range req.header {
+		httpReq.Header[k] = v
+	}
+	if req.body != nil && httpReq.Header.Get("Content-Type") == "" {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("carinfo api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, decodeError(resp)
+	}
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("carinfo api: decode response: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode, Code: codeFromStatus(resp.StatusCode)}
+	if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(sec) * time.Second
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var p problem
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), problemContentType) && json.Unmarshal(body, &p) == nil {
+		if i := strings.LastIndex(p.Type, "/"); i >= 0 && i < len(p.Type)-1 {
+			apiErr.Code = p.Type[i+1:]
+		}
+		apiErr.Title = p.Title
+		apiErr.Detail = p.Detail
+		apiErr.RequestID = p.RequestID
+		apiErr.Fields = p.Errors
+		return apiErr
+	}
+
+	apiErr.Detail = strings.TrimSpace(string(body))
+	return apiErr
+}
+
+// код ошибки для ответов не в формате RFC 7807, например от прокси
+func codeFromStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusUnprocessableEntity:
+		return CodeValidation
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
@@ -0,0 +1,496 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/P1coFly/CarInfoEM/http-server/router"
+	"github.com/P1coFly/CarInfoEM/http-server/schema"
+	"github.com/P1coFly/CarInfoEM/internal/auth"
+	"github.com/P1coFly/CarInfoEM/internal/models/car"
+	"github.com/P1coFly/CarInfoEM/internal/models/idempotency"
+	"github.com/P1coFly/CarInfoEM/internal/ratelimit"
+	"github.com/P1coFly/CarInfoEM/internal/storage"
+	"github.com/P1coFly/CarInfoEM/pkg/client"
+	"github.com/guregu/null/v5"
+)
+
+const testToken = "client-test-admin-token-0123456789"
+
+// readerToken - клиент без owners:read, владельцы ему отдаются замаскированными
+const readerToken = "client-test-reader-token-0123456789"
+
+// memStorage - хранилище в памяти с методами, которые вызывают тесты клиента.
+// Остальные методы router.Storage не реализованы и паникуют
+type memStorage struct {
+	router.Storage
+
+	mu     sync.Mutex
+	nextID int
+	cars   map[int]car.CarWithOwner
+	keys   map[string]idempotency.Record
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{cars: map[int]car.CarWithOwner{}, keys: map[string]idempotency.Record{}}
+}
+
+func (s *memStorage) ReserveIdempotencyKey(ctx context.Context, key, requestHash string, ttl time.Duration) (idempotency.Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.keys[key]; ok {
+		return rec, false, nil
+	}
+	rec := idempotency.Record{Key: key, RequestHash: requestHash}
+	s.keys[key] = rec
+	return rec, true, nil
+}
+
+func (s *memStorage) CompleteIdempotencyKey(ctx context.Context, rec idempotency.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[rec.Key] = rec
+	return nil
+}
+
+func (s *memStorage) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+	return nil
+}
+
+func (s *memStorage) AddCar(ctx context.Context, c car.Car, source string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	now := time.Now().UTC()
+	cwo := car.CarWithOwner{Id: s.nextID, RegNum: c.RegNum, Mark: c.Mark, Model: c.Model, Year: c.Year,
+		Source: source, CreatedAt: now, UpdatedAt: now, Version: 1}
+	cwo.People = c.Owner
+	cwo.Owner.Source, cwo.Owner.CreatedAt, cwo.Owner.UpdatedAt = source, now, now
+	s.cars[cwo.Id] = cwo
+	return cwo.Id, nil
+}
+
+func (s *memStorage) GetCars(ctx context.Context, pageSize, pageToken int, carFilter car.CarFilter, fields []string) ([]car.CarWithOwner, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int, 0, len(s.cars))
+	for id := range s.cars {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	cars := []car.CarWithOwner{}
+	for i := (pageToken - 1) * pageSize; i < len(ids) && len(cars) < pageSize; i++ {
+		cars = append(cars, s.cars[ids[i]])
+	}
+	return cars, nil
+}
+
+func (s *memStorage) GetTotalCarsCount(ctx context.Context, carFilter car.CarFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.cars), nil
+}
+
+func (s *memStorage) GetCar(ctx context.Context, carID int, fields []string, includeDeleted bool) (car.CarWithOwner, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cwo, ok := s.cars[carID]
+	if !ok {
+		return car.CarWithOwner{}, fmt.Errorf("memStorage.GetCar: %w", storage.ErrCarNotFound)
+	}
+	return cwo, nil
+}
+
+func (s *memStorage) PatchCar(ctx context.Context, carID int, pc car.PatchCar, version int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cwo, ok := s.cars[carID]
+	if !ok {
+		return -1, fmt.Errorf("memStorage.PatchCar: %w", storage.ErrCarNotFound)
+	}
+	if version != 0 && version != cwo.Version {
+		return 0, fmt.Errorf("memStorage.PatchCar: %w", storage.ErrVersionMismatch)
+	}
+
+	if pc.Mark.Set {
+		cwo.Mark = pc.Mark.Value
+	}
+	if pc.Model.Set {
+		cwo.Model = pc.Model.Value
+	}
+	cwo.Version++
+	cwo.UpdatedAt = time.Now().UTC()
+	s.cars[carID] = cwo
+	return 0, nil
+}
+
+// fakeCarInfo отвечает одной и той же машиной на любой номер и считает запросы
+type fakeCarInfo struct {
+	calls atomic.Int32
+}
+
+func (c *fakeCarInfo) Get(regNum string) (car.Car, int, error) {
+	c.calls.Add(1)
+	return *car.New(regNum, "Lada", "Vesta", null.Int16From(2015), "Ivan", "Ivanov", null.StringFrom("Ivanovich")), 200, nil
+}
+
+type testServer struct {
+	srv     *httptest.Server
+	client  *client.Client
+	storage *memStorage
+	carInfo *fakeCarInfo
+	// listCalls - сколько раз запрошен список машин
+	listCalls atomic.Int32
+}
+
+// newTestServer поднимает настоящий router на httptest сервере.
+// limits - лимиты запросов, nil - без ограничений
+func newTestServer(t *testing.T, limits map[ratelimit.Budget]ratelimit.Limit) *testServer {
+	t.Helper()
+
+	ts := &testServer{storage: newMemStorage(), carInfo: &fakeCarInfo{}}
+
+	opts := router.Options{
+		DefaultSchema:  schema.V2,
+		IdempotencyTTL: time.Hour,
+		Authenticator: auth.Chain(
+			auth.NewStatic(testToken, auth.Principal{Subject: "test", Scopes: []string{auth.ScopeAdmin}}),
+			auth.NewStatic(readerToken, auth.Principal{Subject: "reader", Scopes: []string{auth.ScopeCarsRead, auth.ScopeCarsWrite}}),
+		),
+	}
+	if limits != nil {
+		opts.Limiter = ratelimit.New(ratelimit.NewMemoryStore(), limits)
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := router.New(log, ts.storage, ts.carInfo, nil, opts)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == client.APIPrefix+"/cars" {
+			ts.listCalls.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	ts.srv = srv
+	ts.client = client.New(srv.URL, client.WithToken(testToken), client.WithHTTPClient(srv.Client()))
+	return ts
+}
+
+// seed добавляет машины напрямую в хранилище
+func (ts *testServer) seed(t *testing.T, n int) []int {
+	t.Helper()
+
+	ids := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := ts.storage.AddCar(context.Background(),
+			*car.New(fmt.Sprintf("A%03dAA77", i), "Lada", "Vesta", null.Int16{}, "Ivan", "Ivanov", null.String{}), car.SourceManual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestAddCarsIdempotencyKeyReplay(t *testing.T) {
+	ts := newTestServer(t, nil)
+	ctx := context.Background()
+
+	first, err := ts.client.AddCars(ctx, []string{"A001AA77", "B002BB77"}, "add-1")
+	if err != nil {
+		t.Fatalf("AddCars: %v", err)
+	}
+	if len(first.CarIDs) != 2 || len(first.Failed) != 0 {
+		t.Fatalf("AddCars = %+v, want 2 cars without failures", first)
+	}
+
+	// повтор с тем же ключом отдаёт сохранённый ответ и ничего не добавляет
+	replay, err := ts.client.AddCars(ctx, []string{"A001AA77", "B002BB77"}, "add-1")
+	if err != nil {
+		t.Fatalf("replayed AddCars: %v", err)
+	}
+	if !slices.Equal(replay.CarIDs, first.CarIDs) {
+		t.Errorf("replayed car ids = %v, want %v", replay.CarIDs, first.CarIDs)
+	}
+	if n := ts.carInfo.calls.Load(); n != 2 {
+		t.Errorf("CarInfo called %d times, want 2", n)
+	}
+	if n := len(ts.storage.cars); n != 2 {
+		t.Errorf("storage has %d cars, want 2", n)
+	}
+
+	// тот же ключ с другими номерами - ошибка клиента
+	_, err = ts.client.AddCars(ctx, []string{"C003CC77"}, "add-1")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != client.CodeIdempotencyKeyReused {
+		t.Errorf("AddCars with reused key: err = %v, want %s", err, client.CodeIdempotencyKeyReused)
+	}
+}
+
+func TestListCarsPagesToLastPage(t *testing.T) {
+	ts := newTestServer(t, nil)
+	want := ts.seed(t, 5)
+
+	var got []int
+	it := ts.client.ListCars(context.Background(), client.ListOptions{PageSize: 2})
+	for it.Next() {
+		got = append(got, it.Car().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("ListCars: %v", err)
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("ListCars ids = %v, want %v", got, want)
+	}
+	// 5 машин по 2 на странице - 3 страницы, после последней запросов нет
+	if n := ts.listCalls.Load(); n != 3 {
+		t.Errorf("list requested %d times, want 3", n)
+	}
+}
+
+func TestGetCarSetsVersionFromETag(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.seed(t, 1)[0]
+	ctx := context.Background()
+
+	c, err := ts.client.GetCar(ctx, id)
+	if err != nil {
+		t.Fatalf("GetCar: %v", err)
+	}
+	if c.ID != id || c.Version != 1 {
+		t.Errorf("GetCar = id %d version %d, want id %d version 1", c.ID, c.Version, id)
+	}
+
+	if err := ts.client.PatchCar(ctx, id, client.CarPatch{Mark: client.Set("Kia")}, c.Version); err != nil {
+		t.Fatalf("PatchCar: %v", err)
+	}
+	c, err = ts.client.GetCar(ctx, id)
+	if err != nil {
+		t.Fatalf("GetCar after patch: %v", err)
+	}
+	if c.Version != 2 || c.Mark != "Kia" {
+		t.Errorf("GetCar after patch = version %d mark %q, want version 2 mark Kia", c.Version, c.Mark)
+	}
+
+	_, err = ts.client.GetCar(ctx, id+100)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("GetCar of missing car: err = %v, want ErrNotFound", err)
+	}
+}
+
+// getRaw выполняет GET без клиента и возвращает ответ с закрытым телом
+func (ts *testServer) getRaw(t *testing.T, token, path, ifNoneMatch string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.srv.URL+client.APIPrefix+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", token)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	resp, err := ts.srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestGetCarETagDependsOnRepresentation(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.seed(t, 1)[0]
+	path := fmt.Sprintf("/cars/%d", id)
+
+	full := ts.getRaw(t, testToken, path, "")
+	tag := full.Header.Get("ETag")
+	if !strings.HasPrefix(tag, `W/"1-`) {
+		t.Fatalf("ETag = %q, want weak ETag of version 1", tag)
+	}
+	if vary := full.Header.Get("Vary"); !strings.Contains(vary, "X-Schema-Version") || !strings.Contains(vary, "X-API-Key") {
+		t.Errorf("Vary = %q, want X-Schema-Version and X-API-Key", vary)
+	}
+
+	if resp := ts.getRaw(t, testToken, path, tag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("same representation: status = %d, want 304", resp.StatusCode)
+	}
+	// ответ с другими полями или с замаскированным владельцем не должен считаться тем же
+	for name, resp := range map[string]*http.Response{
+		"fields": ts.getRaw(t, testToken, path+"?fields=id,regNum", tag),
+		"masked": ts.getRaw(t, readerToken, path, tag),
+	} {
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", name, resp.StatusCode)
+		}
+		if resp.Header.Get("ETag") == tag {
+			t.Errorf("%s: ETag %q equals ETag of full representation", name, tag)
+		}
+	}
+
+	// ETag из GET принимается в If-Match
+	if err := ts.client.PatchCar(context.Background(), id, client.CarPatch{Mark: client.Set("Kia")}, 1); err != nil {
+		t.Fatalf("PatchCar: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPatch, ts.srv.URL+client.APIPrefix+path, strings.NewReader(`{"model":"Rio"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", testToken)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", tag)
+	resp, err := ts.srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with ETag of old version: status = %d, want 412", resp.StatusCode)
+	}
+}
+
+func TestPatchCarStaleVersion(t *testing.T) {
+	ts := newTestServer(t, nil)
+	id := ts.seed(t, 1)[0]
+	ctx := context.Background()
+
+	c, err := ts.client.GetCar(ctx, id)
+	if err != nil {
+		t.Fatalf("GetCar: %v", err)
+	}
+	if err := ts.client.PatchCar(ctx, id, client.CarPatch{Model: client.Set("Granta")}, c.Version); err != nil {
+		t.Fatalf("PatchCar: %v", err)
+	}
+
+	// версия из первого чтения уже устарела
+	err = ts.client.PatchCar(ctx, id, client.CarPatch{Model: client.Set("Niva")}, c.Version)
+	if !errors.Is(err, client.ErrVersionMismatch) {
+		t.Fatalf("PatchCar with stale version: err = %v, want ErrVersionMismatch", err)
+	}
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PatchCar with stale version: err = %v, want status 412", err)
+	}
+	if got := ts.storage.cars[id].Model; got != "Granta" {
+		t.Errorf("model = %q, stale patch must not be applied", got)
+	}
+}
+
+func TestRateLimitedRetryAfter(t *testing.T) {
+	ts := newTestServer(t, map[ratelimit.Budget]ratelimit.Limit{
+		ratelimit.Read: {Burst: 1, Period: time.Minute},
+	})
+	ctx := context.Background()
+
+	if _, err := ts.client.ListCarsPage(ctx, client.ListOptions{}, 1); err != nil {
+		t.Fatalf("first ListCarsPage: %v", err)
+	}
+
+	_, err := ts.client.ListCarsPage(ctx, client.ListOptions{}, 1)
+	if !errors.Is(err, client.ErrRateLimited) {
+		t.Fatalf("second ListCarsPage: err = %v, want ErrRateLimited", err)
+	}
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %T, want *client.Error", err)
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", apiErr.StatusCode)
+	}
+	// один токен восстанавливается за минуту
+	if apiErr.RetryAfter <= 0 || apiErr.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %v, want (0, 1m]", apiErr.RetryAfter)
+	}
+}
+
+func TestAddCarsBatchExceedsBurst(t *testing.T) {
+	ts := newTestServer(t, map[ratelimit.Budget]ratelimit.Limit{
+		ratelimit.CarInfo: {Burst: 1, Period: time.Minute},
+	})
+
+	// два номера не поместятся в корзину из одного токена и после ожидания
+	_, err := ts.client.AddCars(context.Background(), []string{"A001AA77", "B002BB77"}, "")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("AddCars over burst: err = %v, want status 422", err)
+	}
+	if !errors.Is(err, client.ErrValidation) {
+		t.Errorf("AddCars over burst: err = %v, want ErrValidation", err)
+	}
+	if n := ts.carInfo.calls.Load(); n != 0 {
+		t.Errorf("CarInfo called %d times, want 0", n)
+	}
+}
+
+func TestInvalidTokenIsRateLimitedByIP(t *testing.T) {
+	ts := newTestServer(t, map[ratelimit.Budget]ratelimit.Limit{
+		ratelimit.IP: {Burst: 2, Period: time.Minute},
+	})
+
+	// неверные токены списывают токены IP до аутентификации, третий запрос отклоняется без проверки токена
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		resp := ts.getRaw(t, "wrong-token-0123456789abcdef0123456789", "/cars", "")
+		if resp.StatusCode != want {
+			t.Fatalf("request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("429 without Retry-After")
+		}
+	}
+}
+
+func TestAddCarsRetryAfterRateLimitWithSameKey(t *testing.T) {
+	ts := newTestServer(t, map[ratelimit.Budget]ratelimit.Limit{
+		ratelimit.CarInfo: {Burst: 2, Period: 500 * time.Millisecond},
+	})
+	ctx := context.Background()
+
+	if _, err := ts.client.AddCars(ctx, []string{"A001AA77", "B002BB77"}, "add-1"); err != nil {
+		t.Fatalf("first AddCars: %v", err)
+	}
+
+	// корзина пуста, запрос отклоняется, но ключ не должен запомнить 429
+	_, err := ts.client.AddCars(ctx, []string{"C003CC77", "E004EE77"}, "add-2")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second AddCars: err = %v, want status 429", err)
+	}
+
+	time.Sleep(apiErr.RetryAfter)
+
+	res, err := ts.client.AddCars(ctx, []string{"C003CC77", "E004EE77"}, "add-2")
+	if err != nil {
+		t.Fatalf("AddCars retried after Retry-After: %v", err)
+	}
+	if len(res.CarIDs) != 2 {
+		t.Errorf("retried AddCars = %+v, want 2 cars", res)
+	}
+	if n := len(ts.storage.cars); n != 4 {
+		t.Errorf("storage has %d cars, want 4", n)
+	}
+}